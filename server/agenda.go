@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/model"
+)
+
+// responseStatuses maps the response status of an attendee to the text shown in agendas.
+var responseStatuses = map[string]string{
+	"accepted":    "Accepted",
+	"declined":    "Declined",
+	"tentative":   "Maybe",
+	"needsAction": "Not responded",
+}
+
+// executeAgendaCommand replies with the events of the user's calendar for the
+// range named by action: today, tomorrow or the coming week.
+func (p *Plugin) executeAgendaCommand(args *model.CommandArgs, action string, parameters []string) *model.CommandResponse {
+	calendarID, err := parseCalendarFlag(parameters)
+	if err != nil {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, err.Error())
+	}
+
+	userInfo, err := p.getUserInfo(args.UserId)
+	if err != nil || userInfo == nil {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, "Connect your Google Calendar first with `/google-calendar connect`.")
+	}
+
+	now := p.now().In(p.getUserLocation(args.UserId))
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+	var timeMin, timeMax time.Time
+	switch action {
+	case "today":
+		timeMin, timeMax = today, today.AddDate(0, 0, 1)
+	case "tomorrow":
+		timeMin, timeMax = today.AddDate(0, 0, 1), today.AddDate(0, 0, 2)
+	case "week":
+		timeMin, timeMax = today, today.AddDate(0, 0, 7)
+	}
+
+	events, err := p.listEvents(userInfo, calendarID, timeMin, timeMax)
+	if err != nil {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, fmt.Sprintf("Encountered an error fetching the events of calendar `%s`.", calendarID))
+	}
+
+	if len(events) == 0 {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, "No events scheduled.")
+	}
+
+	resp := getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, "")
+	resp.Attachments = generateAgendaAttachments(events, nil, timeMin, now)
+	return resp
+}
+
+// listEvents returns the events of a calendar of the user between timeMin and
+// timeMax, with recurring events expanded and ordered by their start.
+func (p *Plugin) listEvents(u *UserInfo, calendarID string, timeMin, timeMax time.Time) ([]*Event, error) {
+	provider, err := p.getCalendarProvider(u)
+	if err != nil {
+		return nil, err
+	}
+
+	return provider.ListEvents(calendarID, timeMin, timeMax)
+}
+
+// parseCalendarFlag returns the calendar given with --calendar, defaulting to the
+// primary calendar of the user.
+func parseCalendarFlag(parameters []string) (string, error) {
+	for index, parameter := range parameters {
+		if strings.HasPrefix(parameter, "--calendar=") {
+			return strings.TrimPrefix(parameter, "--calendar="), nil
+		}
+		if parameter == "--calendar" {
+			if index+1 == len(parameters) {
+				return "", errors.New("Missing calendar ID after `--calendar`.")
+			}
+			return parameters[index+1], nil
+		}
+	}
+
+	return "primary", nil
+}
+
+// generateAgendaAttachments renders the events, grouped by day, with one attachment
+// per day. Events that started before timeMin are listed on its day. Agendas
+// spanning several calendars pass the names of the calendars of the events, keyed
+// by event ID, to label them.
+func generateAgendaAttachments(events []*Event, calendarNames map[string]string, timeMin, now time.Time) []*model.SlackAttachment {
+	attachments := []*model.SlackAttachment{}
+	var attachment *model.SlackAttachment
+
+	for _, event := range events {
+		e := newEventInfo(event)
+		start, end, err := eventTimes(e, now.Location())
+		if err != nil {
+			continue
+		}
+
+		day := start
+		if day.Before(timeMin) {
+			day = timeMin
+		}
+
+		title := formatDay(day, now) + ", " + day.Format("January 2")
+		if attachment == nil || attachment.Title != title {
+			attachment = &model.SlackAttachment{
+				Title: title,
+				Color: "#7FC1EE",
+			}
+			attachments = append(attachments, attachment)
+		}
+
+		when := fmt.Sprintf("%s–%s", formatTime(start), formatTime(end))
+		if e.AllDay {
+			when = "All day"
+		}
+		attachment.Text += fmt.Sprintf("- **%s** %s\n", when, formatAgendaEvent(event, calendarNames[event.ID]))
+	}
+
+	return attachments
+}
+
+// formatAgendaEvent describes an event in an agenda: its linked title followed by
+// the location, meeting link, response status and calendar name, if any.
+func formatAgendaEvent(event *Event, calendarName string) string {
+	summary := event.Summary
+	if summary == "" {
+		summary = "(No title)"
+	}
+
+	details := []string{fmt.Sprintf("[%s](%s)", summary, event.HTMLLink)}
+
+	if event.Location != "" {
+		details = append(details, event.Location)
+	}
+
+	if event.MeetingLink != "" {
+		details = append(details, fmt.Sprintf("[Join meeting](%s)", event.MeetingLink))
+	}
+
+	if status, ok := responseStatuses[event.ResponseStatus]; ok {
+		details = append(details, "_"+status+"_")
+	}
+
+	if calendarName != "" {
+		details = append(details, calendarName)
+	}
+
+	return strings.Join(details, " · ")
+}
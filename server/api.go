@@ -1,18 +1,28 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"google.golang.org/api/calendar/v3"
 	"net/http"
 	"strings"
+	"time"
 
 	"context"
 	"github.com/mattermost/mattermost-server/mlog"
-	"github.com/mattermost/mattermost-server/model"
 	"github.com/mattermost/mattermost-server/plugin"
 	"golang.org/x/oauth2"
 )
 
+const (
+	oauthStateKeyPrefix = "oauthstate_"
+
+	// oauthStateExpiry is how long a user has to complete connecting their calendar.
+	oauthStateExpiry = 10 * time.Minute
+)
+
 func (p *Plugin) ServeHTTP(c *plugin.Context, w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	switch path := r.URL.Path; path {
@@ -22,11 +32,28 @@ func (p *Plugin) ServeHTTP(c *plugin.Context, w http.ResponseWriter, r *http.Req
 		p.completeGoogleCalendarOauth(w, r)
 	case "/watch":
 		p.watchGoogleCalendar(w, r)
+	case "/event/respond":
+		p.respondToEvent(w, r)
+	case "/dialog/create":
+		p.submitCreateEventDialog(w, r)
+	case "/dialog/caldav":
+		p.submitConnectCalDAVDialog(w, r)
+	case "/meet-channel/schedule":
+		p.scheduleChannelMeeting(w, r)
 	default:
 		http.NotFound(w, r)
 	}
 }
 
+// signIntegrationRequest returns the signature of the values passed to the buttons
+// and dialogs of the plugin. Mattermost doesn't authenticate the requests they send
+// back, so the signature proves the values were set by the plugin.
+func (p *Plugin) signIntegrationRequest(values ...string) string {
+	mac := hmac.New(sha256.New, []byte(p.getConfiguration().Secret))
+	mac.Write([]byte(strings.Join(values, "|")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
 func (p *Plugin) connectUserToGoogleCalendar(w http.ResponseWriter, r *http.Request) {
 	userID := r.Header.Get("Mattermost-User-ID")
 	if userID == "" {
@@ -34,9 +61,21 @@ func (p *Plugin) connectUserToGoogleCalendar(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	state := fmt.Sprintf("%v_%v", model.NewId()[10], userID)
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		mlog.Error("Error generating the OAuth state " + err.Error())
+		http.Error(w, "Encountered an error connecting to Google Calendar", http.StatusInternalServerError)
+		return
+	}
+	state := hex.EncodeToString(nonce)
 
-	p.API.KVSet(state, []byte(state))
+	// The state is bound to the user who started connecting and expires if the
+	// flow isn't completed in time.
+	if appErr := p.API.KVSetWithExpiry(oauthStateKeyPrefix+state, []byte(userID), int64(oauthStateExpiry/time.Second)); appErr != nil {
+		mlog.Error("Error storing the OAuth state " + appErr.Error())
+		http.Error(w, "Encountered an error connecting to Google Calendar", http.StatusInternalServerError)
+		return
+	}
 
 	googleOauthConfig := p.getOAuthConfig()
 
@@ -46,28 +85,45 @@ func (p *Plugin) connectUserToGoogleCalendar(w http.ResponseWriter, r *http.Requ
 }
 
 func (p *Plugin) completeGoogleCalendarOauth(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("Mattermost-User-ID")
+	if userID == "" {
+		writeOAuthPage(w, http.StatusUnauthorized, "Log in to Mattermost and try connecting your Google Calendar again.", false)
+		return
+	}
+
+	// The state is deleted right away so it can't be used twice.
 	state := r.FormValue("state")
-	storedState, _ := p.API.KVGet(state)
+	storedUserID, appErr := p.API.KVGet(oauthStateKeyPrefix + state)
+	if appErr == nil && storedUserID != nil {
+		p.API.KVDelete(oauthStateKeyPrefix + state)
+	}
 
-	if string(storedState) != state {
-		http.Error(w, "invalid state", http.StatusBadRequest)
+	if state == "" || appErr != nil || string(storedUserID) != userID {
+		writeOAuthPage(w, http.StatusBadRequest, "This link is invalid or has expired. Run <code>/google-calendar connect</code> to try again.", false)
 		return
 	}
 
-	userID := strings.Split(state, "_")[1]
+	if reason := r.FormValue("error"); reason != "" {
+		if reason == "access_denied" {
+			writeOAuthPage(w, http.StatusOK, "Access to your Google Calendar was denied, so it wasn't connected. Run <code>/google-calendar connect</code> to try again.", false)
+			return
+		}
+		mlog.Error("Google Calendar authorization failed", mlog.String("user_id", userID), mlog.String("error", reason))
+		writeOAuthPage(w, http.StatusBadRequest, "Google Calendar authorization failed. Run <code>/google-calendar connect</code> to try again.", false)
+		return
+	}
 
 	code := r.FormValue("code")
 	googleOauthConfig := p.getOAuthConfig()
 	token, err := googleOauthConfig.Exchange(context.TODO(), code)
-
-	if !token.Valid() {
-		fmt.Fprintln(w, "Retreived invalid token")
+	if err != nil {
+		mlog.Error("oauthConf.Exchange() failed with " + err.Error())
+		writeOAuthPage(w, http.StatusBadGateway, "Encountered an error connecting to Google Calendar. Run <code>/google-calendar connect</code> to try again.", false)
 		return
 	}
 
-	if err != nil {
-		mlog.Error("oauthConf.Exchange() failed with" + err.Error())
-		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+	if !token.Valid() {
+		writeOAuthPage(w, http.StatusBadGateway, "Google Calendar returned an invalid token. Run <code>/google-calendar connect</code> to try again.", false)
 		return
 	}
 
@@ -76,50 +132,75 @@ func (p *Plugin) completeGoogleCalendarOauth(w http.ResponseWriter, r *http.Requ
 		Token:  token,
 	}
 
-	userInfo.ChannelID, _ = p.getDirectChannel(userInfo)
-
-	p.storeUserInfo(userInfo)
-
-	var calendarInfo CalendarInfo
-
-	p.storeCalendarInfo(userID, &calendarInfo)
+	if err := p.connectUser(userInfo); err != nil {
+		writeOAuthPage(w, http.StatusInternalServerError, "Encountered an error connecting to Google Calendar.", false)
+		return
+	}
 
-	p.subscribeToCalendar(userInfo)
+	writeOAuthPage(w, http.StatusOK, "Completed connecting to Google Calendar. Please close this window.", true)
+}
 
-	p.createBotDMPost(userInfo)
+// writeOAuthPage renders the page shown at the end of the OAuth flow, closing the
+// window automatically if closeWindow is set.
+func writeOAuthPage(w http.ResponseWriter, status int, message string, closeWindow bool) {
+	script := ""
+	if closeWindow {
+		script = "<script>window.close();</script>"
+	}
 
-	html := `
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `
 <!DOCTYPE html>
 <html>
 	<head>
-		<script>
-			window.close();
-		</script>
+		%s
 	</head>
 	<body>
-		<p>Completed connecting to Google Calendar. Please close this window.</p>
+		<p>%s</p>
 	</body>
 </html>
-`
-
-	w.Header().Set("Content-Type", "text/html")
-	w.Write([]byte(html))
+`, script, message)
 }
 
+// watchGoogleCalendar handles the notifications of the watch channels. Only the
+// notifications carrying the token of the current channel of a calendar of the
+// user trigger an update; anything else, including the notifications of channels
+// created before their token was stored, is rejected without calling Google.
 func (p *Plugin) watchGoogleCalendar(w http.ResponseWriter, r *http.Request) {
 	channelID := r.Header.Get("X-Goog-Channel-ID")
-	resourceID := r.Header.Get("X-Goog-Resource-ID")
+	token := r.Header.Get("X-Goog-Channel-Token")
 	state := r.Header.Get("X-Goog-Resource-State")
-
 	userID := r.URL.Query().Get("userID")
-	userInfo, _ := p.getUserInfo(userID)
+
+	if userID == "" || channelID == "" {
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	var subscribedCalendar *SubscribedCalendar
 	calendarInfo, _ := p.getCalendarInfo(userID)
+	if calendarInfo != nil {
+		subscribedCalendar = calendarInfo.getCalendarByWatchToken(channelID)
+	}
+
+	if subscribedCalendar == nil || subscribedCalendar.WatchSecret == "" || !hmac.Equal([]byte(token), []byte(subscribedCalendar.WatchSecret)) {
+		mlog.Warn("Rejected a watch notification with an invalid token", mlog.String("user_id", userID), mlog.String("channel_id", channelID))
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	userInfo, _ := p.getUserInfo(userID)
+	if userInfo == nil {
+		// The user's credentials can't be decrypted. They are disconnected by the
+		// scheduler and the channel stops when it expires.
+		mlog.Info("Ignored a watch notification for a disconnected user", mlog.String("user_id", userID), mlog.String("channel_id", channelID))
+		return
+	}
 
-	if calendarInfo.CalendarWatchToken == channelID && state == "exists" {
-		_ = p.updateCalendarEvents(userInfo, calendarInfo)
-	} else {
-		calendarService, _ := p.createCalendarService(userInfo)
-		stopChannel := calendarService.Channels.Stop(&calendar.Channel{Id: channelID, ResourceId: resourceID})
-		stopChannel.Do()
+	if state == "exists" {
+		if err := p.updateCalendarEvents(userInfo, subscribedCalendar.ID); err != nil {
+			mlog.Error("Error updating the calendar events", mlog.String("user_id", userID), mlog.Err(err))
+		}
 	}
 }
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/waseem18/mattermost-plugin-google-calendar/server/fakegoogle"
+)
+
+func TestOAuthFlow(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+
+	userInfo := e.connected(t, testUserID)
+	assert.Equal(t, directChannelID(testUserID), userInfo.ChannelID)
+	assert.NotEmpty(t, userInfo.Token.RefreshToken)
+
+	calendarInfo, err := e.p.getCalendarInfo(testUserID)
+	require.NoError(t, err)
+	require.Len(t, calendarInfo.Calendars, 1)
+	primary := calendarInfo.Calendars[0]
+	assert.Equal(t, "primary", primary.ID)
+	assert.NotEmpty(t, primary.SyncToken)
+
+	channels := e.google.Channels()
+	require.Len(t, channels, 1)
+	assert.Equal(t, primary.WatchToken, channels[0].Id)
+	assert.Equal(t, primary.WatchResourceID, channels[0].ResourceId)
+
+	connectedUsers, err := e.p.getConnectedUsers()
+	require.NoError(t, err)
+	assert.Equal(t, []string{testUserID}, connectedUsers)
+
+	posts := e.channelPosts(directChannelID(testUserID))
+	require.Len(t, posts, 1)
+	assert.Equal(t, welcomeMessage, posts[0].Message)
+	assert.Equal(t, testBotID, posts[0].UserId)
+}
+
+func TestOAuthFlowDeniedConsent(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	e.google.DenyConsent = true
+
+	resp := e.connect(t, testUserID)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	userInfo, err := e.p.getUserInfo(testUserID)
+	require.NoError(t, err)
+	assert.Nil(t, userInfo)
+	assert.Empty(t, e.channelPosts(directChannelID(testUserID)))
+}
+
+// startOAuth starts connecting as the user and returns the URL the fake
+// authorization endpoint redirects the browser back to.
+func (e *testEnv) startOAuth(t *testing.T, userID string) string {
+	// The browser stops at the fake authorization endpoint, which redirects back
+	// to the plugin with the state and code.
+	client := &http.Client{
+		CheckRedirect: func(r *http.Request, via []*http.Request) error {
+			if len(via) > 1 {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+	request, err := http.NewRequest(http.MethodGet, e.mattermost.URL+"/plugins/google-calendar/oauth/connect", nil)
+	require.NoError(t, err)
+	request.Header.Set("Mattermost-User-ID", userID)
+	resp, err := client.Do(request)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	return resp.Header.Get("Location")
+}
+
+// completeOAuth follows the redirect back to the plugin as the user and
+// returns the status code of the response.
+func completeOAuth(t *testing.T, userID, rawURL string) int {
+	request, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	require.NoError(t, err)
+	if userID != "" {
+		request.Header.Set("Mattermost-User-ID", userID)
+	}
+	resp, err := http.DefaultClient.Do(request)
+	require.NoError(t, err)
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestOAuthCompleteChecksState(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	completeURL := e.startOAuth(t, testUserID)
+
+	assert.Equal(t, http.StatusUnauthorized, completeOAuth(t, "", completeURL))
+
+	parsed, err := url.Parse(completeURL)
+	require.NoError(t, err)
+	forged := *parsed
+	query := forged.Query()
+	query.Set("state", "forged")
+	forged.RawQuery = query.Encode()
+	assert.Equal(t, http.StatusBadRequest, completeOAuth(t, testUserID, forged.String()))
+
+	// The state can only be used by the user who started connecting, and only once.
+	assert.Equal(t, http.StatusBadRequest, completeOAuth(t, "user2", completeURL))
+	assert.Equal(t, http.StatusBadRequest, completeOAuth(t, testUserID, completeURL))
+
+	for _, userID := range []string{testUserID, "user2"} {
+		userInfo, err := e.p.getUserInfo(userID)
+		require.NoError(t, err)
+		assert.Nil(t, userInfo)
+	}
+}
+
+func TestOAuthStateExpires(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		after     time.Duration
+		status    int
+		connected bool
+	}{
+		{"completed in time", oauthStateExpiry - time.Second, http.StatusOK, true},
+		{"completed too late", oauthStateExpiry, http.StatusBadRequest, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			defer e.close()
+			completeURL := e.startOAuth(t, testUserID)
+
+			e.clock.set(e.clock.Now().Add(tc.after))
+			assert.Equal(t, tc.status, completeOAuth(t, testUserID, completeURL))
+
+			userInfo, err := e.p.getUserInfo(testUserID)
+			require.NoError(t, err)
+			assert.Equal(t, tc.connected, userInfo != nil)
+		})
+	}
+}
+
+func TestWatchNotification(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	e.connected(t, testUserID)
+
+	e.addEvent(t, fakegoogle.PrimaryCalendarID, "All hands", time.Hour, time.Hour)
+	require.NoError(t, e.google.Notify(fakegoogle.PrimaryCalendarID))
+	assert.Equal(t, []string{"All hands"}, e.storedEvents(t, testUserID))
+
+	// Notifications with an invalid token are rejected.
+	channel := e.google.Channels()[0]
+	request, err := http.NewRequest(http.MethodPost, e.mattermost.URL+"/plugins/google-calendar/watch?userID="+testUserID, nil)
+	require.NoError(t, err)
+	request.Header.Set("X-Goog-Channel-ID", channel.Id)
+	request.Header.Set("X-Goog-Channel-Token", "forged")
+	request.Header.Set("X-Goog-Resource-State", "exists")
+	resp, err := http.DefaultClient.Do(request)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestWatchChannelWithoutSecretIsReplaced(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	e.connected(t, testUserID)
+	previous := e.google.Channels()[0]
+
+	// Channels created before their token was stored carry no secret.
+	_, err := e.p.updateCalendarInfo(testUserID, func(calendarInfo *CalendarInfo) bool {
+		calendarInfo.getCalendar("primary").WatchSecret = ""
+		return true
+	})
+	require.NoError(t, err)
+
+	notify := func(channelID, token string) int {
+		request, err := http.NewRequest(http.MethodPost, e.mattermost.URL+"/plugins/google-calendar/watch?userID="+testUserID, nil)
+		require.NoError(t, err)
+		request.Header.Set("X-Goog-Channel-ID", channelID)
+		request.Header.Set("X-Goog-Channel-Token", token)
+		request.Header.Set("X-Goog-Resource-State", "exists")
+		resp, err := http.DefaultClient.Do(request)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	e.addEvent(t, fakegoogle.PrimaryCalendarID, "Sprint review", time.Hour, time.Hour)
+	for _, token := range []string{"", previous.Token, e.p.signIntegrationRequest("watch", testUserID, previous.Id)} {
+		assert.Equal(t, http.StatusUnauthorized, notify(previous.Id, token))
+	}
+	assert.Empty(t, e.storedEvents(t, testUserID))
+
+	// The channel is replaced without waiting for it to expire.
+	require.NoError(t, e.p.setupWatchRenewal(testUserID))
+	channels := e.google.Channels()
+	require.Len(t, channels, 1)
+	assert.NotEqual(t, previous.Id, channels[0].Id)
+
+	require.NoError(t, e.google.Notify(fakegoogle.PrimaryCalendarID))
+	assert.Equal(t, []string{"Sprint review"}, e.storedEvents(t, testUserID))
+}
+
+func TestWatchRenewalStopsPreviousChannel(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	userInfo := e.connected(t, testUserID)
+	previous := e.google.Channels()[0]
+
+	require.NoError(t, e.p.setupCalendarWatchService(userInfo, "primary"))
+
+	channels := e.google.Channels()
+	require.Len(t, channels, 1)
+	assert.NotEqual(t, previous.Id, channels[0].Id)
+
+	// Notifications of the previous channel, whose token was discarded, are
+	// rejected without syncing.
+	e.addEvent(t, fakegoogle.PrimaryCalendarID, "Sprint review", time.Hour, time.Hour)
+	request, err := http.NewRequest(http.MethodPost, e.mattermost.URL+"/plugins/google-calendar/watch?userID="+testUserID, nil)
+	require.NoError(t, err)
+	request.Header.Set("X-Goog-Channel-ID", previous.Id)
+	request.Header.Set("X-Goog-Channel-Token", previous.Token)
+	request.Header.Set("X-Goog-Resource-State", "exists")
+	resp, err := http.DefaultClient.Do(request)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Empty(t, e.storedEvents(t, testUserID))
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/mlog"
+	"github.com/mattermost/mattermost-server/model"
+)
+
+// Values of UserSettings.AvailabilityVisibility.
+const (
+	availabilityEveryone = "everyone"
+	availabilityTeam     = "team"
+	availabilityNobody   = "nobody"
+)
+
+// executeAvailabilityCommand replies with the busy blocks and next free slot of
+// another user on a given day. Only free/busy information is looked up, never the
+// details of the events.
+func (p *Plugin) executeAvailabilityCommand(args *model.CommandArgs, parameters []string) *model.CommandResponse {
+	if len(parameters) == 0 {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, "Use `/google-calendar availability @username [today|tomorrow|YYYY-MM-DD]`.")
+	}
+
+	username := strings.TrimPrefix(parameters[0], "@")
+	user, appErr := p.API.GetUserByUsername(username)
+	if appErr != nil {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, fmt.Sprintf("Unknown user `@%s`.", username))
+	}
+
+	now := p.now().In(p.getUserLocation(args.UserId))
+	day := "today"
+	if len(parameters) > 1 {
+		day = parameters[1]
+	}
+
+	dayStart, err := parseEventStart(day, "0:00", now)
+	if err != nil {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, err.Error())
+	}
+
+	if !p.canSeeAvailability(args.UserId, args.TeamId, user.Id) {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, fmt.Sprintf("@%s doesn't share their availability with you.", user.Username))
+	}
+
+	if userInfo, err := p.getUserInfo(user.Id); err != nil || userInfo == nil {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, fmt.Sprintf("@%s hasn't connected their Google Calendar.", user.Username))
+	}
+
+	dayEnd := dayStart.AddDate(0, 0, 1)
+	busy, err := p.getBusyTime(user, dayStart, dayEnd)
+	if err != nil {
+		mlog.Error("Error fetching free/busy information", mlog.String("user_id", user.Id), mlog.Err(err))
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, fmt.Sprintf("Encountered an error fetching the availability of @%s.", user.Username))
+	}
+
+	resp := getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, "")
+	resp.Attachments = []*model.SlackAttachment{{
+		Pretext: fmt.Sprintf("Availability of @%s", user.Username),
+		Title:   formatDay(dayStart, now) + ", " + dayStart.Format("January 2"),
+		Color:   "#7FC1EE",
+		Fields: []*model.SlackAttachmentField{
+			{Title: "Busy", Value: formatBusyBlocks(busy, dayStart, dayEnd)},
+			{Title: "Next free slot", Value: formatNextFreeSlot(busy, dayStart, now)},
+		},
+		Footer: "Times are shown in your timezone",
+	}}
+	return resp
+}
+
+// canSeeAvailability returns whether the requester may look up the availability of
+// the target user, according to the privacy setting of the target user.
+func (p *Plugin) canSeeAvailability(requesterID, teamID, targetID string) bool {
+	if requesterID == targetID {
+		return true
+	}
+
+	settings, err := p.getUserSettings(targetID)
+	if err != nil {
+		return false
+	}
+
+	switch settings.AvailabilityVisibility {
+	case availabilityEveryone:
+		return true
+	case availabilityTeam:
+		if teamID == "" {
+			return false
+		}
+		if _, appErr := p.API.GetTeamMember(teamID, requesterID); appErr != nil {
+			return false
+		}
+		_, appErr := p.API.GetTeamMember(teamID, targetID)
+		return appErr == nil
+	default:
+		return false
+	}
+}
+
+// formatBusyBlocks lists the busy periods, clipped to the day between dayStart and dayEnd.
+func formatBusyBlocks(busy []interval, dayStart, dayEnd time.Time) string {
+	blocks := []string{}
+	for _, period := range busy {
+		start, end := period.start.In(dayStart.Location()), period.end.In(dayStart.Location())
+		if start.Before(dayStart) {
+			start = dayStart
+		}
+		if end.After(dayEnd) {
+			end = dayEnd
+		}
+
+		if start.Equal(dayStart) && end.Equal(dayEnd) {
+			blocks = append(blocks, "- All day")
+		} else {
+			blocks = append(blocks, fmt.Sprintf("- %s–%s", formatTime(start), formatTime(end)))
+		}
+	}
+
+	if len(blocks) == 0 {
+		return "Free all day"
+	}
+	return strings.Join(blocks, "\n")
+}
+
+// formatNextFreeSlot describes the first free time of at least minFreeTime during
+// the working hours of the day starting at dayStart, not earlier than now.
+func formatNextFreeSlot(busy []interval, dayStart, now time.Time) string {
+	free := time.Date(dayStart.Year(), dayStart.Month(), dayStart.Day(), workdayStart, 0, 0, 0, dayStart.Location())
+	workdayEndTime := time.Date(dayStart.Year(), dayStart.Month(), dayStart.Day(), workdayEnd, 0, 0, 0, dayStart.Location())
+	if free.Before(now) {
+		free = now
+	}
+
+	for _, period := range append(busy, interval{start: workdayEndTime, end: workdayEndTime}) {
+		start := period.start
+		if start.After(workdayEndTime) {
+			start = workdayEndTime
+		}
+		if start.Sub(free) >= minFreeTime {
+			return fmt.Sprintf("%s–%s", formatTime(free), formatTime(start.In(dayStart.Location())))
+		}
+		if period.end.After(free) {
+			free = period.end.In(dayStart.Location())
+		}
+	}
+
+	return "None during working hours"
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/mattermost/mattermost-server/mlog"
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	botUserIDKey = "bot_user_id"
+
+	botUsername    = "google-calendar"
+	botDisplayName = "Google Calendar"
+	botDescription = "Posts reminders and agendas from Google Calendar."
+
+	// botIconPath is the path, relative to the plugin bundle, of the profile image of the bot.
+	botIconPath = "assets/Google_Calendar_Logo.png"
+)
+
+// ensureBot returns the ID of the plugin's bot account, creating it if needed, and
+// sets its profile image.
+func (p *Plugin) ensureBot() (string, error) {
+	botUserID := ""
+
+	if stored, appErr := p.API.KVGet(botUserIDKey); appErr != nil {
+		return "", appErr
+	} else if stored != nil {
+		if bot, appErr := p.API.GetBot(string(stored), true); appErr == nil {
+			botUserID = bot.UserId
+			if bot.DeleteAt != 0 {
+				if _, appErr := p.API.UpdateBotActive(botUserID, true); appErr != nil {
+					return "", appErr
+				}
+			}
+		}
+	}
+
+	if botUserID == "" {
+		bot, appErr := p.API.CreateBot(&model.Bot{
+			Username:    botUsername,
+			DisplayName: botDisplayName,
+			Description: botDescription,
+		})
+		if appErr != nil {
+			// The bot may exist without its ID having been stored, e.g. if storing it failed.
+			user, userErr := p.API.GetUserByUsername(botUsername)
+			if userErr != nil || !user.IsBot {
+				return "", errors.Wrap(appErr, "failed to create the bot account")
+			}
+			botUserID = user.Id
+		} else {
+			botUserID = bot.UserId
+		}
+
+		if appErr := p.API.KVSet(botUserIDKey, []byte(botUserID)); appErr != nil {
+			return "", appErr
+		}
+	}
+
+	if err := p.setBotProfileImage(botUserID); err != nil {
+		mlog.Warn("Unable to set the profile image of the bot", mlog.Err(err))
+	}
+
+	return botUserID, nil
+}
+
+// setBotProfileImage sets the calendar icon bundled with the plugin as the profile image of the bot.
+func (p *Plugin) setBotProfileImage(botUserID string) error {
+	bundlePath, err := p.API.GetBundlePath()
+	if err != nil {
+		return err
+	}
+
+	icon, err := ioutil.ReadFile(filepath.Join(bundlePath, botIconPath))
+	if err != nil {
+		return err
+	}
+
+	if appErr := p.API.SetProfileImage(botUserID, icon); appErr != nil {
+		return appErr
+	}
+	return nil
+}
+
+// createBotPost creates a post as the bot. When posting as the configured user
+// instead, the post is overridden to show the name and icon of the plugin.
+func (p *Plugin) createBotPost(post *model.Post) (*model.Post, *model.AppError) {
+	post.UserId = p.BotUserID
+
+	if p.postAsConfiguredUser {
+		if post.Props == nil {
+			post.Props = map[string]interface{}{}
+		}
+		post.Props["from_webhook"] = "true"
+		post.Props["override_username"] = BotUsername
+		post.Props["override_icon_url"] = CalendarIconURL
+	}
+
+	return p.API.CreatePost(post)
+}
@@ -0,0 +1,799 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/mlog"
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/pkg/errors"
+)
+
+// caldavResponseStatuses maps the participation statuses of iCalendar to the
+// response statuses used by the plugin.
+var caldavResponseStatuses = map[string]string{
+	"NEEDS-ACTION": "needsAction",
+	"ACCEPTED":     "accepted",
+	"DECLINED":     "declined",
+	"TENTATIVE":    "tentative",
+}
+
+// CalDAVAccount captures the account of a user who connected a calendar of the
+// CalDAV server configured in CalDAVServerURL, e.g. Nextcloud or Radicale.
+type CalDAVAccount struct {
+	// CalendarHomeURL is the collection holding the calendars of the user,
+	// discovered when connecting.
+	CalendarHomeURL string
+	Username        string
+
+	// Password is the password or app password of the user. It is stored
+	// encrypted in storedUserInfo.EncryptedPassword.
+	Password string `json:"-"`
+
+	// Addresses are the email addresses of the user on the server, used to find
+	// them among the organizer and attendees of events.
+	Addresses []string
+}
+
+// caldavProvider gives access to the calendars of a user on a CalDAV server.
+// Calendars are identified by the path of their collection, and events by the
+// path of their resource followed by "#" and their recurrence ID for the
+// occurrences of recurring events.
+type caldavProvider struct {
+	account *CalDAVAccount
+	client  *webdavClient
+	homeURL *url.URL
+	now     func() time.Time
+
+	// calendars caches the calendars of the user, see ListCalendars.
+	calendars []*caldavCalendar
+}
+
+// caldavCalendar captures a calendar collection of the user.
+type caldavCalendar struct {
+	Calendar
+	url *url.URL
+}
+
+// caldavSyncState is what the sync tokens of CalDAV calendars encode. Changes
+// are detected with the CTag of the calendar, if the server supports it, and the
+// ETags of the events of the sync window.
+type caldavSyncState struct {
+	CTag      string
+	Resources map[string]caldavResource
+}
+
+// caldavResource captures an event resource as of the last sync.
+type caldavResource struct {
+	ETag     string
+	EventIDs []string
+}
+
+// newCalDAVProvider returns the CalDAV provider of the user.
+func (p *Plugin) newCalDAVProvider(u *UserInfo) (*caldavProvider, error) {
+	homeURL, err := url.Parse(u.CalDAV.CalendarHomeURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &caldavProvider{
+		account: u.CalDAV,
+		client:  newWebdavClient(homeURL, u.CalDAV.Username, u.CalDAV.Password),
+		homeURL: homeURL,
+		now:     p.now,
+	}, nil
+}
+
+// ListCalendars returns the calendars in the calendar home of the user. The
+// first one is the primary calendar.
+func (c *caldavProvider) ListCalendars() ([]*Calendar, error) {
+	calendars, err := c.listCalendars()
+	if err != nil {
+		return nil, err
+	}
+
+	list := []*Calendar{}
+	for _, calendar := range calendars {
+		entry := calendar.Calendar
+		list = append(list, &entry)
+	}
+	return list, nil
+}
+
+func (c *caldavProvider) listCalendars() ([]*caldavCalendar, error) {
+	if c.calendars != nil {
+		return c.calendars, nil
+	}
+
+	ms, err := c.client.propfind(c.homeURL.String(), "1", "<d:resourcetype/><d:displayname/><c:supported-calendar-component-set/>")
+	if err != nil {
+		return nil, err
+	}
+
+	calendars := []*caldavCalendar{}
+	for _, response := range ms.Responses {
+		calendar, err := newCalDAVCalendar(ms, response)
+		if err != nil {
+			return nil, err
+		}
+		if calendar != nil {
+			calendar.Primary = len(calendars) == 0
+			calendars = append(calendars, calendar)
+		}
+	}
+	if len(calendars) == 0 {
+		return nil, errors.New("the user has no calendar")
+	}
+
+	c.calendars = calendars
+	return calendars, nil
+}
+
+// newCalDAVCalendar returns the calendar described by a response to a PROPFIND
+// request, or nil if the resource isn't a calendar of events.
+func newCalDAVCalendar(ms *multistatus, response davResponse) (*caldavCalendar, error) {
+	prop := response.prop()
+	if !prop.isCalendar() {
+		return nil, nil
+	}
+
+	calendarURL, err := ms.resolve(response.Href)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := prop.DisplayName
+	if summary == "" {
+		segments := strings.Split(strings.TrimSuffix(calendarURL.Path, "/"), "/")
+		summary = segments[len(segments)-1]
+	}
+
+	return &caldavCalendar{
+		Calendar: Calendar{ID: calendarURL.EscapedPath(), Summary: summary},
+		url:      calendarURL,
+	}, nil
+}
+
+// GetCalendar returns a calendar of the user, including calendars outside of
+// their calendar home, e.g. shared with them.
+func (c *caldavProvider) GetCalendar(calendarID string) (*Calendar, error) {
+	calendar, err := c.getCalendar(calendarID)
+	if err != nil {
+		return nil, err
+	}
+	entry := calendar.Calendar
+	return &entry, nil
+}
+
+func (c *caldavProvider) getCalendar(calendarID string) (*caldavCalendar, error) {
+	calendars, err := c.listCalendars()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, calendar := range calendars {
+		if calendarID == calendar.ID || (calendarID == "primary" && calendar.Primary) {
+			return calendar, nil
+		}
+	}
+
+	calendarURL, err := resolvePath(c.homeURL, calendarID)
+	if err != nil {
+		return nil, err
+	}
+
+	ms, err := c.client.propfind(calendarURL.String(), "0", "<d:resourcetype/><d:displayname/><c:supported-calendar-component-set/>")
+	if err != nil {
+		return nil, err
+	}
+	for _, response := range ms.Responses {
+		if calendar, err := newCalDAVCalendar(ms, response); err != nil || calendar != nil {
+			return calendar, err
+		}
+	}
+	return nil, fmt.Errorf("%s isn't a calendar", calendarID)
+}
+
+// ListEvents returns the events of a calendar between timeMin and timeMax, with
+// recurring events expanded by the server.
+func (c *caldavProvider) ListEvents(calendarID string, timeMin, timeMax time.Time) ([]*Event, error) {
+	calendar, err := c.getCalendar(calendarID)
+	if err != nil {
+		return nil, err
+	}
+
+	ms, err := c.client.report(calendar.url.String(), "1", calendarQuery(timeMin, timeMax, true))
+	if err != nil {
+		return nil, err
+	}
+
+	events := []*Event{}
+	starts := map[*Event]time.Time{}
+	for _, response := range ms.Responses {
+		resourceEvents, err := c.parseResponseEvents(ms, response)
+		if err != nil {
+			return nil, err
+		}
+		for _, event := range resourceEvents {
+			if event.Status == "cancelled" {
+				continue
+			}
+			starts[event], _, _ = eventTimes(newEventInfo(event), timeMin.Location())
+			events = append(events, event)
+		}
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return starts[events[i]].Before(starts[events[j]])
+	})
+	return events, nil
+}
+
+// SyncEvents returns the changes to the events of a calendar during the sync
+// window starting at timeMin. CalDAV servers only expand recurring events within
+// a time range, so events starting later than syncWindow ahead aren't synced.
+// Events leaving the sync window are returned as cancelled.
+func (c *caldavProvider) SyncEvents(calendarID, syncToken string, timeMin time.Time) ([]*Event, string, error) {
+	calendar, err := c.getCalendar(calendarID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	previous := caldavSyncState{}
+	if syncToken != "" {
+		if err := json.Unmarshal([]byte(syncToken), &previous); err != nil {
+			return nil, "", errors.Wrap(errSyncTokenExpired, err.Error())
+		}
+	}
+
+	ms, err := c.client.propfind(calendar.url.String(), "0", "<cs:getctag/>")
+	if err != nil {
+		return nil, "", err
+	}
+	state := caldavSyncState{Resources: map[string]caldavResource{}}
+	for _, response := range ms.Responses {
+		state.CTag = response.prop().CTag
+	}
+
+	if syncToken != "" && state.CTag != "" && state.CTag == previous.CTag {
+		return []*Event{}, syncToken, nil
+	}
+
+	timeMax := timeMin.Add(syncWindow)
+	events := []*Event{}
+	if syncToken == "" {
+		ms, err := c.client.report(calendar.url.String(), "1", calendarQuery(timeMin, timeMax, true))
+		if err != nil {
+			return nil, "", err
+		}
+		if events, err = c.collectEvents(ms, state); err != nil {
+			return nil, "", err
+		}
+	} else {
+		// Only the events whose ETag changed are fetched.
+		ms, err := c.client.report(calendar.url.String(), "1", calendarQuery(timeMin, timeMax, false))
+		if err != nil {
+			return nil, "", err
+		}
+
+		changed := []string{}
+		for _, response := range ms.Responses {
+			resourceURL, err := ms.resolve(response.Href)
+			if err != nil {
+				return nil, "", err
+			}
+			href := resourceURL.EscapedPath()
+			etag := response.prop().ETag
+			if resource, ok := previous.Resources[href]; ok && resource.ETag == etag {
+				state.Resources[href] = resource
+				continue
+			}
+			changed = append(changed, href)
+		}
+
+		if len(changed) > 0 {
+			ms, err := c.client.report(calendar.url.String(), "1", calendarMultiget(changed, timeMin, timeMax))
+			if err != nil {
+				return nil, "", err
+			}
+			if events, err = c.collectEvents(ms, state); err != nil {
+				return nil, "", err
+			}
+		}
+	}
+
+	// The events that are no longer found were deleted or left the sync window.
+	current := map[string]bool{}
+	for _, resource := range state.Resources {
+		for _, eventID := range resource.EventIDs {
+			current[eventID] = true
+		}
+	}
+	for _, resource := range previous.Resources {
+		for _, eventID := range resource.EventIDs {
+			if !current[eventID] {
+				events = append(events, &Event{ID: eventID, Status: "cancelled"})
+			}
+		}
+	}
+
+	nextSyncToken, err := json.Marshal(&state)
+	if err != nil {
+		return nil, "", err
+	}
+	return events, string(nextSyncToken), nil
+}
+
+// collectEvents returns the events of the resources of a calendar-query or
+// calendar-multiget response, recording the resources in the sync state.
+func (c *caldavProvider) collectEvents(ms *multistatus, state caldavSyncState) ([]*Event, error) {
+	events := []*Event{}
+	for _, response := range ms.Responses {
+		resourceEvents, err := c.parseResponseEvents(ms, response)
+		if err != nil {
+			return nil, err
+		}
+		if !response.found() {
+			continue
+		}
+
+		resourceURL, err := ms.resolve(response.Href)
+		if err != nil {
+			return nil, err
+		}
+		resource := caldavResource{ETag: response.prop().ETag}
+		for _, event := range resourceEvents {
+			resource.EventIDs = append(resource.EventIDs, event.ID)
+		}
+		state.Resources[resourceURL.EscapedPath()] = resource
+
+		events = append(events, resourceEvents...)
+	}
+	return events, nil
+}
+
+// parseResponseEvents returns the events of the calendar data of a response.
+func (c *caldavProvider) parseResponseEvents(ms *multistatus, response davResponse) ([]*Event, error) {
+	data := response.prop().CalendarData
+	if !response.found() || data == "" {
+		return nil, nil
+	}
+
+	resourceURL, err := ms.resolve(response.Href)
+	if err != nil {
+		return nil, err
+	}
+
+	object, err := parseICalendar(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid calendar data in %s", resourceURL.Path)
+	}
+
+	events := []*Event{}
+	for _, component := range object.events() {
+		event, err := newCalDAVEvent(resourceURL.EscapedPath(), component, c.account.Addresses)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid event in %s", resourceURL.Path)
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// Watch returns errWatchNotSupported, as CalDAV servers don't notify clients of
+// changes. The calendars are polled instead.
+func (c *caldavProvider) Watch(calendarID, channelID, token, address string) (*WatchChannel, error) {
+	return nil, errWatchNotSupported
+}
+
+func (c *caldavProvider) StopWatch(channelID, resourceID string) error {
+	return nil
+}
+
+// GetBusyTime returns the busy periods of the primary calendar, computed from its
+// events since CalDAV servers rarely support free/busy queries.
+func (c *caldavProvider) GetBusyTime(timeMin, timeMax time.Time) ([]interval, error) {
+	events, err := c.ListEvents("primary", timeMin, timeMax)
+	if err != nil {
+		return nil, err
+	}
+
+	busy := []interval{}
+	for _, event := range events {
+		if !isBusy(event) {
+			continue
+		}
+		start, err := time.Parse(time.RFC3339, event.StartTime)
+		if err != nil {
+			continue
+		}
+		end, err := time.Parse(time.RFC3339, event.EndTime)
+		if err != nil {
+			continue
+		}
+		busy = append(busy, interval{start: start, end: end})
+	}
+	return busy, nil
+}
+
+// CreateEvent creates the event in the primary calendar. The server sends the
+// invitations to the attendees if it supports scheduling. Meetings can't be added.
+func (c *caldavProvider) CreateEvent(request *EventRequest) (*Event, error) {
+	calendar, err := c.getCalendar("primary")
+	if err != nil {
+		return nil, err
+	}
+
+	uid := model.NewId()
+	event := &icalComponent{
+		Name: "VEVENT",
+		Properties: []*icalProperty{
+			{Name: "UID", Value: uid},
+			{Name: "DTSTAMP", Value: c.now().UTC().Format(icalDateTimeFormat + "Z")},
+			{Name: "DTSTART", Value: request.Start.UTC().Format(icalDateTimeFormat + "Z")},
+			{Name: "DTEND", Value: request.End.UTC().Format(icalDateTimeFormat + "Z")},
+			{Name: "SUMMARY", Value: icalEscape(request.Summary)},
+		},
+	}
+	if len(c.account.Addresses) > 0 && len(request.AttendeeEmails) > 0 {
+		event.Properties = append(event.Properties, &icalProperty{Name: "ORGANIZER", Value: "mailto:" + c.account.Addresses[0]})
+		for _, email := range request.AttendeeEmails {
+			event.Properties = append(event.Properties, &icalProperty{
+				Name:   "ATTENDEE",
+				Params: map[string]string{"PARTSTAT": "NEEDS-ACTION", "RSVP": "TRUE"},
+				Value:  "mailto:" + email,
+			})
+		}
+	}
+
+	object := &icalComponent{
+		Name: "VCALENDAR",
+		Properties: []*icalProperty{
+			{Name: "VERSION", Value: "2.0"},
+			{Name: "PRODID", Value: "-//Mattermost//Google Calendar plugin//EN"},
+		},
+		Components: []*icalComponent{event},
+	}
+
+	resourceURL, err := calendar.url.Parse(uid + ".ics")
+	if err != nil {
+		return nil, err
+	}
+	if err := c.client.put(resourceURL.String(), "", object.String()); err != nil {
+		return nil, err
+	}
+
+	return newCalDAVEvent(resourceURL.EscapedPath(), event, c.account.Addresses)
+}
+
+// RespondToEvent sets the participation status of the user on an event. The
+// response applies to every occurrence of a recurring event.
+func (c *caldavProvider) RespondToEvent(calendarID, eventID, response string) error {
+	partstat := ""
+	for status, responseStatus := range caldavResponseStatuses {
+		if responseStatus == response {
+			partstat = status
+		}
+	}
+	if partstat == "" {
+		return fmt.Errorf("invalid response %s", response)
+	}
+
+	href := strings.SplitN(eventID, "#", 2)[0]
+	resourceURL, err := resolvePath(c.homeURL, href)
+	if err != nil {
+		return err
+	}
+
+	data, etag, err := c.client.get(resourceURL.String())
+	if err != nil {
+		return err
+	}
+
+	object, err := parseICalendar(data)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, event := range object.events() {
+		for _, property := range event.Properties {
+			if property.Name == "ATTENDEE" && c.isUserAddress(property.Value) {
+				property.Params["PARTSTAT"] = partstat
+				delete(property.Params, "RSVP")
+				found = true
+			}
+		}
+	}
+	if !found {
+		return errors.Errorf("the user isn't invited to event %s", eventID)
+	}
+
+	return c.client.put(resourceURL.String(), etag, object.String())
+}
+
+func (c *caldavProvider) isUserAddress(value string) bool {
+	return isCalDAVUserAddress(c.account.Addresses, value)
+}
+
+// isCalDAVUserAddress returns whether a CAL-ADDRESS value is one of the addresses of the user.
+func isCalDAVUserAddress(addresses []string, value string) bool {
+	address := icalAddress(value)
+	for _, userAddress := range addresses {
+		if address == userAddress {
+			return true
+		}
+	}
+	return false
+}
+
+// newCalDAVEvent captures the attributes of a VEVENT used by the plugin.
+func newCalDAVEvent(href string, component *icalComponent, addresses []string) (*Event, error) {
+	event := &Event{
+		ID:          href,
+		Summary:     component.text("SUMMARY"),
+		Location:    component.text("LOCATION"),
+		HTMLLink:    component.value("URL"),
+		Status:      strings.ToLower(component.value("STATUS")),
+		Transparent: strings.EqualFold(component.value("TRANSP"), "TRANSPARENT"),
+		MeetingLink: component.value("CONFERENCE"),
+	}
+	if recurrenceID := component.value("RECURRENCE-ID"); recurrenceID != "" {
+		event.ID += "#" + recurrenceID
+	}
+	if event.Status != "cancelled" && event.Status != "tentative" {
+		event.Status = "confirmed"
+	}
+	if event.MeetingLink == "" {
+		event.MeetingLink = component.value("X-GOOGLE-CONFERENCE")
+	}
+
+	// Events without an organizer are the user's own.
+	organizer := component.property("ORGANIZER")
+	event.OrganizedByUser = organizer == nil || isCalDAVUserAddress(addresses, organizer.Value)
+	for _, attendee := range component.Properties {
+		if attendee.Name == "ATTENDEE" && isCalDAVUserAddress(addresses, attendee.Value) {
+			event.ResponseStatus = "needsAction"
+			if status, ok := caldavResponseStatuses[strings.ToUpper(attendee.Params["PARTSTAT"])]; ok {
+				event.ResponseStatus = status
+			}
+		}
+	}
+
+	dtstart := component.property("DTSTART")
+	if dtstart == nil {
+		return nil, errors.New("the event has no start")
+	}
+	start, allDay, err := icalTime(dtstart)
+	if err != nil {
+		return nil, err
+	}
+
+	// Without an end or a duration, events last a day if they start on a date
+	// and end when they start otherwise.
+	end := start
+	if allDay {
+		end = start.AddDate(0, 0, 1)
+	}
+	if dtend := component.property("DTEND"); dtend != nil {
+		if end, _, err = icalTime(dtend); err != nil {
+			return nil, err
+		}
+	} else if duration := component.value("DURATION"); duration != "" {
+		days, d, err := icalDuration(duration)
+		if err != nil {
+			return nil, err
+		}
+		end = start.AddDate(0, 0, days).Add(d)
+	}
+
+	event.AllDay = allDay
+	if allDay {
+		event.StartTime = start.Format("2006-01-02")
+		event.EndTime = end.Format("2006-01-02")
+	} else {
+		event.StartTime = start.Format(time.RFC3339)
+		event.EndTime = end.Format(time.RFC3339)
+	}
+
+	return event, nil
+}
+
+// calendarQuery returns a calendar-query REPORT request for the events between
+// timeMin and timeMax, with their calendar data if withData is set. Recurring
+// events are expanded into their occurrences.
+func calendarQuery(timeMin, timeMax time.Time, withData bool) string {
+	return `<?xml version="1.0" encoding="utf-8"?>
+<c:calendar-query xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:caldav">
+	` + calendarQueryProps(timeMin, timeMax, withData) + `
+	<c:filter>
+		<c:comp-filter name="VCALENDAR">
+			<c:comp-filter name="VEVENT">
+				<c:time-range start="` + timeMin.UTC().Format(icalDateTimeFormat+"Z") + `" end="` + timeMax.UTC().Format(icalDateTimeFormat+"Z") + `"/>
+			</c:comp-filter>
+		</c:comp-filter>
+	</c:filter>
+</c:calendar-query>`
+}
+
+// calendarMultiget returns a calendar-multiget REPORT request for the calendar
+// data of the given resources, with recurring events expanded between timeMin
+// and timeMax.
+func calendarMultiget(hrefs []string, timeMin, timeMax time.Time) string {
+	body := `<?xml version="1.0" encoding="utf-8"?>
+<c:calendar-multiget xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:caldav">
+	` + calendarQueryProps(timeMin, timeMax, true)
+	for _, href := range hrefs {
+		var escaped strings.Builder
+		xml.EscapeText(&escaped, []byte(href))
+		body += "\n\t<d:href>" + escaped.String() + "</d:href>"
+	}
+	return body + "\n</c:calendar-multiget>"
+}
+
+func calendarQueryProps(timeMin, timeMax time.Time, withData bool) string {
+	if !withData {
+		return "<d:prop><d:getetag/></d:prop>"
+	}
+	return `<d:prop>
+		<d:getetag/>
+		<c:calendar-data>
+			<c:expand start="` + timeMin.UTC().Format(icalDateTimeFormat+"Z") + `" end="` + timeMax.UTC().Format(icalDateTimeFormat+"Z") + `"/>
+		</c:calendar-data>
+	</d:prop>`
+}
+
+// discoverCalDAVAccount finds the calendar home and the addresses of a user on a
+// CalDAV server, trying the given URL and the /.well-known/caldav URL of its host.
+func discoverCalDAVAccount(serverURL, username, password string) (*CalDAVAccount, error) {
+	base, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, err
+	}
+
+	wellKnown, err := base.Parse("/.well-known/caldav")
+	if err != nil {
+		return nil, err
+	}
+	candidates := []*url.URL{base, wellKnown}
+	if strings.Trim(base.Path, "/") == "" {
+		candidates = []*url.URL{wellKnown, base}
+	}
+
+	client := newWebdavClient(base, username, password)
+
+	var principalURL *url.URL
+	for _, candidate := range candidates {
+		ms, err := client.propfind(candidate.String(), "0", "<d:current-user-principal/>")
+		if errors.Cause(err) == errAuthorizationRevoked {
+			return nil, err
+		}
+		if err != nil {
+			continue
+		}
+
+		for _, response := range ms.Responses {
+			if hrefs := response.prop().CurrentUserPrincipal.Hrefs; len(hrefs) > 0 {
+				if principalURL, err = ms.resolve(hrefs[0]); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if principalURL != nil {
+			break
+		}
+	}
+	if principalURL == nil {
+		return nil, fmt.Errorf("no CalDAV principal found at %s", serverURL)
+	}
+
+	ms, err := client.propfind(principalURL.String(), "0", "<c:calendar-home-set/><c:calendar-user-address-set/>")
+	if err != nil {
+		return nil, err
+	}
+
+	account := &CalDAVAccount{Username: username, Password: password}
+	for _, response := range ms.Responses {
+		prop := response.prop()
+		if len(prop.CalendarHomeSet.Hrefs) > 0 {
+			homeURL, err := ms.resolve(prop.CalendarHomeSet.Hrefs[0])
+			if err != nil {
+				return nil, err
+			}
+			account.CalendarHomeURL = homeURL.String()
+		}
+		for _, href := range prop.CalendarUserAddressSet.Hrefs {
+			if strings.HasPrefix(strings.ToLower(strings.TrimSpace(href)), "mailto:") {
+				account.Addresses = append(account.Addresses, icalAddress(strings.TrimSpace(href)))
+			}
+		}
+	}
+	if len(account.Addresses) == 0 && strings.Contains(username, "@") {
+		account.Addresses = []string{strings.ToLower(username)}
+	}
+	if account.CalendarHomeURL == "" {
+		return nil, fmt.Errorf("no calendar home found for %s", principalURL)
+	}
+
+	return account, nil
+}
+
+// executeConnectCalDAVCommand opens the dialog connecting a calendar of the
+// configured CalDAV server.
+func (p *Plugin) executeConnectCalDAVCommand(args *model.CommandArgs) *model.CommandResponse {
+	serverURL := p.getConfiguration().CalDAVServerURL
+	if serverURL == "" {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, "Connecting CalDAV calendars isn't enabled. Ask your system administrator to set the **CalDAV server URL**.")
+	}
+
+	config := p.API.GetConfig()
+	if appErr := p.API.OpenInteractiveDialog(model.OpenDialogRequest{
+		TriggerId: args.TriggerId,
+		URL:       fmt.Sprintf("%s/plugins/google-calendar/dialog/caldav", *config.ServiceSettings.SiteURL),
+		Dialog: model.Dialog{
+			CallbackId:  "caldav",
+			Title:       "Connect a CalDAV calendar",
+			SubmitLabel: "Connect",
+			State:       p.signIntegrationRequest(args.UserId),
+			Elements: []model.DialogElement{
+				{DisplayName: "Username", Name: "username", Type: "text", HelpText: "Your username on " + serverURL},
+				{DisplayName: "Password", Name: "password", Type: "text", SubType: "password", HelpText: "Use an app password if your server supports them. It is stored encrypted."},
+			},
+		},
+	}); appErr != nil {
+		mlog.Error("Error opening the CalDAV dialog " + appErr.Error())
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, "Encountered an error opening the CalDAV dialog.")
+	}
+	return &model.CommandResponse{}
+}
+
+// submitConnectCalDAVDialog handles the submission of the CalDAV dialog: it
+// checks the credentials while discovering the calendars of the user, then
+// connects the user.
+func (p *Plugin) submitConnectCalDAVDialog(w http.ResponseWriter, r *http.Request) {
+	request := model.SubmitDialogRequestFromJson(r.Body)
+	if request == nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if !hmac.Equal([]byte(request.State), []byte(p.signIntegrationRequest(request.UserId))) {
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	if request.Cancelled {
+		return
+	}
+
+	serverURL := p.getConfiguration().CalDAVServerURL
+	if serverURL == "" {
+		json.NewEncoder(w).Encode(&model.SubmitDialogResponse{Errors: map[string]string{"username": "Connecting CalDAV calendars isn't enabled."}})
+		return
+	}
+
+	username, _ := request.Submission["username"].(string)
+	password, _ := request.Submission["password"].(string)
+	account, err := discoverCalDAVAccount(serverURL, strings.TrimSpace(username), password)
+	if errors.Cause(err) == errAuthorizationRevoked {
+		json.NewEncoder(w).Encode(&model.SubmitDialogResponse{Errors: map[string]string{"password": "The server rejected the username or password."}})
+		return
+	}
+	if err != nil {
+		mlog.Error("Error discovering the CalDAV account", mlog.String("user_id", request.UserId), mlog.Err(err))
+		json.NewEncoder(w).Encode(&model.SubmitDialogResponse{Errors: map[string]string{"username": "Encountered an error connecting to the CalDAV server."}})
+		return
+	}
+
+	if err := p.connectUser(&UserInfo{UserID: request.UserId, CalDAV: account}); err != nil {
+		json.NewEncoder(w).Encode(&model.SubmitDialogResponse{Errors: map[string]string{"username": "Encountered an error connecting your calendar."}})
+		return
+	}
+}
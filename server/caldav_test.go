@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/waseem18/mattermost-plugin-google-calendar/server/fakecaldav"
+)
+
+// connectCalDAV submits the CalDAV dialog for the user and returns the errors
+// shown in the dialog, if any.
+func (e *testEnv) connectCalDAV(t *testing.T, userID, password string) map[string]string {
+	request := &model.SubmitDialogRequest{
+		UserId: userID,
+		State:  e.p.signIntegrationRequest(userID),
+		Submission: map[string]interface{}{
+			"username": fakecaldav.Username,
+			"password": password,
+		},
+	}
+	resp, err := http.Post(e.mattermost.URL+"/plugins/google-calendar/dialog/caldav", "application/json", bytes.NewReader(request.ToJson()))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil
+	}
+	return model.SubmitDialogResponseFromJson(bytes.NewReader(body)).Errors
+}
+
+// connectedCalDAV connects the CalDAV account of the user and returns the stored
+// user information.
+func (e *testEnv) connectedCalDAV(t *testing.T, userID string) *UserInfo {
+	require.Empty(t, e.connectCalDAV(t, userID, testCalDAVPassword))
+
+	userInfo, err := e.p.getUserInfo(userID)
+	require.NoError(t, err)
+	require.NotNil(t, userInfo)
+	return userInfo
+}
+
+// addCalDAVEvent adds a timed event to the primary calendar of the fake CalDAV
+// server, starting after the given delay according to the clock of the plugin.
+func (e *testEnv) addCalDAVEvent(t *testing.T, event fakecaldav.Event, startsIn, duration time.Duration) string {
+	event.Start = e.clock.Now().Add(startsIn).Truncate(time.Second)
+	event.End = event.Start.Add(duration)
+	path, err := e.caldav.AddEvent(fakecaldav.PrimaryCalendarPath, event)
+	require.NoError(t, err)
+	return path
+}
+
+// poll advances the clock past the poll interval and syncs the calendars of the user.
+func (e *testEnv) poll(t *testing.T, userID string) {
+	e.clock.set(e.clock.Now().Add(pollInterval))
+	require.NoError(t, e.p.checkCalendarSync(userID))
+}
+
+func TestConnectCalDAV(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	e.addCalDAVEvent(t, fakecaldav.Event{UID: "standup", Summary: "Standup"}, time.Hour, 15*time.Minute)
+
+	userInfo := e.connectedCalDAV(t, testUserID)
+	require.NotNil(t, userInfo.CalDAV)
+	assert.Equal(t, e.caldav.URL+"/dav/calendars/alice/", userInfo.CalDAV.CalendarHomeURL)
+	assert.Equal(t, []string{fakecaldav.Address}, userInfo.CalDAV.Addresses)
+	assert.Equal(t, testCalDAVPassword, userInfo.CalDAV.Password)
+	assert.Nil(t, userInfo.Token)
+
+	e.lock.Lock()
+	stored := e.kv[testUserID+userTokenKey]
+	e.lock.Unlock()
+	assert.NotContains(t, string(stored), testCalDAVPassword, "the password is stored encrypted")
+
+	calendarInfo, err := e.p.getCalendarInfo(testUserID)
+	require.NoError(t, err)
+	require.Len(t, calendarInfo.Calendars, 1)
+	assert.Equal(t, "primary", calendarInfo.Calendars[0].ID)
+	assert.Equal(t, "Personal", calendarInfo.Calendars[0].Summary)
+	assert.True(t, calendarInfo.Calendars[0].Polled)
+	assert.Equal(t, []string{"Standup"}, e.storedEvents(t, testUserID))
+
+	posts := e.channelPosts(directChannelID(testUserID))
+	require.Len(t, posts, 1)
+	assert.Equal(t, welcomeMessage, posts[0].Message)
+}
+
+func TestConnectCalDAVRejectsWrongPassword(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+
+	errs := e.connectCalDAV(t, testUserID, "wrong")
+	assert.Equal(t, "The server rejected the username or password.", errs["password"])
+
+	userInfo, err := e.p.getUserInfo(testUserID)
+	require.NoError(t, err)
+	assert.Nil(t, userInfo)
+}
+
+func TestCalDAVListCalendars(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	e.caldav.AddCalendar("/dav/calendars/alice/team/", "Team", "VEVENT", "VTODO")
+	userInfo := e.connectedCalDAV(t, testUserID)
+
+	provider, err := e.p.getCalendarProvider(userInfo)
+	require.NoError(t, err)
+	calendars, err := provider.ListCalendars()
+	require.NoError(t, err)
+	assert.Equal(t, []*Calendar{
+		{ID: fakecaldav.PrimaryCalendarPath, Summary: "Personal", Primary: true},
+		{ID: "/dav/calendars/alice/team/", Summary: "Team"},
+	}, calendars, "task lists are skipped")
+}
+
+func TestCalDAVPolling(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		noCTag bool
+	}{
+		{"changes detected with the CTag", false},
+		{"changes detected with the ETags", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			defer e.close()
+			e.caldav.NoCTag = tc.noCTag
+			standup := e.addCalDAVEvent(t, fakecaldav.Event{UID: "standup", Summary: "Standup"}, time.Hour, 15*time.Minute)
+			e.connectedCalDAV(t, testUserID)
+
+			e.addCalDAVEvent(t, fakecaldav.Event{UID: "retro", Summary: "Retro"}, 2*time.Hour, time.Hour)
+			e.poll(t, testUserID)
+			assert.ElementsMatch(t, []string{"Standup", "Retro"}, e.storedEvents(t, testUserID))
+
+			e.addCalDAVEvent(t, fakecaldav.Event{UID: "standup", Summary: "Daily standup"}, time.Hour, 15*time.Minute)
+			e.poll(t, testUserID)
+			assert.ElementsMatch(t, []string{"Daily standup", "Retro"}, e.storedEvents(t, testUserID))
+
+			e.caldav.DeleteResource(standup)
+			e.poll(t, testUserID)
+			assert.Equal(t, []string{"Retro"}, e.storedEvents(t, testUserID))
+
+			// Without changes, only the CTag is fetched.
+			reports := e.caldav.Requests("REPORT")
+			e.poll(t, testUserID)
+			if tc.noCTag {
+				assert.Equal(t, reports+1, e.caldav.Requests("REPORT"))
+			} else {
+				assert.Equal(t, reports, e.caldav.Requests("REPORT"))
+			}
+			assert.Equal(t, []string{"Retro"}, e.storedEvents(t, testUserID))
+		})
+	}
+}
+
+func TestCalDAVPollingWaitsForPollInterval(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	e.connectedCalDAV(t, testUserID)
+
+	e.addCalDAVEvent(t, fakecaldav.Event{UID: "standup", Summary: "Standup"}, 2*time.Hour, 15*time.Minute)
+	e.clock.set(e.clock.Now().Add(pollInterval - time.Minute))
+	require.NoError(t, e.p.checkCalendarSync(testUserID))
+	assert.Empty(t, e.storedEvents(t, testUserID))
+
+	e.clock.set(e.clock.Now().Add(time.Minute))
+	require.NoError(t, e.p.checkCalendarSync(testUserID))
+	assert.Equal(t, []string{"Standup"}, e.storedEvents(t, testUserID))
+}
+
+func TestCalDAVReminders(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	e.addCalDAVEvent(t, fakecaldav.Event{UID: "review", Summary: "Design review"}, 5*time.Minute, 30*time.Minute)
+	e.addCalDAVEvent(t, fakecaldav.Event{UID: "lunch", Summary: "Lunch"}, 3*time.Hour, time.Hour)
+	e.connectedCalDAV(t, testUserID)
+
+	require.NoError(t, e.p.checkEvents(testUserID))
+
+	reminders := []string{}
+	for _, post := range e.channelPosts(directChannelID(testUserID)) {
+		if attachments := post.Attachments(); len(attachments) > 0 {
+			reminders = append(reminders, attachments[0].Title)
+		}
+	}
+	assert.Equal(t, []string{"Design review"}, reminders)
+}
+
+func TestCalDAVInvitation(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	e.connectedCalDAV(t, testUserID)
+
+	offsite := e.addCalDAVEvent(t, fakecaldav.Event{
+		UID:       "offsite",
+		Summary:   "Offsite",
+		Organizer: "bob@example.com",
+		Attendees: map[string]string{"bob@example.com": "ACCEPTED", fakecaldav.Address: "NEEDS-ACTION"},
+	}, 4*time.Hour, time.Hour)
+	e.poll(t, testUserID)
+
+	invitations := []string{}
+	for _, post := range e.channelPosts(directChannelID(testUserID)) {
+		if attachments := post.Attachments(); len(attachments) > 0 && attachments[0].Pretext == "New invitation" {
+			invitations = append(invitations, attachments[0].Title)
+		}
+	}
+	assert.Equal(t, []string{"Offsite"}, invitations)
+
+	require.NoError(t, e.p.setEventResponse(testUserID, "primary", offsite, "accepted"))
+	object, err := parseICalendar(e.caldav.Resource(offsite))
+	require.NoError(t, err)
+	event, err := newCalDAVEvent(offsite, object.events()[0], []string{fakecaldav.Address})
+	require.NoError(t, err)
+	assert.Equal(t, "accepted", event.ResponseStatus)
+	assert.Contains(t, e.caldav.Resource(offsite), "PARTSTAT=ACCEPTED:mailto:bob@example.com", "the other attendees are kept")
+}
+
+func TestCalDAVCreateEvent(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	userInfo := e.connectedCalDAV(t, testUserID)
+
+	start := e.clock.Now().Add(24 * time.Hour).Truncate(time.Minute)
+	event, err := e.p.insertEvent(userInfo, &newEvent{title: "Planning; Q3", start: start, duration: 30 * time.Minute})
+	require.NoError(t, err)
+	assert.Equal(t, "Planning; Q3", event.Summary)
+	assert.Equal(t, start.Format(time.RFC3339), event.StartTime)
+
+	resources := e.caldav.Resources(fakecaldav.PrimaryCalendarPath)
+	require.Equal(t, []string{event.ID}, resources)
+	assert.Contains(t, e.caldav.Resource(event.ID), `SUMMARY:Planning\; Q3`)
+}
+
+func TestCalDAVRevokedPasswordDisconnectsUser(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	e.connectedCalDAV(t, testUserID)
+
+	e.caldav.SetPassword("regenerated")
+	e.clock.set(e.clock.Now().Add(pollInterval))
+	assert.Error(t, e.p.checkCalendarSync(testUserID))
+
+	userInfo, err := e.p.getUserInfo(testUserID)
+	require.NoError(t, err)
+	assert.Nil(t, userInfo)
+
+	posts := e.channelPosts(directChannelID(testUserID))
+	require.NotEmpty(t, posts)
+	assert.Equal(t, caldavCredentialsRejectedMessage, posts[len(posts)-1].Message)
+}
+
+func TestCalDAVStaysOnServer(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	userInfo := e.connectedCalDAV(t, testUserID)
+
+	var lock sync.Mutex
+	leaked := []string{}
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		leaked = append(leaked, r.Method+" "+r.URL.Path+" "+r.Header.Get("Authorization"))
+	}))
+	defer other.Close()
+	redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, other.URL+r.URL.Path, http.StatusMovedPermanently)
+	}))
+	defer redirect.Close()
+
+	provider, err := e.p.getCalendarProvider(userInfo)
+	require.NoError(t, err)
+	for _, calendarID := range []string{other.URL + "/cal/", "//" + strings.TrimPrefix(other.URL, "http://") + "/cal/"} {
+		_, err := provider.GetCalendar(calendarID)
+		assert.Error(t, err, calendarID)
+	}
+	assert.Error(t, provider.RespondToEvent("primary", other.URL+"/cal/1.ics", "accepted"))
+
+	serverURL, err := url.Parse(e.caldav.URL)
+	require.NoError(t, err)
+	_, _, err = newWebdavClient(serverURL, fakecaldav.Username, testCalDAVPassword).do(http.MethodGet, redirect.URL+"/cal/", nil, "")
+	assert.Error(t, err)
+
+	redirectURL, err := url.Parse(redirect.URL)
+	require.NoError(t, err)
+	_, _, err = newWebdavClient(redirectURL, fakecaldav.Username, testCalDAVPassword).do(http.MethodGet, redirect.URL+"/cal/", nil, "")
+	assert.Error(t, err, "cross-origin redirects are refused")
+
+	ms := &multistatus{url: serverURL}
+	_, err = ms.resolve(other.URL + "/cal/")
+	assert.Error(t, err)
+	resolved, err := ms.resolve("/dav/calendars/alice/personal/")
+	require.NoError(t, err)
+	assert.Equal(t, e.caldav.URL+"/dav/calendars/alice/personal/", resolved.String())
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Empty(t, leaked, "no request reaches another host")
+}
+
+func TestReencryptCalDAVPassword(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	e.connectedCalDAV(t, testUserID)
+
+	config := *e.p.getConfiguration()
+	config.Secret = "new secret"
+	e.p.setConfiguration(&config)
+	e.p.reencryptUserTokens("secret")
+
+	userInfo, err := e.p.getUserInfo(testUserID)
+	require.NoError(t, err)
+	require.NotNil(t, userInfo)
+	assert.Equal(t, testCalDAVPassword, userInfo.CalDAV.Password)
+}
+
+func TestNewCalDAVEvent(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name   string
+		vevent string
+		want   Event
+	}{
+		{
+			name:   "UTC times",
+			vevent: "UID:1\r\nSUMMARY:Standup\r\nDTSTART:20260302T090000Z\r\nDTEND:20260302T091500Z\r\n",
+			want: Event{ID: "/cal/1.ics", Summary: "Standup", Status: "confirmed", OrganizedByUser: true,
+				StartTime: "2026-03-02T09:00:00Z", EndTime: "2026-03-02T09:15:00Z"},
+		},
+		{
+			name:   "time zone and duration",
+			vevent: "UID:1\r\nSUMMARY:Review\r\nDTSTART;TZID=Europe/Berlin:20260302T100000\r\nDURATION:PT1H30M\r\n",
+			want: Event{ID: "/cal/1.ics", Summary: "Review", Status: "confirmed", OrganizedByUser: true,
+				StartTime: time.Date(2026, 3, 2, 10, 0, 0, 0, berlin).Format(time.RFC3339), EndTime: time.Date(2026, 3, 2, 11, 30, 0, 0, berlin).Format(time.RFC3339)},
+		},
+		{
+			name:   "all-day event without an end",
+			vevent: "UID:1\r\nSUMMARY:Holiday\r\nDTSTART;VALUE=DATE:20260302\r\nTRANSP:TRANSPARENT\r\n",
+			want: Event{ID: "/cal/1.ics", Summary: "Holiday", Status: "confirmed", OrganizedByUser: true, AllDay: true, Transparent: true,
+				StartTime: "2026-03-02", EndTime: "2026-03-03"},
+		},
+		{
+			name: "occurrence of a recurring invitation with folded and escaped text",
+			vevent: "UID:1\r\nRECURRENCE-ID:20260302T090000Z\r\nSUMMARY:Planning\\, budget\\; and a very long summary folded acro\r\n ss lines\r\n" +
+				"LOCATION:Room 1\r\nDTSTART:20260302T090000Z\r\nDTEND:20260302T100000Z\r\nORGANIZER;CN=Bob:mailto:bob@example.com\r\n" +
+				"ATTENDEE;CN=\"Alice; A.\";PARTSTAT=TENTATIVE:MAILTO:Alice@Example.com\r\nCONFERENCE;VALUE=URI:https://meet.example.com/abc\r\n",
+			want: Event{ID: "/cal/1.ics#20260302T090000Z", Summary: "Planning, budget; and a very long summary folded across lines", Location: "Room 1",
+				Status: "confirmed", ResponseStatus: "tentative", MeetingLink: "https://meet.example.com/abc",
+				StartTime: "2026-03-02T09:00:00Z", EndTime: "2026-03-02T10:00:00Z"},
+		},
+		{
+			name:   "cancelled invitation without a participation status",
+			vevent: "UID:1\r\nSTATUS:CANCELLED\r\nDTSTART:20260302T090000Z\r\nORGANIZER:mailto:bob@example.com\r\nATTENDEE:mailto:alice@example.com\r\n",
+			want: Event{ID: "/cal/1.ics", Status: "cancelled", ResponseStatus: "needsAction",
+				StartTime: "2026-03-02T09:00:00Z", EndTime: "2026-03-02T09:00:00Z"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			object, err := parseICalendar("BEGIN:VCALENDAR\r\nVERSION:2.0\r\nBEGIN:VEVENT\r\n" + tc.vevent + "BEGIN:VALARM\r\nTRIGGER:-PT10M\r\nEND:VALARM\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n")
+			require.NoError(t, err)
+			require.Len(t, object.events(), 1)
+
+			event, err := newCalDAVEvent("/cal/1.ics", object.events()[0], []string{"alice@example.com"})
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, *event)
+		})
+	}
+}
+
+func TestICalendarRoundTrip(t *testing.T) {
+	summary := strings.Repeat("Très long résumé ", 10)
+	object := &icalComponent{
+		Name: "VCALENDAR",
+		Components: []*icalComponent{{
+			Name: "VEVENT",
+			Properties: []*icalProperty{
+				{Name: "SUMMARY", Value: icalEscape(summary)},
+				{Name: "ATTENDEE", Params: map[string]string{"CN": "Doe, Jane", "PARTSTAT": "ACCEPTED"}, Value: "mailto:jane@example.com"},
+			},
+		}},
+	}
+
+	encoded := object.String()
+	for _, line := range strings.Split(encoded, "\r\n") {
+		assert.True(t, len(line) <= icalMaxLineLength+1, "line %q is folded", line)
+	}
+
+	parsed, err := parseICalendar(encoded)
+	require.NoError(t, err)
+	event := parsed.events()[0]
+	assert.Equal(t, summary, event.text("SUMMARY"))
+	assert.Equal(t, map[string]string{"CN": "Doe, Jane", "PARTSTAT": "ACCEPTED"}, event.property("ATTENDEE").Params)
+}
+
+func TestICalDuration(t *testing.T) {
+	for _, tc := range []struct {
+		value    string
+		days     int
+		duration time.Duration
+		valid    bool
+	}{
+		{"PT15M", 0, 15 * time.Minute, true},
+		{"PT1H30M", 0, 90 * time.Minute, true},
+		{"P1D", 1, 0, true},
+		{"P1W", 7, 0, true},
+		{"P1DT12H", 1, 12 * time.Hour, true},
+		{"-PT10M", 0, -10 * time.Minute, true},
+		{"PT", 0, 0, true},
+		{"1H", 0, 0, false},
+		{"P1H", 0, 0, false},
+		{"PT5", 0, 0, false},
+	} {
+		t.Run(tc.value, func(t *testing.T) {
+			days, duration, err := icalDuration(tc.value)
+			if !tc.valid {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.days, days)
+			assert.Equal(t, tc.duration, duration)
+		})
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/mlog"
+	"github.com/mattermost/mattermost-server/model"
+)
+
+// SubscribedCalendar captures a calendar the user subscribed to, along with the
+// details of its last sync and of its watch channel.
+type SubscribedCalendar struct {
+	ID      string
+	Summary string
+
+	// SyncToken fetches the changes since the last sync. Empty if the next sync
+	// has to be a full sync.
+	SyncToken string
+
+	// LastFullSync and LastSync are the Unix times of the last full sync and of
+	// the last sync of any kind.
+	LastFullSync int64
+	LastSync     int64
+
+	// SyncPending is set when the last sync failed because the provider limited
+	// the rate of the requests, so the scheduler syncs the calendar again.
+	SyncPending bool
+
+	// Polled is set for calendars whose provider can't notify the plugin of
+	// changes. They are synced every pollInterval instead of being watched.
+	Polled bool
+
+	// ChannelsOnly is set for calendars synced for the channel subscriptions of
+	// the user only, see addCalendarSubscription. The user isn't reminded of
+	// their events.
+	ChannelsOnly bool
+
+	// Invitations lists the IDs of the upcoming events the user was invited to
+	// without having responded, so they are notified of each invitation once.
+	Invitations []string
+
+	WatchToken  string
+	WatchExpiry int64
+
+	// WatchSecret is the random token Google sends back with each notification of
+	// the watch channel. It is empty for channels created before it was stored,
+	// which are replaced by setupWatchRenewal.
+	WatchSecret string
+
+	// WatchResourceID identifies the watched resource, which is needed to stop the watch channel.
+	WatchResourceID string
+}
+
+// getCalendar returns the subscribed calendar with the given ID, or nil if the
+// user isn't subscribed to it.
+func (c *CalendarInfo) getCalendar(calendarID string) *SubscribedCalendar {
+	for index := range c.Calendars {
+		if c.Calendars[index].ID == calendarID {
+			return &c.Calendars[index]
+		}
+	}
+	return nil
+}
+
+// personalEvents returns the events of the calendars the user subscribed to
+// themselves, leaving out the calendars only synced for channel subscriptions.
+func (c *CalendarInfo) personalEvents() []EventInfo {
+	events := []EventInfo{}
+	for _, event := range c.Events {
+		if subscribedCalendar := c.getCalendar(event.CalendarID); subscribedCalendar == nil || !subscribedCalendar.ChannelsOnly {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// getCalendarByWatchToken returns the subscribed calendar watched by the channel
+// with the given ID, or nil if the channel isn't the current one of any calendar.
+func (c *CalendarInfo) getCalendarByWatchToken(channelID string) *SubscribedCalendar {
+	for index := range c.Calendars {
+		if c.Calendars[index].WatchToken == channelID {
+			return &c.Calendars[index]
+		}
+	}
+	return nil
+}
+
+// hasInvitation returns whether the user was already notified of the invitation to an event.
+func (c *SubscribedCalendar) hasInvitation(eventID string) bool {
+	for _, id := range c.Invitations {
+		if id == eventID {
+			return true
+		}
+	}
+	return false
+}
+
+// calendarName returns the name under which events of a calendar are shown.
+func (c *CalendarInfo) calendarName(calendarID string) string {
+	if subscribedCalendar := c.getCalendar(calendarID); subscribedCalendar != nil && subscribedCalendar.Summary != "" {
+		return subscribedCalendar.Summary
+	}
+	return calendarID
+}
+
+// updateEvent stores an event, replacing the previous version of it if any.
+func (c *CalendarInfo) updateEvent(updatedEvent EventInfo) {
+	for index := range c.Events {
+		event := &c.Events[index]
+		if event.Id != updatedEvent.Id || event.CalendarID != updatedEvent.CalendarID {
+			continue
+		}
+
+		// The reminders already sent are kept unless the event was rescheduled,
+		// in which case they are due again.
+		if event.StartTime == updatedEvent.StartTime {
+			updatedEvent.SentReminders = event.SentReminders
+		}
+		*event = updatedEvent
+		return
+	}
+
+	c.Events = append(c.Events, updatedEvent)
+}
+
+// removeEvent removes an event, e.g. because it was cancelled.
+func (c *CalendarInfo) removeEvent(calendarID, eventID string) {
+	for index, event := range c.Events {
+		if event.Id == eventID && event.CalendarID == calendarID {
+			c.Events = append(c.Events[:index], c.Events[index+1:]...)
+			return
+		}
+	}
+}
+
+// removeCalendar removes a subscribed calendar and its events.
+func (c *CalendarInfo) removeCalendar(calendarID string) {
+	events := []EventInfo{}
+	for _, event := range c.Events {
+		if event.CalendarID != calendarID {
+			events = append(events, event)
+		}
+	}
+	c.Events = events
+
+	calendars := []SubscribedCalendar{}
+	for _, subscribedCalendar := range c.Calendars {
+		if subscribedCalendar.ID != calendarID {
+			calendars = append(calendars, subscribedCalendar)
+		}
+	}
+	c.Calendars = calendars
+}
+
+// removeCalendarEvents removes the events of a calendar before a full sync. The
+// reminders already sent for the events that are synced again are kept.
+func (c *CalendarInfo) removeCalendarEvents(calendarID string, syncedEvents []*Event) {
+	synced := map[string]bool{}
+	for _, event := range syncedEvents {
+		synced[event.ID] = true
+	}
+
+	events := []EventInfo{}
+	for _, event := range c.Events {
+		if event.CalendarID != calendarID || synced[event.Id] {
+			events = append(events, event)
+		}
+	}
+	c.Events = events
+}
+
+// addCalendarSubscription subscribes the user to one of the calendars in their
+// calendar list: its upcoming events are fetched and watched for changes, or
+// polled if it can't be watched. With channelsOnly, the calendar is only synced
+// for the channel subscriptions of the user, who isn't reminded of its events
+// unless they subscribe to it themselves. It returns the subscription, which is
+// stored even if fetching the events or watching the calendar failed, as both
+// are retried by the scheduler.
+func (p *Plugin) addCalendarSubscription(u *UserInfo, calendarID string, channelsOnly bool) (*SubscribedCalendar, error) {
+	provider, err := p.getCalendarProvider(u)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := provider.GetCalendar(calendarID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The primary calendar is always referred to by its alias, so subscribing to
+	// it by its actual ID doesn't subscribe to it twice.
+	calendarID = entry.ID
+	if entry.Primary {
+		calendarID = "primary"
+	}
+
+	added := false
+	if _, err := p.updateCalendarInfo(u.UserID, func(calendarInfo *CalendarInfo) bool {
+		if subscribedCalendar := calendarInfo.getCalendar(calendarID); subscribedCalendar != nil {
+			if subscribedCalendar.ChannelsOnly && !channelsOnly {
+				subscribedCalendar.ChannelsOnly = false
+				return true
+			}
+			return false
+		}
+
+		calendarInfo.Calendars = append(calendarInfo.Calendars, SubscribedCalendar{
+			ID:           calendarID,
+			Summary:      entry.Summary,
+			ChannelsOnly: channelsOnly,
+		})
+		added = true
+		return true
+	}); err != nil {
+		return nil, err
+	}
+
+	if added {
+		if err := p.updateCalendarEvents(u, calendarID); isAuthorizationError(err) {
+			return nil, err
+		} else if err != nil {
+			mlog.Error("Error syncing a new calendar subscription", mlog.String("user_id", u.UserID), mlog.String("calendar_id", calendarID), mlog.Err(err))
+		}
+
+		if err := p.setupCalendarWatchService(u, calendarID); isAuthorizationError(err) {
+			return nil, err
+		} else if err != nil {
+			mlog.Error("Error watching a new calendar subscription", mlog.String("user_id", u.UserID), mlog.String("calendar_id", calendarID), mlog.Err(err))
+		}
+	}
+
+	calendarInfo, err := p.getCalendarInfo(u.UserID)
+	if err != nil || calendarInfo == nil {
+		return nil, err
+	}
+	subscribedCalendar := calendarInfo.getCalendar(calendarID)
+	if subscribedCalendar == nil {
+		return nil, fmt.Errorf("calendar %s was unsubscribed in the meantime", calendarID)
+	}
+	return subscribedCalendar, nil
+}
+
+// removeCalendarSubscription unsubscribes the user from a calendar, stopping its
+// watch channel and removing its events. A calendar that the channel subscriptions
+// of the user still use keeps being synced for them.
+func (p *Plugin) removeCalendarSubscription(u *UserInfo, calendarID string) (bool, error) {
+	usedByChannels, err := p.hasChannelSubscription(u.UserID, calendarID)
+	if err != nil {
+		return false, err
+	}
+
+	unsubscribed := false
+	var removed *SubscribedCalendar
+	if _, err := p.updateCalendarInfo(u.UserID, func(calendarInfo *CalendarInfo) bool {
+		subscribedCalendar := calendarInfo.getCalendar(calendarID)
+		if subscribedCalendar == nil || subscribedCalendar.ChannelsOnly {
+			return false
+		}
+		unsubscribed = true
+
+		if usedByChannels {
+			subscribedCalendar.ChannelsOnly = true
+			return true
+		}
+
+		stored := *subscribedCalendar
+		removed = &stored
+		calendarInfo.removeCalendar(calendarID)
+		return true
+	}); err != nil {
+		return false, err
+	}
+
+	if removed != nil {
+		if err := p.stopCalendarWatchService(u, *removed); err != nil {
+			mlog.Error("Error stopping the watch channel " + err.Error())
+		}
+	}
+	return unsubscribed, nil
+}
+
+// removeChannelCalendar unsubscribes the user from a calendar only synced for
+// their channel subscriptions once none of them uses it anymore.
+func (p *Plugin) removeChannelCalendar(userID, calendarID string) error {
+	usedByChannels, err := p.hasChannelSubscription(userID, calendarID)
+	if err != nil || usedByChannels {
+		return err
+	}
+
+	var removed *SubscribedCalendar
+	if _, err := p.updateCalendarInfo(userID, func(calendarInfo *CalendarInfo) bool {
+		subscribedCalendar := calendarInfo.getCalendar(calendarID)
+		if subscribedCalendar == nil || !subscribedCalendar.ChannelsOnly {
+			return false
+		}
+
+		stored := *subscribedCalendar
+		removed = &stored
+		calendarInfo.removeCalendar(calendarID)
+		return true
+	}); err != nil || removed == nil {
+		return err
+	}
+
+	userInfo, err := p.getUserInfo(userID)
+	if err != nil || userInfo == nil {
+		return err
+	}
+	return p.stopCalendarWatchService(userInfo, *removed)
+}
+
+func (p *Plugin) executeCalendarsCommand(args *model.CommandArgs, parameters []string) *model.CommandResponse {
+	userInfo, err := p.getUserInfo(args.UserId)
+	if err != nil || userInfo == nil {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, "Connect your Google Calendar first with `/google-calendar connect`.")
+	}
+
+	action := ""
+	if len(parameters) > 0 {
+		action = parameters[0]
+	}
+
+	switch action {
+	case "":
+		return p.executeListCalendars(userInfo)
+	case "subscribe", "unsubscribe":
+		if len(parameters) < 2 {
+			return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, fmt.Sprintf("Use `/google-calendar calendars %s <calendar ID>`. List the IDs of your calendars with `/google-calendar calendars`.", action))
+		}
+		calendarID := parameters[1]
+
+		if action == "subscribe" {
+			subscribedCalendar, err := p.addCalendarSubscription(userInfo, calendarID, false)
+			if err != nil {
+				return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, fmt.Sprintf("Encountered an error subscribing to calendar `%s`.", calendarID))
+			}
+			message := fmt.Sprintf("Subscribed to calendar `%s`. You will receive reminders for its events.", calendarID)
+			if subscribedCalendar.Polled {
+				message += fmt.Sprintf(" This calendar can't notify the plugin of changes, so it is checked for changes every %d minutes.", int(pollInterval/time.Minute))
+			} else if subscribedCalendar.WatchToken == "" {
+				message += " Watching it for changes failed and will be retried shortly, so recent changes may take a few minutes to show up."
+			}
+			return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, message)
+		}
+
+		removed, err := p.removeCalendarSubscription(userInfo, calendarID)
+		if err != nil {
+			return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, fmt.Sprintf("Encountered an error unsubscribing from calendar `%s`.", calendarID))
+		}
+		if !removed {
+			return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, fmt.Sprintf("You aren't subscribed to calendar `%s`.", calendarID))
+		}
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, fmt.Sprintf("Unsubscribed from calendar `%s`.", calendarID))
+	default:
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, "Available commands: calendars, calendars subscribe <calendar ID>, calendars unsubscribe <calendar ID>")
+	}
+}
+
+// executeListCalendars lists the calendars in the user's calendar list, marking
+// the ones they subscribed to.
+func (p *Plugin) executeListCalendars(u *UserInfo) *model.CommandResponse {
+	provider, err := p.getCalendarProvider(u)
+	if err != nil {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, "Encountered an error connecting to Google Calendar.")
+	}
+
+	calendars, err := provider.ListCalendars()
+	if err != nil {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, "Encountered an error fetching your calendars.")
+	}
+
+	calendarInfo, err := p.getCalendarInfo(u.UserID)
+	if err != nil || calendarInfo == nil {
+		calendarInfo = &CalendarInfo{}
+	}
+
+	lines := []string{"Your calendars:"}
+	for _, entry := range calendars {
+		calendarID := entry.ID
+		if entry.Primary {
+			calendarID = "primary"
+		}
+
+		line := fmt.Sprintf("- **%s** `%s`", entry.Summary, calendarID)
+		if subscribedCalendar := calendarInfo.getCalendar(calendarID); subscribedCalendar != nil && !subscribedCalendar.ChannelsOnly {
+			line += " _(subscribed)_"
+		}
+		lines = append(lines, line)
+	}
+	lines = append(lines, "", "Subscribe to a calendar with `/google-calendar calendars subscribe <calendar ID>`.")
+
+	return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, strings.Join(lines, "\n"))
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/mlog"
+	"github.com/mattermost/mattermost-server/model"
+)
+
+const channelSubscriptionsKey = "channel_subscriptions"
+
+// ChannelSubscription captures a shared calendar whose events are announced in a
+// channel when they start.
+type ChannelSubscription struct {
+	ChannelID    string
+	CalendarID   string
+	CalendarName string
+
+	// UserID is the user who subscribed the channel. The calendar is read with
+	// their credentials and the times are shown in their timezone.
+	UserID string
+
+	// DigestTime is the time of day, formatted as "15:04", at which the events of
+	// the day are posted in the channel. Empty if there is no daily digest.
+	DigestTime     string
+	LastDigestDate string
+
+	// AnnouncedEvents lists the events announced within reminderGracePeriod,
+	// formatted as "<event ID> <start time>", so each is announced once.
+	AnnouncedEvents []string
+}
+
+// getChannelSubscriptions returns the calendars subscribed to by all channels.
+func (p *Plugin) getChannelSubscriptions() ([]ChannelSubscription, error) {
+	var subscriptions []ChannelSubscription
+
+	if info, appErr := p.API.KVGet(channelSubscriptionsKey); appErr != nil {
+		return nil, appErr
+	} else if info == nil {
+		return nil, nil
+	} else if err := json.Unmarshal(info, &subscriptions); err != nil {
+		return nil, err
+	}
+
+	return subscriptions, nil
+}
+
+func (p *Plugin) storeChannelSubscriptions(subscriptions []ChannelSubscription) error {
+	jsonSubscriptions, err := json.Marshal(subscriptions)
+	if err != nil {
+		return err
+	}
+
+	if err := p.API.KVSet(channelSubscriptionsKey, jsonSubscriptions); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// hasChannelSubscription returns whether the user subscribed a channel to the calendar.
+func (p *Plugin) hasChannelSubscription(userID, calendarID string) (bool, error) {
+	subscriptions, err := p.getChannelSubscriptions()
+	if err != nil {
+		return false, err
+	}
+
+	for _, subscription := range subscriptions {
+		if subscription.UserID == userID && subscription.CalendarID == calendarID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// removeChannelSubscriptions removes the subscriptions matching the filter and
+// returns the removed ones.
+func (p *Plugin) removeChannelSubscriptions(remove func(ChannelSubscription) bool) ([]ChannelSubscription, error) {
+	subscriptions, err := p.getChannelSubscriptions()
+	if err != nil {
+		return nil, err
+	}
+
+	kept := []ChannelSubscription{}
+	removed := []ChannelSubscription{}
+	for _, subscription := range subscriptions {
+		if remove(subscription) {
+			removed = append(removed, subscription)
+		} else {
+			kept = append(kept, subscription)
+		}
+	}
+
+	if len(removed) == 0 {
+		return nil, nil
+	}
+	return removed, p.storeChannelSubscriptions(kept)
+}
+
+// releaseChannelCalendars stops syncing the calendars of removed channel
+// subscriptions that the users who made them don't use anymore.
+func (p *Plugin) releaseChannelCalendars(removed []ChannelSubscription) {
+	for _, subscription := range removed {
+		if err := p.removeChannelCalendar(subscription.UserID, subscription.CalendarID); err != nil {
+			mlog.Error("Error unsubscribing from the calendar of a channel subscription", mlog.String("user_id", subscription.UserID), mlog.String("calendar_id", subscription.CalendarID), mlog.Err(err))
+		}
+	}
+}
+
+func (p *Plugin) executeChannelCommand(args *model.CommandArgs, parameters []string) *model.CommandResponse {
+	action := ""
+	if len(parameters) > 0 {
+		action = parameters[0]
+	}
+
+	switch action {
+	case "subscribe":
+		return p.executeChannelSubscribe(args, parameters[1:])
+	case "unsubscribe":
+		if len(parameters) < 2 {
+			return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, "Use `/google-calendar channel unsubscribe <calendar ID>`.")
+		}
+		calendarID := parameters[1]
+
+		removed, err := p.removeChannelSubscriptions(func(s ChannelSubscription) bool {
+			return s.ChannelID == args.ChannelId && s.CalendarID == calendarID
+		})
+		if err != nil {
+			return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, fmt.Sprintf("Encountered an error unsubscribing this channel from calendar `%s`.", calendarID))
+		}
+		if len(removed) == 0 {
+			return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, fmt.Sprintf("This channel isn't subscribed to calendar `%s`.", calendarID))
+		}
+		p.releaseChannelCalendars(removed)
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, fmt.Sprintf("Unsubscribed this channel from calendar `%s`.", calendarID))
+	case "list":
+		return p.executeChannelList(args)
+	default:
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, "Available commands: channel subscribe <calendar ID> [--digest <time>], channel list, channel unsubscribe <calendar ID>")
+	}
+}
+
+// executeChannelSubscribe subscribes the channel to a calendar the user can read.
+func (p *Plugin) executeChannelSubscribe(args *model.CommandArgs, parameters []string) *model.CommandResponse {
+	usage := "Use `/google-calendar channel subscribe <calendar ID> [--digest <time>]`, e.g. `/google-calendar channel subscribe team@example.com --digest 9:00`. Events are announced in the channel when they start, except all-day events, which are only listed in the daily digest."
+	if len(parameters) == 0 {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, usage)
+	}
+
+	subscription := ChannelSubscription{
+		ChannelID:  args.ChannelId,
+		CalendarID: parameters[0],
+		UserID:     args.UserId,
+	}
+
+	if len(parameters) > 1 {
+		if parameters[1] != "--digest" || len(parameters) < 3 {
+			return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, usage)
+		}
+		digestTime, err := parseTimeOfDay(parameters[2])
+		if err != nil {
+			return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, err.Error())
+		}
+		subscription.DigestTime = digestTime
+	}
+
+	userInfo, err := p.getUserInfo(args.UserId)
+	if err != nil || userInfo == nil {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, "Connect your Google Calendar first with `/google-calendar connect`.")
+	}
+
+	// The events of the calendar are synced along with the calendars of the user,
+	// which also checks the user can read it.
+	subscribedCalendar, err := p.addCalendarSubscription(userInfo, subscription.CalendarID, true)
+	if err != nil {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, fmt.Sprintf("Couldn't find calendar `%s`. Make sure it is shared with you.", subscription.CalendarID))
+	}
+	subscription.CalendarID = subscribedCalendar.ID
+	subscription.CalendarName = subscribedCalendar.Summary
+
+	// Subscribing again replaces the previous subscription, e.g. to change the digest time.
+	replaced, err := p.removeChannelSubscriptions(func(s ChannelSubscription) bool {
+		return s.ChannelID == subscription.ChannelID && s.CalendarID == subscription.CalendarID
+	})
+	if err == nil {
+		var subscriptions []ChannelSubscription
+		if subscriptions, err = p.getChannelSubscriptions(); err == nil {
+			err = p.storeChannelSubscriptions(append(subscriptions, subscription))
+		}
+	}
+	p.releaseChannelCalendars(replaced)
+	if err != nil {
+		p.releaseChannelCalendars([]ChannelSubscription{subscription})
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, "Encountered an error subscribing this channel.")
+	}
+
+	message := fmt.Sprintf("Subscribed this channel to calendar **%s**. Its events will be announced here when they start, except all-day events", subscription.CalendarName)
+	if subscription.DigestTime != "" {
+		message += fmt.Sprintf(", and its events of the day will be posted at %s", subscription.DigestTime)
+	}
+	message += "."
+	if subscribedCalendar.Polled {
+		message += fmt.Sprintf(" This calendar can't notify the plugin of changes, so it is checked for changes every %d minutes.", int(pollInterval/time.Minute))
+	}
+	return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, message)
+}
+
+func (p *Plugin) executeChannelList(args *model.CommandArgs) *model.CommandResponse {
+	subscriptions, err := p.getChannelSubscriptions()
+	if err != nil {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, "Encountered an error fetching the subscriptions of this channel.")
+	}
+
+	lines := []string{}
+	for _, subscription := range subscriptions {
+		if subscription.ChannelID != args.ChannelId {
+			continue
+		}
+
+		line := fmt.Sprintf("- **%s** `%s`", subscription.CalendarName, subscription.CalendarID)
+		if subscription.DigestTime != "" {
+			line += fmt.Sprintf(", daily digest at %s", subscription.DigestTime)
+		}
+		if user, appErr := p.API.GetUser(subscription.UserID); appErr == nil {
+			line += fmt.Sprintf(", subscribed by @%s", user.Username)
+		}
+		lines = append(lines, line)
+	}
+
+	if len(lines) == 0 {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, "This channel isn't subscribed to any calendar. Subscribe it with `/google-calendar channel subscribe <calendar ID>`.")
+	}
+
+	return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, "This channel is subscribed to:\n"+strings.Join(lines, "\n"))
+}
+
+// checkChannelSubscriptions announces the events of the subscribed calendars that
+// just started and posts the daily digests that are due.
+func (p *Plugin) checkChannelSubscriptions() error {
+	subscriptions, err := p.getChannelSubscriptions()
+	if err != nil {
+		return err
+	}
+
+	changed := map[string]ChannelSubscription{}
+	for _, subscription := range subscriptions {
+		if p.checkChannelSubscription(&subscription) {
+			changed[subscription.ChannelID+" "+subscription.CalendarID] = subscription
+		}
+	}
+
+	if len(changed) == 0 {
+		return nil
+	}
+
+	// The subscriptions are read again as they may have been changed while the
+	// events were fetched.
+	subscriptions, err = p.getChannelSubscriptions()
+	if err != nil {
+		return err
+	}
+	for index, subscription := range subscriptions {
+		if updated, ok := changed[subscription.ChannelID+" "+subscription.CalendarID]; ok {
+			subscriptions[index].AnnouncedEvents = updated.AnnouncedEvents
+			subscriptions[index].LastDigestDate = updated.LastDigestDate
+		}
+	}
+	return p.storeChannelSubscriptions(subscriptions)
+}
+
+// checkChannelSubscription posts the announcements and digest due for a channel
+// subscription. The events are announced from the events of the calendar synced
+// for the user who made the subscription. It returns whether the subscription
+// was changed.
+func (p *Plugin) checkChannelSubscription(subscription *ChannelSubscription) bool {
+	userInfo, err := p.getUserInfo(subscription.UserID)
+	if err != nil || userInfo == nil {
+		return false
+	}
+
+	calendarInfo, err := p.getCalendarInfo(subscription.UserID)
+	if err != nil || calendarInfo == nil {
+		return false
+	}
+
+	// The calendar isn't synced yet if the subscription was made before channel
+	// subscriptions used the synced events, or if the user switched providers.
+	if calendarInfo.getCalendar(subscription.CalendarID) == nil {
+		if _, err := p.addCalendarSubscription(userInfo, subscription.CalendarID, true); err != nil {
+			mlog.Error("Error syncing the calendar of a channel subscription", mlog.String("channel_id", subscription.ChannelID), mlog.String("calendar_id", subscription.CalendarID), mlog.Err(err))
+		}
+		return false
+	}
+
+	now := p.now().In(p.getUserLocation(subscription.UserID))
+
+	announced := map[string]bool{}
+	for _, key := range subscription.AnnouncedEvents {
+		announced[key] = true
+	}
+
+	// The announced events are stored again when one was announced or when the
+	// grace period of one ended.
+	announcedEvents := []string{}
+	changed := false
+	for _, e := range calendarInfo.Events {
+		if e.CalendarID != subscription.CalendarID {
+			continue
+		}
+
+		// All-day events are only listed in the daily digest.
+		start, _, err := eventTimes(e, now.Location())
+		if err != nil || e.AllDay || now.Before(start) || !now.Before(start.Add(reminderGracePeriod)) {
+			continue
+		}
+
+		key := e.Id + " " + e.StartTime
+		if !announced[key] {
+			if err := p.createChannelPost(subscription.ChannelID, generateSlackAttachment(e, subscription.CalendarName, now)); err != nil {
+				mlog.Error("Error announcing an event", mlog.String("channel_id", subscription.ChannelID), mlog.Err(err))
+				continue
+			}
+			changed = true
+		}
+		announcedEvents = append(announcedEvents, key)
+	}
+
+	if len(announcedEvents) != len(subscription.AnnouncedEvents) {
+		changed = true
+	}
+	subscription.AnnouncedEvents = announcedEvents
+
+	if p.checkChannelDigest(userInfo, subscription, now) {
+		changed = true
+	}
+
+	return changed
+}
+
+// checkChannelDigest posts the events of the day of the subscribed calendar if
+// the digest is due. It returns whether the digest was posted.
+func (p *Plugin) checkChannelDigest(u *UserInfo, subscription *ChannelSubscription, now time.Time) bool {
+	today := now.Format("2006-01-02")
+	if subscription.DigestTime == "" || subscription.LastDigestDate == today {
+		return false
+	}
+
+	digestAt, err := time.ParseInLocation("2006-01-02 15:04", today+" "+subscription.DigestTime, now.Location())
+	if err != nil || now.Before(digestAt) {
+		return false
+	}
+
+	dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	events, err := p.listEvents(u, subscription.CalendarID, dayStart, dayStart.AddDate(0, 0, 1))
+	if err != nil {
+		mlog.Error("Error fetching the events of a channel subscription", mlog.String("channel_id", subscription.ChannelID), mlog.String("calendar_id", subscription.CalendarID), mlog.Err(err))
+		return false
+	}
+
+	attachments := []*model.SlackAttachment{{Text: "No events scheduled today.", Color: "#7FC1EE"}}
+	if len(events) > 0 {
+		attachments = generateAgendaAttachments(events, nil, dayStart, now)
+	}
+	attachments[0].Pretext = fmt.Sprintf("Today on %s", subscription.CalendarName)
+
+	if err := p.createChannelPost(subscription.ChannelID, attachments...); err != nil {
+		mlog.Error("Error posting a channel digest", mlog.String("channel_id", subscription.ChannelID), mlog.Err(err))
+		return false
+	}
+
+	subscription.LastDigestDate = today
+	return true
+}
+
+func (p *Plugin) createChannelPost(channelID string, attachments ...*model.SlackAttachment) error {
+	if _, appErr := p.createBotPost(&model.Post{
+		ChannelId: channelID,
+		Type:      model.POST_SLACK_ATTACHMENT,
+		Props: map[string]interface{}{
+			"attachments": attachments,
+		},
+	}); appErr != nil {
+		return appErr
+	}
+	return nil
+}
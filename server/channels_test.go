@@ -0,0 +1,109 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/mattermost/mattermost-server/plugin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/calendar/v3"
+)
+
+// postTitles returns the titles of the attachments posted in a channel.
+func (e *testEnv) postTitles(channelID string) []string {
+	titles := []string{}
+	for _, post := range e.channelPosts(channelID) {
+		for _, attachment := range post.Attachments() {
+			if attachment.Title != "" {
+				titles = append(titles, attachment.Title)
+			}
+		}
+	}
+	return titles
+}
+
+func TestChannelSubscription(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	e.google.AddCalendar(&calendar.CalendarListEntry{Id: "team@example.com", Summary: "Team", AccessRole: "reader"})
+	e.connected(t, testUserID)
+
+	resp, appErr := e.p.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{UserId: testUserID, ChannelId: "town-square", Command: "/google-calendar channel subscribe team@example.com"})
+	require.Nil(t, appErr)
+	assert.Contains(t, resp.Text, "Subscribed this channel to calendar **Team**.")
+	assert.Contains(t, resp.Text, "except all-day events")
+
+	// The calendar is synced and watched along with the calendars of the user,
+	// without reminding them of its events.
+	calendarInfo, err := e.p.getCalendarInfo(testUserID)
+	require.NoError(t, err)
+	teamCalendar := calendarInfo.getCalendar("team@example.com")
+	require.NotNil(t, teamCalendar)
+	assert.True(t, teamCalendar.ChannelsOnly)
+	assert.NotEmpty(t, teamCalendar.WatchToken)
+
+	e.addEvent(t, "team@example.com", "Retro", 20*time.Minute, time.Hour)
+	today := e.clock.Now().Format("2006-01-02")
+	_, err = e.google.AddEvent("team@example.com", &calendar.Event{
+		Summary: "Offsite",
+		Start:   &calendar.EventDateTime{Date: today},
+		End:     &calendar.EventDateTime{Date: e.clock.Now().AddDate(0, 0, 1).Format("2006-01-02")},
+	})
+	require.NoError(t, err)
+	require.NoError(t, e.google.Notify("team@example.com"))
+
+	subscribedAt := e.clock.Now()
+	for _, offset := range []time.Duration{0, 10 * time.Minute, 21 * time.Minute, 22 * time.Minute} {
+		e.clock.set(subscribedAt.Add(offset))
+		require.NoError(t, e.p.checkEvents(testUserID))
+		require.NoError(t, e.p.checkChannelSubscriptions())
+	}
+
+	assert.Equal(t, []string{"Retro"}, e.postTitles("town-square"), "events are announced once, all-day events aren't")
+	assert.Empty(t, e.postTitles(directChannelID(testUserID)))
+
+	// The user isn't subscribed to the calendar themselves.
+	resp, appErr = e.p.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{UserId: testUserID, Command: "/google-calendar calendars unsubscribe team@example.com"})
+	require.Nil(t, appErr)
+	assert.Equal(t, "You aren't subscribed to calendar `team@example.com`.", resp.Text)
+
+	// Unsubscribing the channel stops syncing the calendar.
+	channels := len(e.google.Channels())
+	resp, appErr = e.p.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{UserId: testUserID, ChannelId: "town-square", Command: "/google-calendar channel unsubscribe team@example.com"})
+	require.Nil(t, appErr)
+	assert.Equal(t, "Unsubscribed this channel from calendar `team@example.com`.", resp.Text)
+
+	calendarInfo, err = e.p.getCalendarInfo(testUserID)
+	require.NoError(t, err)
+	assert.Nil(t, calendarInfo.getCalendar("team@example.com"))
+	assert.Len(t, e.google.Channels(), channels-1)
+}
+
+func TestChannelSubscriptionOfSubscribedCalendar(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	e.google.AddCalendar(&calendar.CalendarListEntry{Id: "team@example.com", Summary: "Team", AccessRole: "reader"})
+	e.connected(t, testUserID)
+
+	for _, command := range []string{"/google-calendar calendars subscribe team@example.com", "/google-calendar channel subscribe team@example.com"} {
+		_, appErr := e.p.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{UserId: testUserID, ChannelId: "town-square", Command: command})
+		require.Nil(t, appErr)
+	}
+
+	calendarInfo, err := e.p.getCalendarInfo(testUserID)
+	require.NoError(t, err)
+	require.NotNil(t, calendarInfo.getCalendar("team@example.com"))
+	assert.False(t, calendarInfo.getCalendar("team@example.com").ChannelsOnly, "the calendar keeps reminding the user")
+
+	// Once the user unsubscribes, the calendar keeps being synced for the channel.
+	resp, appErr := e.p.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{UserId: testUserID, Command: "/google-calendar calendars unsubscribe team@example.com"})
+	require.Nil(t, appErr)
+	assert.Equal(t, "Unsubscribed from calendar `team@example.com`.", resp.Text)
+
+	calendarInfo, err = e.p.getCalendarInfo(testUserID)
+	require.NoError(t, err)
+	require.NotNil(t, calendarInfo.getCalendar("team@example.com"))
+	assert.True(t, calendarInfo.getCalendar("team@example.com").ChannelsOnly)
+}
@@ -0,0 +1,24 @@
+package main
+
+import "time"
+
+// clock tells the current time. The plugin reads the time through its clock, so
+// tests can drive the reminders, digests and watch renewals deterministically.
+type clock interface {
+	Now() time.Time
+}
+
+// systemClock is the clock of the system, used unless the plugin is given another one.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// now returns the current time according to the clock of the plugin.
+func (p *Plugin) now() time.Time {
+	if p.clock == nil {
+		return systemClock{}.Now()
+	}
+	return p.clock.Now()
+}
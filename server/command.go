@@ -10,7 +10,7 @@ func getCommand() *model.Command {
 		Description:      "Mattermost Google Calendar integration",
 		DisplayName:      "Google Calendar bot",
 		AutoComplete:     true,
-		AutoCompleteDesc: "Available commands: connect",
+		AutoCompleteDesc: "Available commands: connect, disconnect, calendars, channel, create, meet-channel, availability, today, tomorrow, week, settings",
 		AutoCompleteHint: "[command]",
 	}
 }
@@ -3,8 +3,16 @@ package main
 import (
 	"fmt"
 	"reflect"
+	"strings"
 
 	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	// googleRevokeURL is the endpoint used to revoke the tokens granted to the plugin.
+	googleRevokeURL = "https://oauth2.googleapis.com/revoke"
 )
 
 // configuration captures the plugin's external configuration as exposed
@@ -15,14 +23,26 @@ type configuration struct {
 	CalendarOAuthClientID     string
 	CalendarOAuthClientSecret string
 	Secret                    string
+	EnableWriteAccess         bool
+
+	// CalDAVServerURL is the CalDAV server users can connect a calendar of
+	// instead of a Google Calendar. Connecting CalDAV calendars is disabled when
+	// it is empty.
+	CalDAVServerURL string
+
+	// GoogleCalendarAPIURL and GoogleOAuthURL replace the endpoints of Google, e.g.
+	// to run the plugin against a fake server. They aren't shown in the System
+	// Console and default to Google when empty.
+	GoogleCalendarAPIURL string
+	GoogleOAuthURL       string
+
+	// previousSecret is the secret before it last changed, which decrypts the
+	// records that weren't re-encrypted with the current secret yet.
+	previousSecret string
 }
 
 // IsValid validates if all the required fields are set.
 func (c *configuration) IsValid() error {
-	if c.Username == "" {
-		return fmt.Errorf("Need a user to make posts as")
-	}
-
 	if c.CalendarOAuthClientID == "" {
 		return fmt.Errorf("Must have Google Calendar oauth client id")
 	}
@@ -38,6 +58,27 @@ func (c *configuration) IsValid() error {
 	return nil
 }
 
+// oauthEndpoint returns the OAuth endpoint of Google, or the /auth and /token
+// endpoints of the server at GoogleOAuthURL.
+func (c *configuration) oauthEndpoint() oauth2.Endpoint {
+	if c.GoogleOAuthURL == "" {
+		return google.Endpoint
+	}
+	baseURL := strings.TrimSuffix(c.GoogleOAuthURL, "/")
+	return oauth2.Endpoint{
+		AuthURL:  baseURL + "/auth",
+		TokenURL: baseURL + "/token",
+	}
+}
+
+// oauthRevokeURL returns the endpoint used to revoke the tokens granted to the plugin.
+func (c *configuration) oauthRevokeURL() string {
+	if c.GoogleOAuthURL == "" {
+		return googleRevokeURL
+	}
+	return strings.TrimSuffix(c.GoogleOAuthURL, "/") + "/revoke"
+}
+
 // getConfiguration retrieves the active configuration under lock, making it safe to use
 // concurrently. The active configuration may change underneath the client of this method, but
 // the struct returned by this API call is considered immutable.
@@ -88,7 +129,17 @@ func (p *Plugin) OnConfigurationChange() error {
 		return errors.Wrap(err, "failed to load plugin configuration")
 	}
 
+	previous := p.getConfiguration()
+	configuration.previousSecret = previous.previousSecret
+	if previous.Secret != "" && configuration.Secret != previous.Secret {
+		configuration.previousSecret = previous.Secret
+	}
 	p.setConfiguration(configuration)
 
+	// The stored tokens are encrypted with a key derived from the secret.
+	if previous.Secret != "" && configuration.Secret != "" && configuration.Secret != previous.Secret {
+		go p.reencryptUserTokens(previous.Secret)
+	}
+
 	return nil
 }
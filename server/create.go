@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/mlog"
+	"github.com/mattermost/mattermost-server/model"
+)
+
+// maxEventDuration is the longest duration of an event created from Mattermost.
+const maxEventDuration = 24 * time.Hour
+
+// newEvent captures the details of an event created from Mattermost.
+type newEvent struct {
+	title     string
+	start     time.Time
+	duration  time.Duration
+	attendees []string
+	addMeet   bool
+}
+
+// executeCreateCommand creates an event in the user's primary calendar from the
+// command parameters, or opens the event creation dialog if there are none.
+func (p *Plugin) executeCreateCommand(args *model.CommandArgs, parameters []string) *model.CommandResponse {
+	if !p.getConfiguration().EnableWriteAccess {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, "Creating events isn't enabled. Ask your system administrator to enable **Allow responding to and creating events**.")
+	}
+
+	userInfo, err := p.getUserInfo(args.UserId)
+	if err != nil || userInfo == nil {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, "Connect your Google Calendar first with `/google-calendar connect`.")
+	}
+
+	if len(parameters) == 0 {
+		if err := p.openCreateEventDialog(args); err != nil {
+			mlog.Error("Error opening the event creation dialog " + err.Error())
+			return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, "Encountered an error opening the event creation dialog.")
+		}
+		return &model.CommandResponse{}
+	}
+
+	e, err := parseCreateParameters(parameters, p.now().In(p.getUserLocation(args.UserId)))
+	if err != nil {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, err.Error())
+	}
+
+	event, err := p.insertEvent(userInfo, e)
+	if err != nil {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, err.Error())
+	}
+
+	return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, createdEventMessage(event))
+}
+
+// parseCreateParameters parses the parameters of the create command:
+// <day> <time> <duration> <title> [@username ...] [--meet]
+// where day is today, tomorrow or a date formatted as 2006-01-02.
+func parseCreateParameters(parameters []string, now time.Time) (*newEvent, error) {
+	usage := errors.New("Use `/google-calendar create <today|tomorrow|YYYY-MM-DD> <time> <duration> <title> [@username ...] [--meet]`, e.g. `/google-calendar create tomorrow 15:00 30m Design review @alice --meet`, or `/google-calendar create` to open a dialog.")
+	if len(parameters) < 4 {
+		return nil, usage
+	}
+
+	start, err := parseEventStart(parameters[0], parameters[1], now)
+	if err != nil {
+		return nil, err
+	}
+
+	duration, err := parseEventDuration(parameters[2])
+	if err != nil {
+		return nil, err
+	}
+
+	e := &newEvent{start: start, duration: duration}
+	title := []string{}
+	for _, parameter := range parameters[3:] {
+		switch {
+		case parameter == "--meet":
+			e.addMeet = true
+		case strings.HasPrefix(parameter, "@"):
+			e.attendees = append(e.attendees, strings.TrimPrefix(parameter, "@"))
+		default:
+			title = append(title, parameter)
+		}
+	}
+
+	e.title = strings.Join(title, " ")
+	if e.title == "" {
+		return nil, usage
+	}
+
+	return e, nil
+}
+
+// parseEventStart parses the day and time of day of the start of an event in the
+// timezone of now. The day is today, tomorrow or a date formatted as 2006-01-02.
+func parseEventStart(day, timeOfDay string, now time.Time) (time.Time, error) {
+	switch strings.ToLower(day) {
+	case "today":
+		day = now.Format("2006-01-02")
+	case "tomorrow":
+		day = now.AddDate(0, 0, 1).Format("2006-01-02")
+	}
+
+	clock, err := parseTimeOfDay(timeOfDay)
+	if err != nil || clock == "" {
+		return time.Time{}, fmt.Errorf("Invalid time `%s`. Use a time of day such as `9:00`, `17:30` or `3pm`.", timeOfDay)
+	}
+
+	start, err := time.ParseInLocation("2006-01-02 15:04", day+" "+clock, now.Location())
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid day `%s`. Use `today`, `tomorrow` or a date such as `%s`.", day, now.Format("2006-01-02"))
+	}
+
+	return start, nil
+}
+
+// parseEventDuration parses the duration of an event, such as "30m" or "1h30m".
+func parseEventDuration(value string) (time.Duration, error) {
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < time.Minute || duration > maxEventDuration {
+		return 0, fmt.Errorf("Invalid duration `%s`. Use a duration of at most 24 hours such as `30m`, `1h` or `1h30m`.", value)
+	}
+	return duration, nil
+}
+
+// insertEvent creates an event in the user's primary calendar, inviting the
+// Mattermost users listed as attendees by their email address.
+func (p *Plugin) insertEvent(u *UserInfo, e *newEvent) (*Event, error) {
+	request := &EventRequest{
+		Summary:    e.title,
+		Start:      e.start,
+		End:        e.start.Add(e.duration),
+		AddMeeting: e.addMeet,
+	}
+	for _, username := range e.attendees {
+		user, appErr := p.API.GetUserByUsername(username)
+		if appErr != nil {
+			return nil, fmt.Errorf("Unknown user `@%s`.", username)
+		}
+		request.AttendeeEmails = append(request.AttendeeEmails, user.Email)
+	}
+
+	provider, err := p.getCalendarProvider(u)
+	if err != nil {
+		return nil, errors.New("Encountered an error connecting to Google Calendar.")
+	}
+
+	created, err := provider.CreateEvent(request)
+	if err != nil {
+		mlog.Error("Error creating an event", mlog.String("user_id", u.UserID), mlog.Err(err))
+		return nil, errors.New("Encountered an error creating the event. If you connected before creating events was enabled, reconnect with `/google-calendar connect` and try again.")
+	}
+
+	return created, nil
+}
+
+// createdEventMessage confirms the creation of an event, linking to it and to its meeting.
+func createdEventMessage(event *Event) string {
+	message := fmt.Sprintf("Created [%s](%s).", event.Summary, event.HTMLLink)
+	if event.MeetingLink != "" {
+		message += fmt.Sprintf(" [Join meeting](%s)", event.MeetingLink)
+	}
+	return message
+}
+
+// openCreateEventDialog opens the dialog creating an event in the user's primary calendar.
+func (p *Plugin) openCreateEventDialog(args *model.CommandArgs) error {
+	config := p.API.GetConfig()
+	now := p.now().In(p.getUserLocation(args.UserId))
+
+	durations := []*model.PostActionOptions{}
+	for _, duration := range []string{"15m", "30m", "45m", "1h", "1h30m", "2h"} {
+		durations = append(durations, &model.PostActionOptions{Text: duration, Value: duration})
+	}
+
+	if appErr := p.API.OpenInteractiveDialog(model.OpenDialogRequest{
+		TriggerId: args.TriggerId,
+		URL:       fmt.Sprintf("%s/plugins/google-calendar/dialog/create", *config.ServiceSettings.SiteURL),
+		Dialog: model.Dialog{
+			CallbackId:  "create",
+			Title:       "Create an event",
+			SubmitLabel: "Create",
+			State:       p.signIntegrationRequest(args.UserId),
+			Elements: []model.DialogElement{
+				{DisplayName: "Title", Name: "title", Type: "text"},
+				{DisplayName: "Day", Name: "day", Type: "text", Default: now.Format("2006-01-02"), HelpText: "today, tomorrow or a date formatted as YYYY-MM-DD"},
+				{DisplayName: "Time", Name: "time", Type: "text", Placeholder: "15:00", HelpText: "Local time of day, e.g. 9:00, 17:30 or 3pm"},
+				{DisplayName: "Duration", Name: "duration", Type: "select", Default: "30m", Options: durations},
+				{DisplayName: "Attendees", Name: "attendees", Type: "text", Optional: true, Placeholder: "@alice @bob"},
+				{DisplayName: "Add Google Meet", Name: "meet", Type: "select", Optional: true, Options: []*model.PostActionOptions{
+					{Text: "Yes", Value: "yes"},
+					{Text: "No", Value: "no"},
+				}},
+			},
+		},
+	}); appErr != nil {
+		return appErr
+	}
+	return nil
+}
+
+// submitCreateEventDialog handles the submission of the event creation dialog.
+func (p *Plugin) submitCreateEventDialog(w http.ResponseWriter, r *http.Request) {
+	request := model.SubmitDialogRequestFromJson(r.Body)
+	if request == nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if !hmac.Equal([]byte(request.State), []byte(p.signIntegrationRequest(request.UserId))) {
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	if request.Cancelled {
+		return
+	}
+
+	value := func(name string) string {
+		v, _ := request.Submission[name].(string)
+		return strings.TrimSpace(v)
+	}
+
+	now := p.now().In(p.getUserLocation(request.UserId))
+	e := &newEvent{title: value("title"), addMeet: value("meet") == "yes"}
+	errs := map[string]string{}
+
+	if e.title == "" {
+		errs["title"] = "Enter a title."
+	}
+
+	start, err := parseEventStart(value("day"), value("time"), now)
+	if err != nil {
+		errs["time"] = err.Error()
+	}
+	e.start = start
+
+	duration, err := parseEventDuration(value("duration"))
+	if err != nil {
+		errs["duration"] = err.Error()
+	}
+	e.duration = duration
+
+	for _, attendee := range strings.Fields(strings.Replace(value("attendees"), ",", " ", -1)) {
+		e.attendees = append(e.attendees, strings.TrimPrefix(attendee, "@"))
+	}
+
+	if len(errs) > 0 {
+		json.NewEncoder(w).Encode(&model.SubmitDialogResponse{Errors: errs})
+		return
+	}
+
+	userInfo, err := p.getUserInfo(request.UserId)
+	if err != nil || userInfo == nil {
+		json.NewEncoder(w).Encode(&model.SubmitDialogResponse{Errors: map[string]string{"title": "Connect your Google Calendar first with /google-calendar connect."}})
+		return
+	}
+
+	event, err := p.insertEvent(userInfo, e)
+	if err != nil {
+		json.NewEncoder(w).Encode(&model.SubmitDialogResponse{Errors: map[string]string{"attendees": err.Error()}})
+		return
+	}
+
+	p.API.SendEphemeralPost(request.UserId, &model.Post{
+		ChannelId: request.ChannelId,
+		UserId:    p.BotUserID,
+		Message:   createdEventMessage(event),
+	})
+}
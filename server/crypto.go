@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/mattermost/mattermost-server/mlog"
+	"golang.org/x/oauth2"
+)
+
+// storedUserInfo is the format UserInfo records are stored in, with the token or
+// the CalDAV password encrypted with a key derived from the configured secret.
+type storedUserInfo struct {
+	UserID         string
+	ChannelID      string
+	EncryptedToken string
+
+	// KeyID identifies the secret the record was encrypted with, see keyID.
+	KeyID string `json:",omitempty"`
+
+	// Token is the plaintext token of records stored before tokens were
+	// encrypted, see migrateUserTokens.
+	Token *oauth2.Token `json:",omitempty"`
+
+	// CalDAV is the account of users who connected a CalDAV account, whose
+	// password is stored in EncryptedPassword.
+	CalDAV            *CalDAVAccount `json:",omitempty"`
+	EncryptedPassword string         `json:",omitempty"`
+}
+
+// decrypt returns the user information with the token or the CalDAV password
+// decrypted with the given secret.
+func (stored *storedUserInfo) decrypt(secret string) (*UserInfo, error) {
+	if stored.KeyID != "" && stored.KeyID != keyID(secret) {
+		return nil, errors.New("the record was encrypted with another secret")
+	}
+
+	userInfo := &UserInfo{
+		UserID:    stored.UserID,
+		ChannelID: stored.ChannelID,
+		Token:     stored.Token,
+	}
+
+	if stored.CalDAV != nil {
+		password, err := decrypt(encryptionKey(secret), stored.EncryptedPassword)
+		if err != nil {
+			return nil, err
+		}
+		account := *stored.CalDAV
+		account.Password = string(password)
+		userInfo.CalDAV = &account
+	}
+
+	if stored.EncryptedToken != "" {
+		token, err := decryptToken(secret, stored.EncryptedToken)
+		if err != nil {
+			return nil, err
+		}
+		userInfo.Token = token
+	}
+
+	return userInfo, nil
+}
+
+// encryptionKey derives the AES-256 key used to encrypt tokens from a secret.
+func encryptionKey(secret string) []byte {
+	key := sha256.Sum256([]byte(secret))
+	return key[:]
+}
+
+// keyID returns an identifier of the key derived from a secret, stored with the
+// records encrypted with it so that a change of secret is told apart from
+// corrupted data. It doesn't reveal the key.
+func keyID(secret string) string {
+	id := sha256.Sum256(append([]byte("key-id|"), encryptionKey(secret)...))
+	return hex.EncodeToString(id[:8])
+}
+
+// encrypt encrypts data with AES-GCM, returning the nonce followed by the
+// ciphertext, encoded in base64.
+func encrypt(key, data []byte) (string, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, data, nil)), nil
+}
+
+// decrypt decrypts data encrypted by encrypt.
+func decrypt(key []byte, encoded string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("encrypted data is too short")
+	}
+
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
+
+// encryptToken encodes a token for storage.
+func encryptToken(secret string, token *oauth2.Token) (string, error) {
+	jsonToken, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	return encrypt(encryptionKey(secret), jsonToken)
+}
+
+// decryptToken decodes a token encoded by encryptToken.
+func decryptToken(secret, encryptedToken string) (*oauth2.Token, error) {
+	jsonToken, err := decrypt(encryptionKey(secret), encryptedToken)
+	if err != nil {
+		return nil, err
+	}
+
+	var token oauth2.Token
+	if err := json.Unmarshal(jsonToken, &token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// reencryptUserTokens re-encrypts the stored tokens and CalDAV passwords after
+// the secret changed from previousSecret to the current one. Records that can't
+// be decrypted with the previous secret, e.g. because another node already
+// re-encrypted them, are skipped.
+func (p *Plugin) reencryptUserTokens(previousSecret string) {
+	userIDs, err := p.listStoredUserIDs()
+	if err != nil {
+		mlog.Error("Error listing the stored tokens " + err.Error())
+		return
+	}
+
+	reencrypted := 0
+	for _, userID := range userIDs {
+		stored, err := p.getStoredUserInfo(userID)
+		if err != nil || stored == nil || (stored.EncryptedToken == "" && stored.EncryptedPassword == "") || stored.KeyID == keyID(p.getConfiguration().Secret) {
+			continue
+		}
+
+		userInfo, err := stored.decrypt(previousSecret)
+		if err != nil {
+			continue
+		}
+
+		if err := p.storeUserInfo(userInfo); err != nil {
+			mlog.Error("Error re-encrypting a token", mlog.String("user_id", userID), mlog.Err(err))
+			continue
+		}
+		reencrypted++
+	}
+
+	mlog.Info("Re-encrypted the stored tokens with the new secret", mlog.Int("users", reencrypted))
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+
+	"github.com/waseem18/mattermost-plugin-google-calendar/server/fakegoogle"
+)
+
+// changeSecret changes the secret the way the System Console does, through
+// OnConfigurationChange.
+func (e *testEnv) changeSecret(t *testing.T, secret string) {
+	config := *e.p.getConfiguration()
+	config.Secret = secret
+	e.api.On("LoadPluginConfiguration", mock.Anything).Return(func(dest interface{}) error {
+		*dest.(*configuration) = config
+		return nil
+	}).Once()
+	require.NoError(t, e.p.OnConfigurationChange())
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	key := encryptionKey("secret")
+
+	encrypted, err := encrypt(key, []byte("refresh-token"))
+	require.NoError(t, err)
+	assert.NotContains(t, encrypted, "refresh-token")
+
+	again, err := encrypt(key, []byte("refresh-token"))
+	require.NoError(t, err)
+	assert.NotEqual(t, encrypted, again, "each encryption uses a new nonce")
+
+	decrypted, err := decrypt(key, encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, "refresh-token", string(decrypted))
+
+	_, err = decrypt(encryptionKey("another secret"), encrypted)
+	assert.Error(t, err)
+	_, err = decrypt(key, encrypted[:8])
+	assert.Error(t, err)
+	_, err = decrypt(key, "not base64!")
+	assert.Error(t, err)
+}
+
+func TestEncryptToken(t *testing.T) {
+	token := &oauth2.Token{AccessToken: "access", RefreshToken: "refresh", Expiry: time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)}
+
+	encrypted, err := encryptToken("secret", token)
+	require.NoError(t, err)
+
+	decrypted, err := decryptToken("secret", encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, token.AccessToken, decrypted.AccessToken)
+	assert.Equal(t, token.RefreshToken, decrypted.RefreshToken)
+	assert.True(t, token.Expiry.Equal(decrypted.Expiry))
+
+	_, err = decryptToken("another secret", encrypted)
+	assert.Error(t, err)
+}
+
+func TestStoredUserInfoKeyID(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	e.connected(t, testUserID)
+
+	stored, err := e.p.getStoredUserInfo(testUserID)
+	require.NoError(t, err)
+	assert.Equal(t, keyID("secret"), stored.KeyID)
+	assert.NotEqual(t, keyID("secret"), keyID("another secret"))
+	assert.Nil(t, stored.Token, "the token is only stored encrypted")
+
+	_, err = stored.decrypt("another secret")
+	assert.Error(t, err)
+}
+
+func TestSecretRotation(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	connected := e.connected(t, testUserID)
+
+	e.changeSecret(t, "new secret")
+
+	// Whether or not the background re-encryption got to the user yet, their
+	// token is readable and ends up encrypted with the new secret.
+	userInfo, err := e.p.getUserInfo(testUserID)
+	require.NoError(t, err)
+	require.NotNil(t, userInfo)
+	assert.Equal(t, connected.Token.RefreshToken, userInfo.Token.RefreshToken)
+
+	stored, err := e.p.getStoredUserInfo(testUserID)
+	require.NoError(t, err)
+	assert.Equal(t, keyID("new secret"), stored.KeyID)
+
+	// Watch channels created with the previous secret keep being accepted.
+	e.addEvent(t, fakegoogle.PrimaryCalendarID, "All hands", time.Hour, time.Hour)
+	require.NoError(t, e.google.Notify(fakegoogle.PrimaryCalendarID))
+	assert.Equal(t, []string{"All hands"}, e.storedEvents(t, testUserID))
+}
+
+func TestReencryptUserTokens(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	e.connected(t, testUserID)
+	e.connected(t, "user2")
+
+	config := *e.p.getConfiguration()
+	config.Secret = "new secret"
+	e.p.setConfiguration(&config)
+	e.p.reencryptUserTokens("secret")
+
+	for _, userID := range []string{testUserID, "user2"} {
+		stored, err := e.p.getStoredUserInfo(userID)
+		require.NoError(t, err)
+		assert.Equal(t, keyID("new secret"), stored.KeyID)
+
+		_, err = stored.decrypt("new secret")
+		assert.NoError(t, err)
+	}
+}
+
+func TestSecretChangedWhileDisabled(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	userInfo := e.connected(t, testUserID)
+
+	// A reminder is due when the scheduler finds out, which it checks with the
+	// calendar information of the user locked.
+	e.addEvent(t, fakegoogle.PrimaryCalendarID, "Standup", 5*time.Minute, 15*time.Minute)
+	require.NoError(t, e.p.updateCalendarEvents(userInfo, "primary"))
+
+	// The previous secret isn't known, as if the plugin was restarted with a new one.
+	config := *e.p.getConfiguration()
+	config.Secret = "new secret"
+	e.p.setConfiguration(&config)
+
+	userInfo, err := e.p.getUserInfo(testUserID)
+	assert.True(t, isAuthorizationError(err))
+	assert.Nil(t, userInfo)
+
+	err = e.p.checkEvents(testUserID)
+	assert.True(t, isAuthorizationError(err))
+
+	stored, err := e.p.getStoredUserInfo(testUserID)
+	require.NoError(t, err)
+	assert.Nil(t, stored, "the user is disconnected")
+
+	posts := e.channelPosts(directChannelID(testUserID))
+	require.NotEmpty(t, posts)
+	assert.Equal(t, fmt.Sprintf(authorizationRevokedMessage, e.mattermost.URL), posts[len(posts)-1].Message)
+
+	// They are only notified once.
+	require.NoError(t, e.p.checkEvents(testUserID))
+	assert.Len(t, e.channelPosts(directChannelID(testUserID)), len(posts))
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/mlog"
+	"github.com/mattermost/mattermost-server/model"
+)
+
+const (
+	// workdayStart and workdayEnd bound, in local hours, the free time listed in the daily digest.
+	workdayStart = 9
+	workdayEnd   = 17
+
+	// minFreeTime is the shortest gap between meetings listed as free time.
+	minFreeTime = 30 * time.Minute
+)
+
+// interval is a span of time taken by a meeting.
+type interval struct {
+	start   time.Time
+	end     time.Time
+	summary string
+}
+
+// checkDigest posts the daily digest to the user if it is due and hasn't been sent today.
+func (p *Plugin) checkDigest(userID string) error {
+	settings, err := p.getUserSettings(userID)
+	if err != nil || settings.DigestTime == "" {
+		return err
+	}
+
+	now := p.now().In(p.getUserLocation(userID))
+	if settings.DigestSkipWeekends && (now.Weekday() == time.Saturday || now.Weekday() == time.Sunday) {
+		return nil
+	}
+
+	today := now.Format("2006-01-02")
+	digestAt, err := time.ParseInLocation("2006-01-02 15:04", today+" "+settings.DigestTime, now.Location())
+	if err != nil || now.Before(digestAt) {
+		return err
+	}
+
+	calendarInfo, err := p.getCalendarInfo(userID)
+	if err != nil || calendarInfo == nil || calendarInfo.LastDigestDate == today {
+		return err
+	}
+
+	userInfo, err := p.getUserInfo(userID)
+	if err != nil || userInfo == nil {
+		return err
+	}
+
+	dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	events, calendarNames, err := p.listDigestEvents(userInfo, calendarInfo, dayStart, dayStart.AddDate(0, 0, 1))
+	if err != nil {
+		return err
+	}
+
+	if _, appErr := p.createBotPost(&model.Post{
+		ChannelId: userInfo.ChannelID,
+		Type:      model.POST_SLACK_ATTACHMENT,
+		Props: map[string]interface{}{
+			"attachments": generateDigestAttachments(events, calendarNames, dayStart, now),
+		},
+	}); appErr != nil {
+		return appErr
+	}
+
+	_, err = p.updateCalendarInfo(userID, func(calendarInfo *CalendarInfo) bool {
+		calendarInfo.LastDigestDate = today
+		return true
+	})
+	return err
+}
+
+// listDigestEvents returns the events between timeMin and timeMax of the calendars
+// the user subscribed to, ordered by their start, along with the names of their
+// calendars keyed by event ID if there are several. Events the user sees on
+// several calendars, e.g. invitations on a shared calendar, are listed once.
+// Calendars whose events can't be fetched are left out, unless all of them fail.
+func (p *Plugin) listDigestEvents(u *UserInfo, calendarInfo *CalendarInfo, timeMin, timeMax time.Time) ([]*Event, map[string]string, error) {
+	calendarIDs := []string{}
+	for _, subscribedCalendar := range calendarInfo.Calendars {
+		if !subscribedCalendar.ChannelsOnly {
+			calendarIDs = append(calendarIDs, subscribedCalendar.ID)
+		}
+	}
+
+	events := []*Event{}
+	calendarNames := map[string]string{}
+	var lastErr error
+	for _, calendarID := range calendarIDs {
+		calendarEvents, err := p.listEvents(u, calendarID, timeMin, timeMax)
+		if err != nil {
+			if isAuthorizationError(err) {
+				return nil, nil, err
+			}
+			mlog.Warn("Unable to fetch the events of a calendar for the daily digest", mlog.String("user_id", u.UserID), mlog.String("calendar_id", calendarID), mlog.Err(err))
+			lastErr = err
+			continue
+		}
+
+		for _, event := range calendarEvents {
+			if _, ok := calendarNames[event.ID]; ok {
+				continue
+			}
+			calendarNames[event.ID] = calendarInfo.calendarName(calendarID)
+			events = append(events, event)
+		}
+	}
+
+	if len(events) == 0 && lastErr != nil {
+		return nil, nil, lastErr
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		start, _, _ := eventTimes(newEventInfo(events[i]), timeMin.Location())
+		otherStart, _, _ := eventTimes(newEventInfo(events[j]), timeMin.Location())
+		return start.Before(otherStart)
+	})
+
+	if len(calendarIDs) < 2 {
+		calendarNames = nil
+	}
+	return events, calendarNames, nil
+}
+
+// generateDigestAttachments renders the daily digest of the day starting at
+// dayStart: the agenda followed by a summary of the meetings, conflicts and free
+// time. The events are labelled with the names of their calendars, if given.
+func generateDigestAttachments(events []*Event, calendarNames map[string]string, dayStart, now time.Time) []*model.SlackAttachment {
+	if len(events) == 0 {
+		return []*model.SlackAttachment{{
+			Pretext: "Your daily digest",
+			Text:    "No events scheduled today.",
+			Color:   "#7FC1EE",
+		}}
+	}
+
+	attachments := generateAgendaAttachments(events, calendarNames, dayStart, now)
+	attachments[0].Pretext = "Your daily digest"
+
+	meetings := []interval{}
+	for _, event := range events {
+		if !isBusy(event) {
+			continue
+		}
+
+		start, end, err := eventTimes(newEventInfo(event), now.Location())
+		if err != nil {
+			continue
+		}
+		meetings = append(meetings, interval{start: start, end: end, summary: event.Summary})
+	}
+
+	sort.Slice(meetings, func(i, j int) bool {
+		return meetings[i].start.Before(meetings[j].start)
+	})
+
+	attachments = append(attachments, &model.SlackAttachment{
+		Title: "Summary",
+		Color: "#7FC1EE",
+		Fields: []*model.SlackAttachmentField{
+			{Title: "Meetings", Value: fmt.Sprintf("%d", len(meetings)), Short: true},
+			{Title: "Meeting time", Value: formatDuration(busyTime(meetings)), Short: true},
+			{Title: "Conflicts", Value: formatConflicts(meetings)},
+			{Title: "Free time", Value: formatFreeTime(meetings, dayStart)},
+		},
+	})
+
+	return attachments
+}
+
+// isBusy returns whether an event takes up the user's time: it has a start and
+// end time, isn't marked as free and hasn't been declined.
+func isBusy(event *Event) bool {
+	return !event.AllDay && !event.Transparent && event.ResponseStatus != "declined"
+}
+
+// busyTime returns the time taken by the meetings, counting overlaps once.
+func busyTime(meetings []interval) time.Duration {
+	var total time.Duration
+	var busyUntil time.Time
+
+	for _, meeting := range meetings {
+		start := meeting.start
+		if start.Before(busyUntil) {
+			start = busyUntil
+		}
+		if meeting.end.After(start) {
+			total += meeting.end.Sub(start)
+			busyUntil = meeting.end
+		}
+	}
+
+	return total
+}
+
+func formatConflicts(meetings []interval) string {
+	conflicts := []string{}
+
+	for i := range meetings {
+		for j := i + 1; j < len(meetings) && meetings[j].start.Before(meetings[i].end); j++ {
+			conflicts = append(conflicts, fmt.Sprintf("- %s overlaps with %s at %s", meetings[i].summary, meetings[j].summary, formatTime(meetings[j].start)))
+		}
+	}
+
+	if len(conflicts) == 0 {
+		return "None"
+	}
+	return strings.Join(conflicts, "\n")
+}
+
+// formatFreeTime lists the gaps of at least minFreeTime between the meetings
+// during the working hours of the day starting at dayStart.
+func formatFreeTime(meetings []interval, dayStart time.Time) string {
+	gaps := []string{}
+	free := time.Date(dayStart.Year(), dayStart.Month(), dayStart.Day(), workdayStart, 0, 0, 0, dayStart.Location())
+	workdayEndTime := time.Date(dayStart.Year(), dayStart.Month(), dayStart.Day(), workdayEnd, 0, 0, 0, dayStart.Location())
+
+	for _, meeting := range append(meetings, interval{start: workdayEndTime, end: workdayEndTime}) {
+		start := meeting.start
+		if start.After(workdayEndTime) {
+			start = workdayEndTime
+		}
+		if start.Sub(free) >= minFreeTime {
+			gaps = append(gaps, fmt.Sprintf("- %s–%s", formatTime(free), formatTime(start)))
+		}
+		if meeting.end.After(free) {
+			free = meeting.end
+		}
+	}
+
+	if len(gaps) == 0 {
+		return "None during working hours"
+	}
+	return strings.Join(gaps, "\n")
+}
+
+// formatDuration formats a duration in hours and minutes, e.g. "2 hours 30 min".
+func formatDuration(d time.Duration) string {
+	if d < time.Minute {
+		return "None"
+	}
+	return formatLeadTime(int(d / time.Minute))
+}
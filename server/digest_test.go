@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/calendar/v3"
+
+	"github.com/waseem18/mattermost-plugin-google-calendar/server/fakegoogle"
+)
+
+func TestCheckDigest(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		digestTime   string
+		skipWeekends bool
+		ticks        []string
+		want         int
+	}{
+		{"posted once at the digest time", "08:00", false, []string{"2026-03-02 07:59", "2026-03-02 08:00", "2026-03-02 08:01", "2026-03-02 17:00"}, 1},
+		{"late tick", "08:00", false, []string{"2026-03-02 07:59", "2026-03-02 09:30"}, 1},
+		{"each day across midnight", "08:00", false, []string{"2026-03-02 08:00", "2026-03-02 23:59", "2026-03-03 00:00", "2026-03-03 08:00"}, 2},
+		{"at midnight", "00:00", false, []string{"2026-03-02 00:00", "2026-03-02 00:01", "2026-03-02 23:59", "2026-03-03 00:00"}, 2},
+		{"on the day clocks spring forward", "08:00", false, []string{"2026-03-07 08:00", "2026-03-08 07:59", "2026-03-08 08:00"}, 2},
+		{"on the day clocks fall back", "08:00", false, []string{"2026-10-31 08:00", "2026-11-01 07:59", "2026-11-01 08:00", "2026-11-01 23:59"}, 2},
+		{"weekends skipped", "08:00", true, []string{"2026-03-06 08:00", "2026-03-07 08:00", "2026-03-08 08:00", "2026-03-09 08:00"}, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			defer e.close()
+			e.timezone = "America/New_York"
+			location, err := time.LoadLocation(e.timezone)
+			require.NoError(t, err)
+
+			e.connected(t, testUserID)
+			require.NoError(t, e.p.storeUserSettings(testUserID, &UserSettings{
+				ReminderLeadTimes:  defaultReminderLeadTimes,
+				AllDayReminderTime: defaultAllDayReminderTime,
+				DigestTime:         tc.digestTime,
+				DigestSkipWeekends: tc.skipWeekends,
+			}))
+
+			for _, tick := range tc.ticks {
+				e.clock.set(mustParseTime(t, tick, location))
+				require.NoError(t, e.p.checkDigest(testUserID))
+			}
+
+			digests := 0
+			for _, post := range e.channelPosts(directChannelID(testUserID)) {
+				if attachments := post.Attachments(); len(attachments) > 0 && attachments[0].Pretext == "Your daily digest" {
+					digests++
+				}
+			}
+			assert.Equal(t, tc.want, digests)
+		})
+	}
+}
+
+func TestDigestCoversSubscribedCalendars(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	e.google.AddCalendar(&calendar.CalendarListEntry{Id: "team@example.com", Summary: "Team", AccessRole: "reader"})
+	e.google.AddCalendar(&calendar.CalendarListEntry{Id: "ops@example.com", Summary: "Ops", AccessRole: "reader"})
+	e.clock.set(time.Date(2026, 3, 2, 7, 0, 0, 0, time.UTC))
+	userInfo := e.connected(t, testUserID)
+	_, err := e.p.addCalendarSubscription(userInfo, "team@example.com", false)
+	require.NoError(t, err)
+	_, err = e.p.addCalendarSubscription(userInfo, "ops@example.com", true)
+	require.NoError(t, err)
+	require.NoError(t, e.p.storeUserSettings(testUserID, &UserSettings{
+		ReminderLeadTimes:  defaultReminderLeadTimes,
+		AllDayReminderTime: defaultAllDayReminderTime,
+		DigestTime:         "08:00",
+	}))
+
+	e.addEvent(t, "team@example.com", "Retro", 3*time.Hour, time.Hour)
+	e.addEvent(t, fakegoogle.PrimaryCalendarID, "Standup", 2*time.Hour, 15*time.Minute)
+	e.addEvent(t, "ops@example.com", "Deploy", 4*time.Hour, time.Hour)
+
+	e.clock.set(e.clock.Now().Add(time.Hour))
+	require.NoError(t, e.p.checkDigest(testUserID))
+
+	posts := e.channelPosts(directChannelID(testUserID))
+	require.NotEmpty(t, posts)
+	attachments := posts[len(posts)-1].Attachments()
+	require.NotEmpty(t, attachments)
+	assert.Equal(t, "Your daily digest", attachments[0].Pretext)
+
+	agenda := attachments[0].Text
+	assert.Contains(t, agenda, "Standup")
+	assert.Contains(t, agenda, "Retro")
+	assert.True(t, strings.Index(agenda, "Standup") < strings.Index(agenda, "Retro"), "events are ordered by their start")
+	assert.Contains(t, agenda, "· Team\n")
+	assert.NotContains(t, agenda, "Deploy", "calendars only synced for channel subscriptions are left out")
+}
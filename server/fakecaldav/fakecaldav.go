@@ -0,0 +1,552 @@
+// Package fakecaldav implements a fake CalDAV server holding the calendars of a
+// single user, covering the parts of WebDAV and CalDAV used by the plugin, so it
+// can be tested without a Nextcloud or Radicale server. The plugin is pointed at
+// the fake with its CalDAVServerURL setting.
+package fakecaldav
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Username and Address are the username and the email address of the fake user.
+	Username = "alice"
+	Address  = "alice@example.com"
+
+	// PrimaryCalendarPath is the path of the first calendar of the user.
+	PrimaryCalendarPath = "/dav/calendars/alice/personal/"
+
+	rootPath      = "/dav/"
+	principalPath = "/dav/principals/alice/"
+	homePath      = "/dav/calendars/alice/"
+
+	icalDateFormat     = "20060102"
+	icalDateTimeFormat = "20060102T150405"
+)
+
+// Server is a fake CalDAV server. It accepts the username of the fake user with
+// its current password, using basic authentication.
+type Server struct {
+	*httptest.Server
+
+	// NoCTag makes the server omit the getctag property of calendars, as some
+	// servers do.
+	NoCTag bool
+
+	lock      sync.Mutex
+	password  string
+	calendars []*fakeCalendar
+	nextETag  int
+	requests  map[string]int
+}
+
+type fakeCalendar struct {
+	path       string
+	name       string
+	components []string
+	ctag       int
+	resources  map[string]*resource
+}
+
+type resource struct {
+	data  string
+	etag  string
+	start time.Time
+	end   time.Time
+}
+
+// Event describes an event added with AddEvent.
+type Event struct {
+	UID      string
+	Summary  string
+	Start    time.Time
+	End      time.Time
+	AllDay   bool
+	Status   string
+	Transp   string
+	Location string
+
+	// Organizer is the address of the organizer, if any. Attendees maps the
+	// addresses of the attendees to their participation status.
+	Organizer string
+	Attendees map[string]string
+}
+
+// New starts a fake CalDAV server accepting the given password, with an empty
+// primary calendar and a task list. Close it at the end of the test.
+func New(password string) *Server {
+	s := &Server{
+		password: password,
+		requests: map[string]int{},
+	}
+	s.AddCalendar(PrimaryCalendarPath, "Personal", "VEVENT")
+	s.AddCalendar(homePath+"tasks/", "Tasks", "VTODO")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/caldav", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, rootPath, http.StatusMovedPermanently)
+	})
+	mux.HandleFunc(rootPath, s.handleDAV)
+	s.Server = httptest.NewServer(mux)
+
+	return s
+}
+
+// AddCalendar adds a calendar to the calendar home of the user, supporting the
+// given components, e.g. VEVENT.
+func (s *Server) AddCalendar(path, name string, components ...string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.calendars = append(s.calendars, &fakeCalendar{
+		path:       path,
+		name:       name,
+		components: components,
+		resources:  map[string]*resource{},
+	})
+}
+
+// SetPassword changes the password of the user, e.g. to revoke an app password.
+func (s *Server) SetPassword(password string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.password = password
+}
+
+// Requests returns the number of requests received with the given method.
+func (s *Server) Requests(method string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.requests[method]
+}
+
+// AddEvent stores an event in a calendar, replacing the event with the same UID,
+// and returns the path of its resource.
+func (s *Server) AddEvent(calendarPath string, event Event) (string, error) {
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//fakecaldav//EN",
+		"BEGIN:VEVENT",
+		"UID:" + event.UID,
+		"SUMMARY:" + event.Summary,
+	}
+	if event.AllDay {
+		lines = append(lines,
+			"DTSTART;VALUE=DATE:"+event.Start.Format(icalDateFormat),
+			"DTEND;VALUE=DATE:"+event.End.Format(icalDateFormat))
+	} else {
+		lines = append(lines,
+			"DTSTART:"+event.Start.UTC().Format(icalDateTimeFormat)+"Z",
+			"DTEND:"+event.End.UTC().Format(icalDateTimeFormat)+"Z")
+	}
+	if event.Status != "" {
+		lines = append(lines, "STATUS:"+event.Status)
+	}
+	if event.Transp != "" {
+		lines = append(lines, "TRANSP:"+event.Transp)
+	}
+	if event.Location != "" {
+		lines = append(lines, "LOCATION:"+event.Location)
+	}
+	if event.Organizer != "" {
+		lines = append(lines, "ORGANIZER:mailto:"+event.Organizer)
+	}
+
+	addresses := []string{}
+	for address := range event.Attendees {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	for _, address := range addresses {
+		lines = append(lines, fmt.Sprintf("ATTENDEE;PARTSTAT=%s:mailto:%s", event.Attendees[address], address))
+	}
+	lines = append(lines, "END:VEVENT", "END:VCALENDAR", "")
+
+	path := calendarPath + event.UID + ".ics"
+	return path, s.PutResource(path, strings.Join(lines, "\r\n"))
+}
+
+// PutResource stores an iCalendar object at the given path, in one of the calendars.
+func (s *Server) PutResource(path, data string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_, err := s.putResource(path, data)
+	return err
+}
+
+func (s *Server) putResource(path, data string) (*resource, error) {
+	c, name := s.resourceCalendar(path)
+	if c == nil {
+		return nil, fmt.Errorf("no calendar holds %s", path)
+	}
+
+	start, end, err := eventTimes(data)
+	if err != nil {
+		return nil, err
+	}
+
+	s.nextETag++
+	r := &resource{data: data, etag: strconv.Quote(strconv.Itoa(s.nextETag)), start: start, end: end}
+	c.resources[name] = r
+	c.ctag++
+	return r, nil
+}
+
+// DeleteResource deletes the resource at the given path.
+func (s *Server) DeleteResource(path string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if c, name := s.resourceCalendar(path); c != nil && c.resources[name] != nil {
+		delete(c.resources, name)
+		c.ctag++
+	}
+}
+
+// Resource returns the iCalendar object stored at the given path, or an empty string.
+func (s *Server) Resource(path string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if c, name := s.resourceCalendar(path); c != nil && c.resources[name] != nil {
+		return c.resources[name].data
+	}
+	return ""
+}
+
+// Resources returns the paths of the resources of a calendar.
+func (s *Server) Resources(calendarPath string) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	paths := []string{}
+	if c := s.calendar(calendarPath); c != nil {
+		for name := range c.resources {
+			paths = append(paths, c.path+name)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func (s *Server) calendar(path string) *fakeCalendar {
+	for _, c := range s.calendars {
+		if c.path == path {
+			return c
+		}
+	}
+	return nil
+}
+
+// resourceCalendar returns the calendar holding the resource at the given path,
+// along with the name of the resource in it.
+func (s *Server) resourceCalendar(path string) (*fakeCalendar, string) {
+	index := strings.LastIndex(path, "/")
+	if c := s.calendar(path[:index+1]); c != nil && index < len(path)-1 {
+		return c, path[index+1:]
+	}
+	return nil, ""
+}
+
+func (s *Server) handleDAV(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.requests[r.Method]++
+
+	if username, password, ok := r.BasicAuth(); !ok || username != Username || password != s.password {
+		w.Header().Set("WWW-Authenticate", `Basic realm="fakecaldav"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case "PROPFIND":
+		s.handlePropfind(w, r)
+	case "REPORT":
+		s.handleReport(w, r)
+	case http.MethodGet:
+		c, name := s.resourceCalendar(r.URL.Path)
+		if c == nil || c.resources[name] == nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+		w.Header().Set("ETag", c.resources[name].etag)
+		fmt.Fprint(w, c.resources[name].data)
+	case http.MethodPut:
+		s.handlePut(w, r)
+	case http.MethodDelete:
+		c, name := s.resourceCalendar(r.URL.Path)
+		if c == nil || c.resources[name] == nil {
+			http.NotFound(w, r)
+			return
+		}
+		delete(c.resources, name)
+		c.ctag++
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handlePropfind(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	responses := []string{}
+
+	switch {
+	case path == rootPath:
+		responses = append(responses, propResponse(path, "<d:resourcetype><d:collection/></d:resourcetype>"+
+			"<d:current-user-principal><d:href>"+principalPath+"</d:href></d:current-user-principal>"))
+	case path == principalPath:
+		responses = append(responses, propResponse(path, "<d:resourcetype><d:principal/></d:resourcetype>"+
+			"<c:calendar-home-set><d:href>"+homePath+"</d:href></c:calendar-home-set>"+
+			"<c:calendar-user-address-set><d:href>mailto:"+Address+"</d:href><d:href>"+principalPath+"</d:href></c:calendar-user-address-set>"))
+	case path == homePath:
+		responses = append(responses, propResponse(path, "<d:resourcetype><d:collection/></d:resourcetype>"))
+		if r.Header.Get("Depth") == "1" {
+			for _, c := range s.calendars {
+				responses = append(responses, s.calendarResponse(c))
+			}
+		}
+	case s.calendar(path) != nil:
+		responses = append(responses, s.calendarResponse(s.calendar(path)))
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	writeMultistatus(w, responses)
+}
+
+func (s *Server) calendarResponse(c *fakeCalendar) string {
+	props := "<d:resourcetype><d:collection/><c:calendar/></d:resourcetype><d:displayname>" + escape(c.name) + "</d:displayname>"
+	props += "<c:supported-calendar-component-set>"
+	for _, component := range c.components {
+		props += `<c:comp name="` + component + `"/>`
+	}
+	props += "</c:supported-calendar-component-set>"
+	if !s.NoCTag {
+		props += "<cs:getctag>" + strconv.Itoa(c.ctag) + "</cs:getctag>"
+	}
+	return propResponse(c.path, props)
+}
+
+// reportRequest captures what the fake reads from calendar-query and
+// calendar-multiget requests.
+type reportRequest struct {
+	name         string
+	calendarData bool
+	start        time.Time
+	end          time.Time
+	hrefs        []string
+}
+
+func parseReportRequest(r *http.Request) (*reportRequest, error) {
+	request := &reportRequest{}
+	decoder := xml.NewDecoder(r.Body)
+	inHref := false
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+
+		switch token := token.(type) {
+		case xml.StartElement:
+			if request.name == "" {
+				request.name = token.Name.Local
+			}
+			switch token.Name.Local {
+			case "calendar-data":
+				request.calendarData = true
+			case "href":
+				inHref = true
+			case "time-range":
+				for _, attr := range token.Attr {
+					t, err := time.Parse(icalDateTimeFormat+"Z", attr.Value)
+					if err != nil {
+						return nil, err
+					}
+					if attr.Name.Local == "start" {
+						request.start = t
+					} else if attr.Name.Local == "end" {
+						request.end = t
+					}
+				}
+			}
+		case xml.EndElement:
+			inHref = false
+		case xml.CharData:
+			if inHref {
+				request.hrefs = append(request.hrefs, strings.TrimSpace(string(token)))
+			}
+		}
+	}
+	return request, nil
+}
+
+func (s *Server) handleReport(w http.ResponseWriter, r *http.Request) {
+	c := s.calendar(r.URL.Path)
+	if c == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	request, err := parseReportRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	responses := []string{}
+	switch request.name {
+	case "calendar-query":
+		names := []string{}
+		for name := range c.resources {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			res := c.resources[name]
+			if !request.start.IsZero() && !res.end.After(request.start) {
+				continue
+			}
+			if !request.end.IsZero() && !res.start.Before(request.end) {
+				continue
+			}
+			responses = append(responses, resourceResponse(c.path+name, res, request.calendarData))
+		}
+	case "calendar-multiget":
+		for _, href := range request.hrefs {
+			if cal, name := s.resourceCalendar(href); cal == c && c.resources[name] != nil {
+				responses = append(responses, resourceResponse(href, c.resources[name], request.calendarData))
+			} else {
+				responses = append(responses, "<d:response><d:href>"+escape(href)+"</d:href><d:status>HTTP/1.1 404 Not Found</d:status></d:response>")
+			}
+		}
+	default:
+		http.Error(w, "unsupported report", http.StatusBadRequest)
+		return
+	}
+
+	writeMultistatus(w, responses)
+}
+
+func (s *Server) handlePut(w http.ResponseWriter, r *http.Request) {
+	c, name := s.resourceCalendar(r.URL.Path)
+	if c == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	existing := c.resources[name]
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && (existing == nil || existing.etag != ifMatch) {
+		http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+		return
+	}
+	if r.Header.Get("If-None-Match") == "*" && existing != nil {
+		http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+		return
+	}
+
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	stored, err := s.putResource(r.URL.Path, string(data))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("ETag", stored.etag)
+	if existing == nil {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func propResponse(href, props string) string {
+	return "<d:response><d:href>" + escape(href) + "</d:href><d:propstat><d:prop>" + props +
+		"</d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>"
+}
+
+func resourceResponse(href string, r *resource, withData bool) string {
+	props := "<d:getetag>" + escape(r.etag) + "</d:getetag>"
+	if withData {
+		props += "<c:calendar-data>" + escape(r.data) + "</c:calendar-data>"
+	}
+	return propResponse(href, props)
+}
+
+func writeMultistatus(w http.ResponseWriter, responses []string) {
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	fmt.Fprint(w, `<?xml version="1.0" encoding="utf-8"?>`+
+		`<d:multistatus xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:caldav" xmlns:cs="http://calendarserver.org/ns/">`+
+		strings.Join(responses, "")+"</d:multistatus>")
+}
+
+func escape(value string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(value))
+	return b.String()
+}
+
+// eventTimes returns the start and end of the first event of an iCalendar
+// object. Only UTC times and dates are supported.
+func eventTimes(data string) (time.Time, time.Time, error) {
+	var start, end time.Time
+	for _, line := range strings.Split(strings.Replace(data, "\r\n", "\n", -1), "\n") {
+		index := strings.Index(line, ":")
+		if index < 0 {
+			continue
+		}
+		name := strings.SplitN(line[:index], ";", 2)[0]
+		if name != "DTSTART" && name != "DTEND" {
+			continue
+		}
+
+		value := line[index+1:]
+		layout := icalDateTimeFormat + "Z"
+		if len(value) == len(icalDateFormat) {
+			layout = icalDateFormat
+		}
+		t, err := time.Parse(layout, value)
+		if err != nil {
+			return start, end, err
+		}
+
+		if name == "DTSTART" && start.IsZero() {
+			start = t
+		} else if name == "DTEND" && end.IsZero() {
+			end = t
+		}
+	}
+
+	if start.IsZero() {
+		return start, end, fmt.Errorf("the event has no start")
+	}
+	if end.IsZero() {
+		end = start
+	}
+	return start, end, nil
+}
@@ -0,0 +1,807 @@
+// Package fakegoogle implements a fake of the parts of the Google Calendar API and
+// of the Google OAuth endpoints used by the plugin, so it can be tested without
+// network access. The plugin is pointed at the fake with its GoogleCalendarAPIURL
+// and GoogleOAuthURL settings.
+package fakegoogle
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/calendar/v3"
+)
+
+const (
+	// PrimaryCalendarID is the ID of the primary calendar of the fake user.
+	PrimaryCalendarID = "user@example.com"
+
+	// DefaultPageSize is the number of events returned per page by Events.List.
+	DefaultPageSize = 250
+
+	tokenLifetime   = time.Hour
+	channelLifetime = 7 * 24 * time.Hour
+)
+
+// Server is a fake Google server holding the calendars of a single user. All the
+// tokens it issues grant access to these calendars.
+type Server struct {
+	*httptest.Server
+
+	// PageSize is the number of events returned per page by Events.List.
+	PageSize int
+
+	// DenyConsent makes the authorization endpoint redirect back with the
+	// access_denied error, as if the user denied access.
+	DenyConsent bool
+
+	lock         sync.Mutex
+	clientID     string
+	clientSecret string
+
+	codes         map[string]bool
+	accessTokens  map[string]bool
+	refreshTokens map[string]bool
+	revoked       []string
+	nextID        int
+
+	// rateLimited is the number of upcoming requests to the Calendar API that
+	// fail because of the rate limit, see RateLimit.
+	rateLimited int
+
+	calendars []*fakeCalendar
+	channels  map[string]*watchChannel
+
+	// version is incremented by every change to an event. Sync tokens are the
+	// version at the time of the sync, and tokens older than minSyncVersion
+	// have expired.
+	version        int
+	minSyncVersion int
+}
+
+type fakeCalendar struct {
+	entry  calendar.CalendarListEntry
+	events []*fakeEvent
+
+	// pushNotSupported makes watching the calendar fail, see DisablePush.
+	pushNotSupported bool
+}
+
+type fakeEvent struct {
+	event   calendar.Event
+	version int
+}
+
+type watchChannel struct {
+	channel    calendar.Channel
+	calendarID string
+	messages   int
+}
+
+// New starts a fake Google server accepting the given OAuth client, with an empty
+// primary calendar. Close it at the end of the test.
+func New(clientID, clientSecret string) *Server {
+	s := &Server{
+		PageSize:      DefaultPageSize,
+		clientID:      clientID,
+		clientSecret:  clientSecret,
+		codes:         map[string]bool{},
+		accessTokens:  map[string]bool{},
+		refreshTokens: map[string]bool{},
+		channels:      map[string]*watchChannel{},
+	}
+	s.AddCalendar(&calendar.CalendarListEntry{
+		Id:         PrimaryCalendarID,
+		Summary:    PrimaryCalendarID,
+		Primary:    true,
+		AccessRole: "owner",
+	})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth", s.handleAuth)
+	mux.HandleFunc("/token", s.handleToken)
+	mux.HandleFunc("/revoke", s.handleRevoke)
+	mux.HandleFunc("/calendar/v3/", s.handleCalendarAPI)
+	s.Server = httptest.NewServer(mux)
+
+	return s
+}
+
+// CalendarAPIURL returns the value of the GoogleCalendarAPIURL setting pointing the plugin at the fake.
+func (s *Server) CalendarAPIURL() string {
+	return s.URL + "/calendar/v3/"
+}
+
+// OAuthURL returns the value of the GoogleOAuthURL setting pointing the plugin at the fake.
+func (s *Server) OAuthURL() string {
+	return s.URL
+}
+
+// AddCalendar adds a calendar to the calendar list of the user.
+func (s *Server) AddCalendar(entry *calendar.CalendarListEntry) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.calendars = append(s.calendars, &fakeCalendar{entry: *entry})
+}
+
+// DisablePush makes watching a calendar fail the way Google does for calendars
+// that don't support push notifications, such as holiday calendars.
+func (s *Server) DisablePush(calendarID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if c := s.getCalendar(calendarID); c != nil {
+		c.pushNotSupported = true
+	}
+}
+
+// AddEvent adds an event to a calendar, or replaces the event with the same ID,
+// and returns it as stored. The ID, status and link are set if empty.
+func (s *Server) AddEvent(calendarID string, event *calendar.Event) (*calendar.Event, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c := s.getCalendar(calendarID)
+	if c == nil {
+		return nil, fmt.Errorf("unknown calendar %s", calendarID)
+	}
+
+	stored := s.putEvent(c, *event)
+	return &stored, nil
+}
+
+// CancelEvent cancels an event, as if it was deleted.
+func (s *Server) CancelEvent(calendarID, eventID string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c := s.getCalendar(calendarID)
+	if c == nil {
+		return fmt.Errorf("unknown calendar %s", calendarID)
+	}
+
+	for _, e := range c.events {
+		if e.event.Id == eventID {
+			e.event.Status = "cancelled"
+			s.version++
+			e.version = s.version
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown event %s", eventID)
+}
+
+// Events returns the events of a calendar, including the cancelled ones.
+func (s *Server) Events(calendarID string) []*calendar.Event {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	events := []*calendar.Event{}
+	if c := s.getCalendar(calendarID); c != nil {
+		for _, e := range c.events {
+			event := e.event
+			events = append(events, &event)
+		}
+	}
+	return events
+}
+
+// Channels returns the active watch channels.
+func (s *Server) Channels() []*calendar.Channel {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	channels := []*calendar.Channel{}
+	for _, c := range s.channels {
+		channel := c.channel
+		channels = append(channels, &channel)
+	}
+	sort.Slice(channels, func(i, j int) bool { return channels[i].Id < channels[j].Id })
+	return channels
+}
+
+// Notify sends a change notification to the watch channels of a calendar, the way
+// Google does when one of its events changes.
+func (s *Server) Notify(calendarID string) error {
+	s.lock.Lock()
+	c := s.getCalendar(calendarID)
+	requests := []*http.Request{}
+	for _, channel := range s.channels {
+		if c == nil || channel.calendarID != c.entry.Id {
+			continue
+		}
+		channel.messages++
+
+		request, err := http.NewRequest(http.MethodPost, channel.channel.Address, nil)
+		if err != nil {
+			s.lock.Unlock()
+			return err
+		}
+		request.Header.Set("X-Goog-Channel-ID", channel.channel.Id)
+		request.Header.Set("X-Goog-Channel-Token", channel.channel.Token)
+		request.Header.Set("X-Goog-Channel-Expiration", time.Unix(0, channel.channel.Expiration*int64(time.Millisecond)).UTC().Format(http.TimeFormat))
+		request.Header.Set("X-Goog-Resource-ID", channel.channel.ResourceId)
+		request.Header.Set("X-Goog-Resource-URI", channel.channel.ResourceUri)
+		request.Header.Set("X-Goog-Resource-State", "exists")
+		request.Header.Set("X-Goog-Message-Number", strconv.Itoa(channel.messages))
+		requests = append(requests, request)
+	}
+	s.lock.Unlock()
+
+	// The lock isn't held while notifying, as the plugin calls the fake back.
+	for _, request := range requests {
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("notification to %s failed with status %d", request.URL, resp.StatusCode)
+		}
+	}
+	return nil
+}
+
+// ExpireSyncTokens makes the sync tokens issued so far invalid, so the next
+// incremental sync fails with 410 Gone.
+func (s *Server) ExpireSyncTokens() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.version++
+	s.minSyncVersion = s.version
+}
+
+// RevokeAccess revokes all the tokens issued so far, as if the user removed the
+// access of the plugin from their Google account.
+func (s *Server) RevokeAccess() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.accessTokens = map[string]bool{}
+	s.refreshTokens = map[string]bool{}
+}
+
+// RateLimit makes the next n requests to the Calendar API fail with the
+// userRateLimitExceeded error.
+func (s *Server) RateLimit(n int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.rateLimited = n
+}
+
+// Revoked returns the tokens revoked through the revoke endpoint.
+func (s *Server) Revoked() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return append([]string{}, s.revoked...)
+}
+
+func (s *Server) newID(prefix string) string {
+	s.nextID++
+	return fmt.Sprintf("%s%d", prefix, s.nextID)
+}
+
+// getCalendar returns the calendar with the given ID, resolving the primary alias.
+func (s *Server) getCalendar(calendarID string) *fakeCalendar {
+	for _, c := range s.calendars {
+		if c.entry.Id == calendarID || (calendarID == "primary" && c.entry.Primary) {
+			return c
+		}
+	}
+	return nil
+}
+
+// putEvent stores an event in a calendar, replacing the event with the same ID.
+func (s *Server) putEvent(c *fakeCalendar, event calendar.Event) calendar.Event {
+	if event.Id == "" {
+		event.Id = s.newID("event")
+	}
+	if event.Status == "" {
+		event.Status = "confirmed"
+	}
+	if event.HtmlLink == "" {
+		event.HtmlLink = s.URL + "/event?eid=" + event.Id
+	}
+	event.Updated = time.Now().UTC().Format(time.RFC3339)
+
+	s.version++
+	for _, e := range c.events {
+		if e.event.Id == event.Id {
+			e.event = event
+			e.version = s.version
+			return event
+		}
+	}
+	c.events = append(c.events, &fakeEvent{event: event, version: s.version})
+	return event
+}
+
+// handleAuth approves the authorization request right away, redirecting back to
+// the application with a code, unless DenyConsent is set.
+func (s *Server) handleAuth(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("client_id") != s.clientID {
+		http.Error(w, "invalid_client", http.StatusBadRequest)
+		return
+	}
+
+	redirectURL, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil || query.Get("redirect_uri") == "" {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	values := redirectURL.Query()
+	values.Set("state", query.Get("state"))
+
+	s.lock.Lock()
+	if s.DenyConsent {
+		values.Set("error", "access_denied")
+	} else {
+		code := s.newID("code")
+		s.codes[code] = true
+		values.Set("code", code)
+	}
+	s.lock.Unlock()
+
+	redirectURL.RawQuery = values.Encode()
+	http.Redirect(w, r, redirectURL.String(), http.StatusFound)
+}
+
+// handleToken exchanges authorization codes and refresh tokens for access tokens.
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request")
+		return
+	}
+
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientID != s.clientID || clientSecret != s.clientSecret {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	response := map[string]interface{}{
+		"token_type": "Bearer",
+		"expires_in": int(tokenLifetime / time.Second),
+	}
+
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		code := r.PostForm.Get("code")
+		if !s.codes[code] {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+		delete(s.codes, code)
+
+		refreshToken := s.newID("refresh")
+		s.refreshTokens[refreshToken] = true
+		response["refresh_token"] = refreshToken
+	case "refresh_token":
+		if !s.refreshTokens[r.PostForm.Get("refresh_token")] {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+	default:
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+
+	accessToken := s.newID("access")
+	s.accessTokens[accessToken] = true
+	response["access_token"] = accessToken
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// handleRevoke revokes an access or refresh token.
+func (s *Server) handleRevoke(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.accessTokens[token] && !s.refreshTokens[token] {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_token")
+		return
+	}
+	delete(s.accessTokens, token)
+	delete(s.refreshTokens, token)
+	s.revoked = append(s.revoked, token)
+}
+
+// handleCalendarAPI routes the requests to the Calendar API, after checking their access token.
+func (s *Server) handleCalendarAPI(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.accessTokens[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")] {
+		writeAPIError(w, http.StatusUnauthorized, "Invalid Credentials")
+		return
+	}
+
+	if s.rateLimited > 0 {
+		s.rateLimited--
+		writeAPIErrorReason(w, http.StatusForbidden, "userRateLimitExceeded", "User Rate Limit Exceeded")
+		return
+	}
+
+	segments := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/calendar/v3/"), "/")
+	for index, segment := range segments {
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "Invalid path")
+			return
+		}
+		segments[index] = unescaped
+	}
+
+	switch {
+	case r.Method == http.MethodGet && len(segments) == 3 && segments[0] == "users" && segments[1] == "me" && segments[2] == "calendarList":
+		s.listCalendars(w)
+	case r.Method == http.MethodGet && len(segments) == 4 && segments[0] == "users" && segments[1] == "me" && segments[2] == "calendarList":
+		s.getCalendarListEntry(w, segments[3])
+	case r.Method == http.MethodGet && len(segments) == 3 && segments[0] == "calendars" && segments[2] == "events":
+		s.listEvents(w, r, segments[1])
+	case r.Method == http.MethodPost && len(segments) == 3 && segments[0] == "calendars" && segments[2] == "events":
+		s.insertEvent(w, r, segments[1])
+	case r.Method == http.MethodGet && len(segments) == 4 && segments[0] == "calendars" && segments[2] == "events":
+		s.getEvent(w, segments[1], segments[3])
+	case r.Method == http.MethodPatch && len(segments) == 4 && segments[0] == "calendars" && segments[2] == "events":
+		s.patchEvent(w, r, segments[1], segments[3])
+	case r.Method == http.MethodPost && len(segments) == 4 && segments[0] == "calendars" && segments[2] == "events" && segments[3] == "watch":
+		s.watchEvents(w, r, segments[1])
+	case r.Method == http.MethodPost && len(segments) == 1 && segments[0] == "freeBusy":
+		s.queryFreeBusy(w, r)
+	case r.Method == http.MethodPost && len(segments) == 2 && segments[0] == "channels" && segments[1] == "stop":
+		s.stopChannel(w, r)
+	default:
+		writeAPIError(w, http.StatusNotFound, "Not Found")
+	}
+}
+
+func (s *Server) listCalendars(w http.ResponseWriter) {
+	list := &calendar.CalendarList{Kind: "calendar#calendarList"}
+	for _, c := range s.calendars {
+		entry := c.entry
+		list.Items = append(list.Items, &entry)
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *Server) getCalendarListEntry(w http.ResponseWriter, calendarID string) {
+	c := s.getCalendar(calendarID)
+	if c == nil {
+		writeAPIError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	writeJSON(w, http.StatusOK, c.entry)
+}
+
+// listEvents lists the events of a calendar. With a sync token, the events changed
+// since the sync are listed, including the cancelled ones. Otherwise the events
+// that end after timeMin and start before timeMax are listed, without the
+// cancelled ones.
+func (s *Server) listEvents(w http.ResponseWriter, r *http.Request, calendarID string) {
+	c := s.getCalendar(calendarID)
+	if c == nil {
+		writeAPIError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	query := r.URL.Query()
+	syncToken := query.Get("syncToken")
+	if syncToken != "" && (query.Get("timeMin") != "" || query.Get("timeMax") != "") {
+		writeAPIError(w, http.StatusBadRequest, "The syncToken can't be combined with timeMin or timeMax")
+		return
+	}
+
+	var timeMin, timeMax time.Time
+	if value := query.Get("timeMin"); value != "" {
+		var err error
+		if timeMin, err = time.Parse(time.RFC3339, value); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "Invalid timeMin")
+			return
+		}
+	}
+	if value := query.Get("timeMax"); value != "" {
+		var err error
+		if timeMax, err = time.Parse(time.RFC3339, value); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "Invalid timeMax")
+			return
+		}
+	}
+
+	sinceVersion := -1
+	if syncToken != "" {
+		version, err := strconv.Atoi(strings.TrimPrefix(syncToken, "sync"))
+		if err != nil || version < s.minSyncVersion {
+			writeAPIError(w, http.StatusGone, "Sync token is no longer valid, a full sync is required.")
+			return
+		}
+		sinceVersion = version
+	}
+
+	events := []*calendar.Event{}
+	for _, e := range c.events {
+		if syncToken != "" {
+			if e.version <= sinceVersion {
+				continue
+			}
+		} else if e.event.Status == "cancelled" ||
+			(!timeMin.IsZero() && !eventTime(e.event.End).After(timeMin)) ||
+			(!timeMax.IsZero() && !eventTime(e.event.Start).Before(timeMax)) {
+			continue
+		}
+		event := e.event
+		events = append(events, &event)
+	}
+
+	if query.Get("orderBy") == "startTime" {
+		sort.SliceStable(events, func(i, j int) bool {
+			return eventTime(events[i].Start).Before(eventTime(events[j].Start))
+		})
+	}
+
+	offset := 0
+	if pageToken := query.Get("pageToken"); pageToken != "" {
+		var err error
+		if offset, err = strconv.Atoi(strings.TrimPrefix(pageToken, "page")); err != nil || offset > len(events) {
+			writeAPIError(w, http.StatusBadRequest, "Invalid pageToken")
+			return
+		}
+	}
+
+	list := &calendar.Events{Kind: "calendar#events", Summary: c.entry.Summary}
+	end := offset + s.PageSize
+	if end < len(events) {
+		list.Items = events[offset:end]
+		list.NextPageToken = fmt.Sprintf("page%d", end)
+	} else {
+		list.Items = events[offset:]
+		list.NextSyncToken = fmt.Sprintf("sync%d", s.version)
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// findEvent returns the event with the given ID of a calendar, or nil if there is none.
+func (s *Server) findEvent(calendarID, eventID string) (*fakeCalendar, *fakeEvent) {
+	c := s.getCalendar(calendarID)
+	if c == nil {
+		return nil, nil
+	}
+	for _, e := range c.events {
+		if e.event.Id == eventID {
+			return c, e
+		}
+	}
+	return c, nil
+}
+
+func (s *Server) getEvent(w http.ResponseWriter, calendarID, eventID string) {
+	_, e := s.findEvent(calendarID, eventID)
+	if e == nil {
+		writeAPIError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	writeJSON(w, http.StatusOK, e.event)
+}
+
+// patchEvent updates the attendees of an event, which is the only change the
+// plugin makes to existing events.
+func (s *Server) patchEvent(w http.ResponseWriter, r *http.Request, calendarID, eventID string) {
+	c, e := s.findEvent(calendarID, eventID)
+	if e == nil {
+		writeAPIError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	var patch calendar.Event
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Invalid event")
+		return
+	}
+
+	event := e.event
+	if patch.Attendees != nil {
+		event.Attendees = patch.Attendees
+	}
+	stored := s.putEvent(c, event)
+	writeJSON(w, http.StatusOK, stored)
+}
+
+// insertEvent creates an event, adding a Meet link if a conference is requested.
+func (s *Server) insertEvent(w http.ResponseWriter, r *http.Request, calendarID string) {
+	c := s.getCalendar(calendarID)
+	if c == nil {
+		writeAPIError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	var event calendar.Event
+	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Invalid event")
+		return
+	}
+	if event.Start == nil || event.End == nil {
+		writeAPIError(w, http.StatusBadRequest, "Missing start or end time")
+		return
+	}
+
+	event.Id = ""
+	event.Organizer = &calendar.EventOrganizer{Email: c.entry.Id, Self: true}
+	if event.ConferenceData != nil && event.ConferenceData.CreateRequest != nil && r.URL.Query().Get("conferenceDataVersion") == "1" {
+		event.HangoutLink = "https://meet.google.com/" + s.newID("meet")
+		event.ConferenceData = &calendar.ConferenceData{
+			ConferenceId: s.newID("conference"),
+			EntryPoints: []*calendar.EntryPoint{
+				{EntryPointType: "video", Uri: event.HangoutLink},
+			},
+		}
+	}
+
+	stored := s.putEvent(c, event)
+	writeJSON(w, http.StatusOK, stored)
+}
+
+// queryFreeBusy returns the periods between timeMin and timeMax when the
+// requested calendars have events that aren't cancelled or marked as free.
+func (s *Server) queryFreeBusy(w http.ResponseWriter, r *http.Request) {
+	var request calendar.FreeBusyRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+	timeMin, err := time.Parse(time.RFC3339, request.TimeMin)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Invalid timeMin")
+		return
+	}
+	timeMax, err := time.Parse(time.RFC3339, request.TimeMax)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Invalid timeMax")
+		return
+	}
+
+	response := &calendar.FreeBusyResponse{
+		Kind:      "calendar#freeBusy",
+		TimeMin:   request.TimeMin,
+		TimeMax:   request.TimeMax,
+		Calendars: map[string]calendar.FreeBusyCalendar{},
+	}
+	for _, item := range request.Items {
+		c := s.getCalendar(item.Id)
+		if c == nil {
+			response.Calendars[item.Id] = calendar.FreeBusyCalendar{Errors: []*calendar.Error{{Domain: "global", Reason: "notFound"}}}
+			continue
+		}
+
+		busy := []*calendar.TimePeriod{}
+		for _, e := range c.events {
+			start, end := eventTime(e.event.Start), eventTime(e.event.End)
+			if e.event.Status == "cancelled" || e.event.Transparency == "transparent" || !end.After(timeMin) || !start.Before(timeMax) {
+				continue
+			}
+			busy = append(busy, &calendar.TimePeriod{Start: start.Format(time.RFC3339), End: end.Format(time.RFC3339)})
+		}
+		response.Calendars[item.Id] = calendar.FreeBusyCalendar{Busy: busy}
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// watchEvents creates a channel notifying the given address of changes to the
+// events of a calendar. Notifications are only sent by Notify.
+func (s *Server) watchEvents(w http.ResponseWriter, r *http.Request, calendarID string) {
+	c := s.getCalendar(calendarID)
+	if c == nil {
+		writeAPIError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	if c.pushNotSupported {
+		writeAPIErrorReason(w, http.StatusBadRequest, "pushNotSupportedForRequestedResource", "Push notifications are not supported by this resource.")
+		return
+	}
+
+	var channel calendar.Channel
+	if err := json.NewDecoder(r.Body).Decode(&channel); err != nil || channel.Id == "" || channel.Address == "" || channel.Type != "web_hook" {
+		writeAPIError(w, http.StatusBadRequest, "Invalid channel")
+		return
+	}
+	if _, ok := s.channels[channel.Id]; ok {
+		writeAPIError(w, http.StatusBadRequest, "Channel id not unique")
+		return
+	}
+
+	channel.Kind = "api#channel"
+	channel.ResourceId = "resource-" + c.entry.Id
+	channel.ResourceUri = s.CalendarAPIURL() + "calendars/" + url.PathEscape(c.entry.Id) + "/events"
+	channel.Expiration = time.Now().Add(channelLifetime).UnixNano() / int64(time.Millisecond)
+	s.channels[channel.Id] = &watchChannel{channel: channel, calendarID: c.entry.Id}
+
+	response := channel
+	response.Address = ""
+	response.Type = ""
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *Server) stopChannel(w http.ResponseWriter, r *http.Request) {
+	var channel calendar.Channel
+	if err := json.NewDecoder(r.Body).Decode(&channel); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Invalid channel")
+		return
+	}
+
+	stored, ok := s.channels[channel.Id]
+	if !ok || stored.channel.ResourceId != channel.ResourceId {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("Channel '%s' not found for project", channel.Id))
+		return
+	}
+	delete(s.channels, channel.Id)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// eventTime returns the instant of the start or end of an event. The dates of
+// all-day events are taken in UTC.
+func eventTime(t *calendar.EventDateTime) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+
+	if t.DateTime != "" {
+		instant, _ := time.Parse(time.RFC3339, t.DateTime)
+		return instant
+	}
+
+	date, _ := time.Parse("2006-01-02", t.Date)
+	return date
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeAPIError writes an error in the format of the Google APIs, which the
+// client library decodes into a googleapi.Error.
+func writeAPIError(w http.ResponseWriter, code int, message string) {
+	writeAPIErrorReason(w, code, "", message)
+}
+
+// writeAPIErrorReason writes an error of the Google APIs with a reason, such as
+// rateLimitExceeded.
+func writeAPIErrorReason(w http.ResponseWriter, code int, reason, message string) {
+	writeJSON(w, code, map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    code,
+			"message": message,
+			"errors": []map[string]string{
+				{"domain": "global", "reason": reason, "message": message},
+			},
+		},
+	})
+}
+
+// writeOAuthError writes an error of the OAuth endpoints.
+func writeOAuthError(w http.ResponseWriter, status int, code string) {
+	writeJSON(w, status, map[string]string{"error": code})
+}
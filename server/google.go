@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/mlog"
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/calendar/v3"
+	"google.golang.org/api/googleapi"
+)
+
+// googleProvider gives access to the calendars of a user on Google Calendar.
+type googleProvider struct {
+	service *calendar.Service
+}
+
+// newGoogleProvider returns the Google Calendar provider of the user, refreshing
+// and storing their access token if it has expired.
+func (p *Plugin) newGoogleProvider(u *UserInfo) (*googleProvider, error) {
+	googleOauthConfig := p.getOAuthConfig()
+	tokenSource := googleOauthConfig.TokenSource(context.TODO(), u.Token)
+	newToken, err := tokenSource.Token()
+	if err != nil {
+		mlog.Error("Error fetching token from token source" + err.Error())
+		return nil, googleError(err)
+	}
+
+	if newToken.AccessToken != u.Token.AccessToken {
+		u.Token = newToken
+		err := p.storeUserInfo(u)
+		if err != nil {
+			mlog.Error("Error storing the new access token " + err.Error())
+			return nil, err
+		}
+	}
+
+	client := oauth2.NewClient(context.TODO(), tokenSource)
+	calendarService, err := calendar.New(client)
+	if err != nil {
+		return nil, err
+	}
+	if baseURL := p.getConfiguration().GoogleCalendarAPIURL; baseURL != "" {
+		calendarService.BasePath = strings.TrimSuffix(baseURL, "/") + "/"
+	}
+	return &googleProvider{service: calendarService}, nil
+}
+
+func (g *googleProvider) ListCalendars() ([]*Calendar, error) {
+	calendarList, err := g.service.CalendarList.List().Do()
+	if err != nil {
+		return nil, googleError(err)
+	}
+
+	calendars := []*Calendar{}
+	for _, entry := range calendarList.Items {
+		calendars = append(calendars, &Calendar{ID: entry.Id, Summary: entry.Summary, Primary: entry.Primary})
+	}
+	return calendars, nil
+}
+
+func (g *googleProvider) GetCalendar(calendarID string) (*Calendar, error) {
+	entry, err := g.service.CalendarList.Get(calendarID).Do()
+	if err == nil {
+		return &Calendar{ID: entry.Id, Summary: entry.Summary, Primary: entry.Primary}, nil
+	}
+	if apiErr, ok := err.(*googleapi.Error); !ok || apiErr.Code != http.StatusNotFound {
+		return nil, googleError(err)
+	}
+
+	// Calendars shared with the user aren't necessarily in their calendar list.
+	sharedCalendar, err := g.service.Calendars.Get(calendarID).Do()
+	if err != nil {
+		return nil, googleError(err)
+	}
+	return &Calendar{ID: sharedCalendar.Id, Summary: sharedCalendar.Summary}, nil
+}
+
+func (g *googleProvider) ListEvents(calendarID string, timeMin, timeMax time.Time) ([]*Event, error) {
+	calendarEvents, err := g.service.Events.List(calendarID).
+		TimeMin(timeMin.Format(time.RFC3339)).
+		TimeMax(timeMax.Format(time.RFC3339)).
+		SingleEvents(true).
+		OrderBy("startTime").
+		Do()
+	if err != nil {
+		return nil, googleError(err)
+	}
+
+	events := []*Event{}
+	for _, event := range calendarEvents.Items {
+		events = append(events, newGoogleEvent(event))
+	}
+	return events, nil
+}
+
+func (g *googleProvider) SyncEvents(calendarID, syncToken string, timeMin time.Time) ([]*Event, string, error) {
+	events := []*Event{}
+	pageToken := ""
+	for {
+		eventsListCall := g.service.Events.List(calendarID).SingleEvents(true).PageToken(pageToken)
+		if syncToken != "" {
+			eventsListCall = eventsListCall.SyncToken(syncToken)
+		} else {
+			// Recurring events are expanded, so the full sync is bounded by the sync
+			// window: events entering it later are stored by the next full sync.
+			eventsListCall = eventsListCall.TimeMin(timeMin.Format(time.RFC3339)).TimeMax(timeMin.Add(syncWindow).Format(time.RFC3339))
+		}
+
+		calendarEvents, err := eventsListCall.Do()
+		if err != nil {
+			return nil, "", googleError(err)
+		}
+
+		for _, event := range calendarEvents.Items {
+			events = append(events, newGoogleEvent(event))
+		}
+
+		if calendarEvents.NextPageToken == "" {
+			return events, calendarEvents.NextSyncToken, nil
+		}
+		pageToken = calendarEvents.NextPageToken
+	}
+}
+
+func (g *googleProvider) Watch(calendarID, channelID, token, address string) (*WatchChannel, error) {
+	channel, err := g.service.Events.Watch(calendarID, &calendar.Channel{
+		Address: address,
+		Id:      channelID,
+		Token:   token,
+		Type:    "web_hook",
+	}).Do()
+	if err != nil {
+		return nil, googleError(err)
+	}
+
+	return &WatchChannel{ID: channel.Id, ResourceID: channel.ResourceId, Expiry: channel.Expiration}, nil
+}
+
+func (g *googleProvider) StopWatch(channelID, resourceID string) error {
+	err := g.service.Channels.Stop(&calendar.Channel{
+		Id:         channelID,
+		ResourceId: resourceID,
+	}).Do()
+	return googleError(err)
+}
+
+func (g *googleProvider) GetBusyTime(timeMin, timeMax time.Time) ([]interval, error) {
+	freeBusy, err := g.service.Freebusy.Query(&calendar.FreeBusyRequest{
+		TimeMin: timeMin.Format(time.RFC3339),
+		TimeMax: timeMax.Format(time.RFC3339),
+		Items:   []*calendar.FreeBusyRequestItem{{Id: "primary"}},
+	}).Do()
+	if err != nil {
+		return nil, googleError(err)
+	}
+
+	busy := []interval{}
+	for _, period := range freeBusy.Calendars["primary"].Busy {
+		start, err := time.Parse(time.RFC3339, period.Start)
+		if err != nil {
+			continue
+		}
+		end, err := time.Parse(time.RFC3339, period.End)
+		if err != nil {
+			continue
+		}
+		busy = append(busy, interval{start: start, end: end})
+	}
+	return busy, nil
+}
+
+// CreateEvent creates the event, adding a Google Meet conference if a meeting is
+// requested, and emails the invitations to the attendees.
+func (g *googleProvider) CreateEvent(request *EventRequest) (*Event, error) {
+	attendees := []*calendar.EventAttendee{}
+	for _, email := range request.AttendeeEmails {
+		attendees = append(attendees, &calendar.EventAttendee{Email: email})
+	}
+
+	event := &calendar.Event{
+		Summary:   request.Summary,
+		Start:     &calendar.EventDateTime{DateTime: request.Start.Format(time.RFC3339), TimeZone: request.Start.Location().String()},
+		End:       &calendar.EventDateTime{DateTime: request.End.Format(time.RFC3339), TimeZone: request.End.Location().String()},
+		Attendees: attendees,
+	}
+	if request.AddMeeting {
+		event.ConferenceData = &calendar.ConferenceData{
+			CreateRequest: &calendar.CreateConferenceRequest{
+				RequestId:             model.NewId(),
+				ConferenceSolutionKey: &calendar.ConferenceSolutionKey{Type: "hangoutsMeet"},
+			},
+		}
+	}
+
+	created, err := g.service.Events.Insert("primary", event).ConferenceDataVersion(1).SendUpdates("all").Do()
+	if err != nil {
+		return nil, googleError(err)
+	}
+	return newGoogleEvent(created), nil
+}
+
+func (g *googleProvider) RespondToEvent(calendarID, eventID, response string) error {
+	event, err := g.service.Events.Get(calendarID, eventID).Do()
+	if err != nil {
+		return googleError(err)
+	}
+
+	found := false
+	for _, attendee := range event.Attendees {
+		if attendee.Self {
+			attendee.ResponseStatus = response
+			found = true
+		}
+	}
+	if !found {
+		return errors.Errorf("the user isn't invited to event %s", eventID)
+	}
+
+	_, err = g.service.Events.Patch(calendarID, eventID, &calendar.Event{Attendees: event.Attendees}).Do()
+	return googleError(err)
+}
+
+// newGoogleEvent captures the attributes of a Google Calendar event used by the plugin.
+func newGoogleEvent(event *calendar.Event) *Event {
+	e := &Event{
+		ID:       event.Id,
+		Summary:  event.Summary,
+		Location: event.Location,
+		HTMLLink: event.HtmlLink,
+		Status:   event.Status,
+
+		ResponseStatus:  selfResponseStatus(event),
+		OrganizedByUser: event.Organizer != nil && event.Organizer.Self,
+		Transparent:     event.Transparency == "transparent",
+		MeetingLink:     meetingLink(event),
+	}
+
+	// Cancelled events may come without their times. All-day events only set the
+	// date of their start and end.
+	if event.Start != nil && event.End != nil {
+		e.StartTime = event.Start.DateTime
+		e.EndTime = event.End.DateTime
+		if event.Start.DateTime == "" {
+			e.AllDay = true
+			e.StartTime = event.Start.Date
+			e.EndTime = event.End.Date
+		}
+	}
+
+	return e
+}
+
+// selfResponseStatus returns the response status of the user to an event, or an
+// empty string if the user isn't listed as an attendee, e.g. as sole organizer.
+func selfResponseStatus(event *calendar.Event) string {
+	for _, attendee := range event.Attendees {
+		if attendee.Self {
+			return attendee.ResponseStatus
+		}
+	}
+	return ""
+}
+
+// meetingLink returns the video conference link of an event, if any.
+func meetingLink(event *calendar.Event) string {
+	if event.ConferenceData != nil {
+		for _, entryPoint := range event.ConferenceData.EntryPoints {
+			if entryPoint.EntryPointType == "video" {
+				return entryPoint.Uri
+			}
+		}
+	}
+
+	return event.HangoutLink
+}
+
+// googleError translates the errors of Google that the plugin handles into the
+// errors of the providers, keeping their message.
+func googleError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if isGoogleAuthorizationError(err) {
+		return errors.Wrap(errAuthorizationRevoked, err.Error())
+	}
+
+	if apiErr, ok := err.(*googleapi.Error); ok {
+		// Calendars such as holiday calendars can't be watched.
+		if hasGoogleErrorReason(apiErr, "pushNotSupportedForRequestedResource") {
+			return errors.Wrap(errWatchNotSupported, err.Error())
+		}
+
+		// Google answers requests exceeding the quotas with 403 Forbidden, like
+		// requests the user didn't grant the permission for, or with 429.
+		if apiErr.Code == http.StatusTooManyRequests || hasGoogleErrorReason(apiErr, "rateLimitExceeded") || hasGoogleErrorReason(apiErr, "userRateLimitExceeded") {
+			return errors.Wrap(errRateLimited, err.Error())
+		}
+
+		switch apiErr.Code {
+		case http.StatusGone:
+			return errors.Wrap(errSyncTokenExpired, err.Error())
+		case http.StatusForbidden:
+			return errors.Wrap(errPermissionDenied, err.Error())
+		}
+	}
+
+	return err
+}
+
+// hasGoogleErrorReason returns whether one of the reasons of an error of Google is the given one.
+func hasGoogleErrorReason(err *googleapi.Error, reason string) bool {
+	for _, item := range err.Errors {
+		if item.Reason == reason {
+			return true
+		}
+	}
+	return false
+}
+
+// isGoogleAuthorizationError returns whether err shows the user's authorization
+// was revoked or expired: the refresh token is rejected with invalid_grant, or
+// Google answers an API call with 401 Unauthorized. Other token errors, such as
+// invalid_client when the client ID or secret are misconfigured, concern every
+// user and don't disconnect them.
+func isGoogleAuthorizationError(err error) bool {
+	switch err := err.(type) {
+	case *oauth2.RetrieveError:
+		return oauthErrorCode(err) == "invalid_grant"
+	case *googleapi.Error:
+		return err.Code == http.StatusUnauthorized
+	case *url.Error:
+		return isGoogleAuthorizationError(err.Err)
+	}
+	return false
+}
+
+// oauthErrorCode returns the error code of a token request rejected by the
+// authorization server, sent as JSON or form-encoded.
+func oauthErrorCode(err *oauth2.RetrieveError) string {
+	var body struct {
+		Error string `json:"error"`
+	}
+	if jsonErr := json.Unmarshal(err.Body, &body); jsonErr == nil {
+		return body.Error
+	}
+	if values, parseErr := url.ParseQuery(string(err.Body)); parseErr == nil {
+		return values.Get("error")
+	}
+	return ""
+}
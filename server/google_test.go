@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/calendar/v3"
+	"google.golang.org/api/googleapi"
+
+	"github.com/waseem18/mattermost-plugin-google-calendar/server/fakegoogle"
+)
+
+func TestGoogleError(t *testing.T) {
+	apiError := func(code int, reason string) error {
+		return &googleapi.Error{Code: code, Message: "message", Errors: []googleapi.ErrorItem{{Reason: reason, Message: "message"}}}
+	}
+
+	for _, tc := range []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"unauthorized", apiError(http.StatusUnauthorized, "authError"), errAuthorizationRevoked},
+		{"insufficient permissions", apiError(http.StatusForbidden, "insufficientPermissions"), errPermissionDenied},
+		{"rate limit", apiError(http.StatusForbidden, "rateLimitExceeded"), errRateLimited},
+		{"user rate limit", apiError(http.StatusForbidden, "userRateLimitExceeded"), errRateLimited},
+		{"too many requests", apiError(http.StatusTooManyRequests, "rateLimitExceeded"), errRateLimited},
+		{"push not supported", apiError(http.StatusBadRequest, "pushNotSupportedForRequestedResource"), errWatchNotSupported},
+		{"sync token expired", apiError(http.StatusGone, "fullSyncRequired"), errSyncTokenExpired},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := googleError(tc.err)
+			assert.Equal(t, tc.want, errors.Cause(err))
+			assert.Contains(t, err.Error(), "message")
+		})
+	}
+
+	notFound := apiError(http.StatusNotFound, "notFound")
+	assert.Equal(t, notFound, googleError(notFound))
+	assert.NoError(t, googleError(nil))
+}
+
+func TestIsGoogleAuthorizationError(t *testing.T) {
+	retrieveError := func(code int, body string) error {
+		return &url.Error{Op: "Post", URL: "https://oauth2.googleapis.com/token", Err: &oauth2.RetrieveError{
+			Response: &http.Response{StatusCode: code, Status: http.StatusText(code)},
+			Body:     []byte(body),
+		}}
+	}
+
+	for _, tc := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"revoked grant", retrieveError(http.StatusBadRequest, `{"error": "invalid_grant", "error_description": "Token has been expired or revoked."}`), true},
+		{"form-encoded revoked grant", retrieveError(http.StatusBadRequest, "error=invalid_grant"), true},
+		{"misconfigured client", retrieveError(http.StatusUnauthorized, `{"error": "invalid_client", "error_description": "Unauthorized"}`), false},
+		{"unauthorized client", retrieveError(http.StatusUnauthorized, `{"error": "unauthorized_client"}`), false},
+		{"unauthorized API call", &googleapi.Error{Code: http.StatusUnauthorized}, true},
+		{"server error", retrieveError(http.StatusInternalServerError, "oops"), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, isGoogleAuthorizationError(tc.err))
+		})
+	}
+}
+
+func TestMisconfiguredClientKeepsUsersConnected(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	userInfo := e.connected(t, testUserID)
+
+	// The access token has expired and can't be refreshed, as the admin mistyped
+	// the client secret.
+	userInfo.Token.Expiry = e.clock.Now().Add(-time.Minute)
+	require.NoError(t, e.p.storeUserInfo(userInfo))
+	config := *e.p.getConfiguration()
+	config.CalendarOAuthClientSecret = "mistyped"
+	e.p.setConfiguration(&config)
+
+	assert.Error(t, e.p.updateCalendarEvents(userInfo, "primary"))
+
+	stored, err := e.p.getUserInfo(testUserID)
+	require.NoError(t, err)
+	assert.NotNil(t, stored, "the user is still connected")
+
+	connectedUsers, err := e.p.getConnectedUsers()
+	require.NoError(t, err)
+	assert.Contains(t, connectedUsers, testUserID)
+}
+
+func TestFullSyncIsBoundedBySyncWindow(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	userInfo := e.connected(t, testUserID)
+
+	// The instances of a weekly meeting without an end date, as Google expands
+	// them, are only fetched within the sync window.
+	start := e.clock.Now().Add(time.Hour).Truncate(time.Second)
+	for week := 0; week < 52; week++ {
+		weekStart := start.AddDate(0, 0, 7*week)
+		_, err := e.google.AddEvent(fakegoogle.PrimaryCalendarID, &calendar.Event{
+			Summary: "Weekly sync",
+			Start:   &calendar.EventDateTime{DateTime: weekStart.Format(time.RFC3339)},
+			End:     &calendar.EventDateTime{DateTime: weekStart.Add(time.Hour).Format(time.RFC3339)},
+		})
+		require.NoError(t, err)
+	}
+
+	provider, err := e.p.getCalendarProvider(userInfo)
+	require.NoError(t, err)
+	events, syncToken, err := provider.SyncEvents("primary", "", e.clock.Now())
+	require.NoError(t, err)
+	assert.NotEmpty(t, syncToken)
+
+	require.NotEmpty(t, events)
+	for _, event := range events {
+		eventStart, err := time.Parse(time.RFC3339, event.StartTime)
+		require.NoError(t, err)
+		assert.True(t, eventStart.Before(e.clock.Now().Add(syncWindow)), "%s is outside the sync window", event.StartTime)
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	icalDateFormat     = "20060102"
+	icalDateTimeFormat = "20060102T150405"
+
+	// icalMaxLineLength is the length in octets after which lines are folded.
+	icalMaxLineLength = 75
+)
+
+// icalComponent captures a component of an iCalendar object, such as VCALENDAR
+// or VEVENT, with its properties and subcomponents in their original order.
+type icalComponent struct {
+	Name       string
+	Properties []*icalProperty
+	Components []*icalComponent
+}
+
+// icalProperty captures a property of an iCalendar component. Values are kept
+// as they appear in the object, see icalText for text values.
+type icalProperty struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+// parseICalendar parses an iCalendar object, returning its top-level component.
+func parseICalendar(data string) (*icalComponent, error) {
+	var stack []*icalComponent
+	var root *icalComponent
+
+	for _, line := range unfoldICalendar(data) {
+		if line == "" {
+			continue
+		}
+
+		property, err := parseICalendarLine(line)
+		if err != nil {
+			return nil, err
+		}
+
+		switch property.Name {
+		case "BEGIN":
+			component := &icalComponent{Name: strings.ToUpper(property.Value)}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.Components = append(parent.Components, component)
+			} else if root == nil {
+				root = component
+			}
+			stack = append(stack, component)
+		case "END":
+			if len(stack) == 0 || stack[len(stack)-1].Name != strings.ToUpper(property.Value) {
+				return nil, fmt.Errorf("unexpected END:%s", property.Value)
+			}
+			stack = stack[:len(stack)-1]
+		default:
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("property %s outside of a component", property.Name)
+			}
+			component := stack[len(stack)-1]
+			component.Properties = append(component.Properties, property)
+		}
+	}
+
+	if root == nil || len(stack) > 0 {
+		return nil, fmt.Errorf("incomplete iCalendar object")
+	}
+	return root, nil
+}
+
+// unfoldICalendar splits an iCalendar object into its content lines, joining the
+// lines folded by starting them with a space or a tab.
+func unfoldICalendar(data string) []string {
+	lines := []string{}
+	for _, line := range strings.Split(strings.Replace(data, "\r\n", "\n", -1), "\n") {
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// parseICalendarLine parses a content line such as
+// "DTSTART;TZID=Europe/Berlin:20260302T100000".
+func parseICalendarLine(line string) (*icalProperty, error) {
+	property := &icalProperty{Params: map[string]string{}}
+
+	// The name and parameters end at the first colon outside of a quoted parameter value.
+	quoted := false
+	end := -1
+	for i, c := range line {
+		if c == '"' {
+			quoted = !quoted
+		} else if c == ':' && !quoted {
+			end = i
+			break
+		}
+	}
+	if end < 0 {
+		return nil, fmt.Errorf("invalid content line %q", line)
+	}
+	property.Value = line[end+1:]
+
+	parts := splitICalendarParams(line[:end])
+	property.Name = strings.ToUpper(parts[0])
+	for _, param := range parts[1:] {
+		index := strings.Index(param, "=")
+		if index < 0 {
+			continue
+		}
+		property.Params[strings.ToUpper(param[:index])] = strings.Trim(param[index+1:], `"`)
+	}
+
+	return property, nil
+}
+
+// splitICalendarParams splits the name and parameters of a content line at the
+// semicolons outside of quoted parameter values.
+func splitICalendarParams(value string) []string {
+	parts := []string{}
+	quoted := false
+	start := 0
+	for i, c := range value {
+		if c == '"' {
+			quoted = !quoted
+		} else if c == ';' && !quoted {
+			parts = append(parts, value[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, value[start:])
+}
+
+// String encodes the component as an iCalendar object, folding long lines.
+func (c *icalComponent) String() string {
+	var b strings.Builder
+	c.encode(&b)
+	return b.String()
+}
+
+func (c *icalComponent) encode(b *strings.Builder) {
+	writeICalendarLine(b, "BEGIN:"+c.Name)
+	for _, property := range c.Properties {
+		names := []string{}
+		for name := range property.Params {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		line := property.Name
+		for _, name := range names {
+			value := property.Params[name]
+			if strings.ContainsAny(value, ":;,") {
+				value = `"` + value + `"`
+			}
+			line += ";" + name + "=" + value
+		}
+		writeICalendarLine(b, line+":"+property.Value)
+	}
+	for _, component := range c.Components {
+		component.encode(b)
+	}
+	writeICalendarLine(b, "END:"+c.Name)
+}
+
+// writeICalendarLine writes a content line, folding it so that no line is longer
+// than icalMaxLineLength octets without splitting a character.
+func writeICalendarLine(b *strings.Builder, line string) {
+	for len(line) > icalMaxLineLength {
+		end := icalMaxLineLength
+		for end > 0 && !utf8.RuneStart(line[end]) {
+			end--
+		}
+		b.WriteString(line[:end] + "\r\n ")
+		line = line[end:]
+	}
+	b.WriteString(line + "\r\n")
+}
+
+// property returns the first property of the component with the given name, or nil.
+func (c *icalComponent) property(name string) *icalProperty {
+	for _, property := range c.Properties {
+		if property.Name == name {
+			return property
+		}
+	}
+	return nil
+}
+
+// value returns the value of the first property with the given name, or an empty string.
+func (c *icalComponent) value(name string) string {
+	if property := c.property(name); property != nil {
+		return property.Value
+	}
+	return ""
+}
+
+// text returns the unescaped text value of the first property with the given name.
+func (c *icalComponent) text(name string) string {
+	return icalText(c.value(name))
+}
+
+// icalText unescapes a text value.
+func icalText(value string) string {
+	return strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(value)
+}
+
+// icalEscape escapes a text value.
+func icalEscape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, ",", `\,`, ";", `\;`).Replace(value)
+}
+
+// events returns the VEVENT components of a VCALENDAR object.
+func (c *icalComponent) events() []*icalComponent {
+	events := []*icalComponent{}
+	for _, component := range c.Components {
+		if component.Name == "VEVENT" {
+			events = append(events, component)
+		}
+	}
+	return events
+}
+
+// icalTime parses a DATE or DATE-TIME property, returning whether it is a date.
+// Times with an unknown TZID and floating times are taken as UTC.
+func icalTime(property *icalProperty) (time.Time, bool, error) {
+	if property.Params["VALUE"] == "DATE" || len(property.Value) == len(icalDateFormat) {
+		t, err := time.Parse(icalDateFormat, property.Value)
+		return t, true, err
+	}
+
+	if strings.HasSuffix(property.Value, "Z") {
+		t, err := time.Parse(icalDateTimeFormat+"Z", property.Value)
+		return t, false, err
+	}
+
+	location := time.UTC
+	if tzid := property.Params["TZID"]; tzid != "" {
+		if l, err := time.LoadLocation(tzid); err == nil {
+			location = l
+		}
+	}
+	t, err := time.ParseInLocation(icalDateTimeFormat, property.Value, location)
+	return t, false, err
+}
+
+// icalDuration parses a duration such as "PT1H30M", "P1D" or "P1W". Durations
+// in days are returned as a number of days, since they don't always last 24 hours.
+func icalDuration(value string) (days int, duration time.Duration, err error) {
+	invalid := fmt.Errorf("invalid duration %q", value)
+
+	sign := 1
+	if strings.HasPrefix(value, "-") {
+		sign = -1
+	}
+	value = strings.TrimLeft(value, "+-")
+	if !strings.HasPrefix(value, "P") {
+		return 0, 0, invalid
+	}
+	value = value[1:]
+
+	inTime := false
+	number := ""
+	for _, c := range value {
+		switch {
+		case c >= '0' && c <= '9':
+			number += string(c)
+			continue
+		case c == 'T':
+			inTime = true
+			continue
+		}
+
+		n, err := strconv.Atoi(number)
+		if err != nil {
+			return 0, 0, invalid
+		}
+		number = ""
+
+		switch {
+		case c == 'W' && !inTime:
+			days += 7 * n
+		case c == 'D' && !inTime:
+			days += n
+		case c == 'H' && inTime:
+			duration += time.Duration(n) * time.Hour
+		case c == 'M' && inTime:
+			duration += time.Duration(n) * time.Minute
+		case c == 'S' && inTime:
+			duration += time.Duration(n) * time.Second
+		default:
+			return 0, 0, invalid
+		}
+	}
+	if number != "" {
+		return 0, 0, invalid
+	}
+
+	return sign * days, time.Duration(sign) * duration, nil
+}
+
+// icalAddress returns the email address of a CAL-ADDRESS value such as
+// "mailto:alice@example.com", in lower case.
+func icalAddress(value string) string {
+	if strings.HasPrefix(strings.ToLower(value), "mailto:") {
+		value = value[len("mailto:"):]
+	}
+	return strings.ToLower(value)
+}
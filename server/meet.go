@@ -0,0 +1,328 @@
+package main
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/mlog"
+	"github.com/mattermost/mattermost-server/model"
+)
+
+const (
+	// maxProposedSlots is how many free slots are proposed for a channel meeting.
+	maxProposedSlots = 5
+
+	// slotStep is the granularity of the start times of the proposed slots.
+	slotStep = 30 * time.Minute
+)
+
+// executeMeetChannelCommand proposes the earliest slots within working hours when
+// all the members of the channel who connected their calendar and share their
+// availability with the user are free.
+func (p *Plugin) executeMeetChannelCommand(args *model.CommandArgs, parameters []string) *model.CommandResponse {
+	usage := "Use `/google-calendar meet-channel <duration> [today|tomorrow|week]`, e.g. `/google-calendar meet-channel 30m tomorrow`."
+	if len(parameters) == 0 {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, usage)
+	}
+
+	if !p.getConfiguration().EnableWriteAccess {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, "Creating events isn't enabled. Ask your system administrator to enable **Allow responding to and creating events**.")
+	}
+
+	if userInfo, err := p.getUserInfo(args.UserId); err != nil || userInfo == nil {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, "Connect your Google Calendar first with `/google-calendar connect`.")
+	}
+
+	duration, err := parseEventDuration(parameters[0])
+	if err != nil {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, err.Error())
+	}
+
+	now := p.now().In(p.getUserLocation(args.UserId))
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+	window := "week"
+	if len(parameters) > 1 {
+		window = parameters[1]
+	}
+
+	var timeMin, timeMax time.Time
+	switch window {
+	case "today":
+		timeMin, timeMax = now, today.AddDate(0, 0, 1)
+	case "tomorrow":
+		timeMin, timeMax = today.AddDate(0, 0, 1), today.AddDate(0, 0, 2)
+	case "week":
+		timeMin, timeMax = now, today.AddDate(0, 0, 7)
+	default:
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, usage)
+	}
+
+	participants, err := p.getConnectedChannelMembers(args.ChannelId)
+	if err != nil {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, "Encountered an error fetching the members of the channel.")
+	}
+
+	busy := []interval{}
+	checked := 0
+	unavailable := []string{}
+	private := []string{}
+	for _, participant := range participants {
+		if !p.canSeeAvailability(args.UserId, args.TeamId, participant.Id) {
+			private = append(private, "@"+participant.Username)
+			continue
+		}
+
+		checked++
+		periods, err := p.getBusyTime(participant, timeMin, timeMax)
+		if err != nil {
+			mlog.Error("Error fetching free/busy information", mlog.String("user_id", participant.Id), mlog.Err(err))
+			unavailable = append(unavailable, "@"+participant.Username)
+			continue
+		}
+		busy = append(busy, periods...)
+	}
+
+	slots := findFreeSlots(busy, timeMin, timeMax, duration, maxProposedSlots)
+	if len(slots) == 0 {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, fmt.Sprintf("No common free time of %s found within working hours.", formatDuration(duration)))
+	}
+
+	config := p.API.GetConfig()
+	actions := []*model.PostAction{}
+	for _, slot := range slots {
+		start := slot.Format(time.RFC3339)
+		minutes := strconv.Itoa(int(duration / time.Minute))
+		actions = append(actions, &model.PostAction{
+			Name: fmt.Sprintf("%s %s", formatDay(slot, now), formatTime(slot)),
+			Integration: &model.PostActionIntegration{
+				URL: fmt.Sprintf("%s/plugins/google-calendar/meet-channel/schedule", *config.ServiceSettings.SiteURL),
+				Context: map[string]interface{}{
+					"channel_id": args.ChannelId,
+					"start":      start,
+					"duration":   minutes,
+					"signature":  p.signIntegrationRequest(args.UserId, args.ChannelId, start, minutes),
+				},
+			},
+		})
+	}
+
+	text := fmt.Sprintf("Checked the calendars of the %s of this channel who connected their Google Calendar. Pick a time to create the event and post the invite in the channel.", pluralize(checked, "member"))
+	if len(unavailable) > 0 {
+		text += fmt.Sprintf("\nCouldn't check the calendars of %s.", strings.Join(unavailable, ", "))
+	}
+	if len(private) > 0 {
+		text += fmt.Sprintf("\nDidn't check the calendars of %s, who don't share their availability with you.", strings.Join(private, ", "))
+	}
+
+	resp := getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, "")
+	resp.Attachments = []*model.SlackAttachment{{
+		Pretext: fmt.Sprintf("Earliest common free slots of %s", formatDuration(duration)),
+		Text:    text,
+		Color:   "#7FC1EE",
+		Actions: actions,
+	}}
+	return resp
+}
+
+// getConnectedChannelMembers returns the members of a channel who connected their Google Calendar.
+func (p *Plugin) getConnectedChannelMembers(channelID string) ([]*model.User, error) {
+	members := []*model.User{}
+	for page := 0; ; page++ {
+		users, appErr := p.API.GetUsersInChannel(channelID, "username", page, 200)
+		if appErr != nil {
+			return nil, appErr
+		}
+
+		for _, user := range users {
+			if userInfo, err := p.getUserInfo(user.Id); err == nil && userInfo != nil {
+				members = append(members, user)
+			}
+		}
+
+		if len(users) < 200 {
+			return members, nil
+		}
+	}
+}
+
+// getBusyTime returns the busy periods of the user's primary calendar between
+// timeMin and timeMax, queried with their own credentials.
+func (p *Plugin) getBusyTime(user *model.User, timeMin, timeMax time.Time) ([]interval, error) {
+	userInfo, err := p.getUserInfo(user.Id)
+	if err != nil {
+		return nil, err
+	}
+	if userInfo == nil {
+		return nil, fmt.Errorf("user %s isn't connected", user.Id)
+	}
+
+	provider, err := p.getCalendarProvider(userInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	return provider.GetBusyTime(timeMin, timeMax)
+}
+
+// findFreeSlots returns the start of up to n non-overlapping slots of the given
+// duration between timeMin and timeMax, within the working hours of weekdays in the
+// timezone of timeMin, that don't overlap any busy period.
+func findFreeSlots(busy []interval, timeMin, timeMax time.Time, duration time.Duration, n int) []time.Time {
+	slots := []time.Time{}
+	for day := time.Date(timeMin.Year(), timeMin.Month(), timeMin.Day(), 0, 0, 0, 0, timeMin.Location()); day.Before(timeMax) && len(slots) < n; day = day.AddDate(0, 0, 1) {
+		if day.Weekday() == time.Saturday || day.Weekday() == time.Sunday {
+			continue
+		}
+
+		dayEnd := time.Date(day.Year(), day.Month(), day.Day(), workdayEnd, 0, 0, 0, day.Location())
+		if dayEnd.After(timeMax) {
+			dayEnd = timeMax
+		}
+
+		start := time.Date(day.Year(), day.Month(), day.Day(), workdayStart, 0, 0, 0, day.Location())
+		for start.Before(timeMin) {
+			start = start.Add(slotStep)
+		}
+
+		for !start.Add(duration).After(dayEnd) && len(slots) < n {
+			end := start.Add(duration)
+			conflict := false
+			for _, period := range busy {
+				if period.start.Before(end) && period.end.After(start) {
+					conflict = true
+					break
+				}
+			}
+
+			if conflict {
+				start = start.Add(slotStep)
+				continue
+			}
+
+			slots = append(slots, start)
+			start = end
+		}
+	}
+
+	return slots
+}
+
+// scheduleChannelMeeting handles a click on a proposed slot: it creates the event
+// with the connected members of the channel and posts the invite in the channel.
+func (p *Plugin) scheduleChannelMeeting(w http.ResponseWriter, r *http.Request) {
+	request := model.PostActionIntegrationRequestFromJson(r.Body)
+	if request == nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	channelID, _ := request.Context["channel_id"].(string)
+	startTime, _ := request.Context["start"].(string)
+	minutes, _ := request.Context["duration"].(string)
+	signature, _ := request.Context["signature"].(string)
+
+	if !hmac.Equal([]byte(signature), []byte(p.signIntegrationRequest(request.UserId, channelID, startTime, minutes))) {
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	reply := &model.PostActionIntegrationResponse{}
+	if err := p.createChannelMeeting(request.UserId, channelID, startTime, minutes); err != nil {
+		mlog.Error("Error scheduling a channel meeting", mlog.String("user_id", request.UserId), mlog.Err(err))
+		reply.EphemeralText = "Encountered an error scheduling the meeting."
+	} else {
+		reply.EphemeralText = "Scheduled the meeting and posted the invite in the channel."
+	}
+
+	w.Write(reply.ToJson())
+}
+
+// createChannelMeeting creates an event organized by the user with the connected
+// members of the channel and posts the invite in the channel.
+func (p *Plugin) createChannelMeeting(userID, channelID, startTime, minutes string) error {
+	userInfo, err := p.getUserInfo(userID)
+	if err != nil {
+		return err
+	}
+	if userInfo == nil {
+		return fmt.Errorf("user %s isn't connected", userID)
+	}
+
+	channel, appErr := p.API.GetChannel(channelID)
+	if appErr != nil {
+		return appErr
+	}
+
+	location := p.getUserLocation(userID)
+	start, err := time.Parse(time.RFC3339, startTime)
+	if err != nil {
+		return err
+	}
+	start = start.In(location)
+	duration, err := strconv.Atoi(minutes)
+	if err != nil {
+		return err
+	}
+
+	members, err := p.getConnectedChannelMembers(channelID)
+	if err != nil {
+		return err
+	}
+
+	channelName := channel.DisplayName
+	if channelName == "" {
+		channelName = channel.Name
+	}
+
+	e := &newEvent{
+		title:    "Meeting with " + channelName,
+		start:    start,
+		duration: time.Duration(duration) * time.Minute,
+		addMeet:  true,
+	}
+	for _, member := range members {
+		if member.Id != userID {
+			e.attendees = append(e.attendees, member.Username)
+		}
+	}
+
+	event, err := p.insertEvent(userInfo, e)
+	if err != nil {
+		return err
+	}
+
+	organizer, appErr := p.API.GetUser(userID)
+	if appErr != nil {
+		return appErr
+	}
+
+	text := fmt.Sprintf("@%s scheduled a meeting with this channel. The members who connected their Google Calendar are invited.", organizer.Username)
+	if event.MeetingLink != "" {
+		text += fmt.Sprintf("\n[Join meeting](%s)", event.MeetingLink)
+	}
+
+	if _, appErr := p.createBotPost(&model.Post{
+		ChannelId: channelID,
+		Type:      model.POST_SLACK_ATTACHMENT,
+		Props: map[string]interface{}{
+			"attachments": []*model.SlackAttachment{{
+				Pretext:   "New meeting",
+				Title:     event.Summary,
+				TitleLink: event.HTMLLink,
+				Text:      text,
+				Fields: []*model.SlackAttachmentField{
+					{Title: "When", Value: formatEventTime(newEventInfo(event), p.now().In(location)) + " " + start.Format("MST")},
+				},
+				Color: "#7FC1EE",
+			}},
+		},
+	}); appErr != nil {
+		return appErr
+	}
+	return nil
+}
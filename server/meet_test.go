@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/mattermost/mattermost-server/plugin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/waseem18/mattermost-plugin-google-calendar/server/fakegoogle"
+)
+
+func TestMeetChannelCommand(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	config := *e.p.getConfiguration()
+	config.EnableWriteAccess = true
+	e.p.setConfiguration(&config)
+	e.clock.set(time.Date(2026, 3, 2, 8, 0, 0, 0, time.UTC))
+
+	e.connected(t, testUserID)
+	e.connected(t, "teammate")
+	e.connected(t, "private")
+	require.NoError(t, e.p.storeUserSettings("private", &UserSettings{
+		ReminderLeadTimes:      defaultReminderLeadTimes,
+		AllDayReminderTime:     defaultAllDayReminderTime,
+		AvailabilityVisibility: availabilityNobody,
+	}))
+	e.api.On("GetUsersInChannel", "channel", "username", 0, 200).Return([]*model.User{
+		{Id: testUserID, Username: testUserID},
+		{Id: "teammate", Username: "teammate"},
+		{Id: "private", Username: "private"},
+		{Id: "unconnected", Username: "unconnected"},
+	}, nil)
+
+	// The connected users share the calendar of the fake.
+	e.addEvent(t, fakegoogle.PrimaryCalendarID, "Planning", time.Hour, time.Hour)
+
+	resp, appErr := e.p.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{UserId: testUserID, ChannelId: "channel", Command: "/google-calendar meet-channel 30m today"})
+	require.Nil(t, appErr)
+	require.Len(t, resp.Attachments, 1)
+
+	attachment := resp.Attachments[0]
+	assert.Contains(t, attachment.Text, "Checked the calendars of the 2 members")
+	assert.Contains(t, attachment.Text, "Didn't check the calendars of @private, who don't share their availability with you.")
+	assert.NotContains(t, attachment.Text, "Couldn't check")
+
+	require.NotEmpty(t, attachment.Actions)
+	assert.Equal(t, "2026-03-02T10:00:00Z", attachment.Actions[0].Integration.Context["start"], "the first slot is after the busy period")
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/mlog"
+)
+
+// calendarInfoVersion is the current format version of stored CalendarInfo records.
+//
+// Version 0 stored event times formatted as "3:04PM", with the RFC3339 start of
+// the event kept separately in StartDateTime.
+// Version 1 stores event times as RFC3339 instants.
+// Version 2 stores the sync and watch details per subscribed calendar instead of
+// for the primary calendar only.
+const calendarInfoVersion = 2
+
+// legacyCalendarInfo captures the attributes of a record stored before version 2.
+type legacyCalendarInfo struct {
+	CalendarWatchToken      string
+	CalendarWatchExpiry     int64
+	CalendarWatchResourceID string
+	Events                  []legacyEventInfo
+}
+
+// legacyEventInfo captures the attributes of an event stored in a version 0 record.
+type legacyEventInfo struct {
+	EndTime       string
+	StartDateTime string
+}
+
+// migrateCalendarInfo upgrades a CalendarInfo record stored in an older format and
+// persists the result. Events whose times can't be recovered are dropped; the
+// next calendar update is a full sync, which fetches all upcoming events again.
+func (p *Plugin) migrateCalendarInfo(userID string, data []byte, calendarInfo *CalendarInfo) error {
+	var legacy legacyCalendarInfo
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return err
+	}
+
+	droppedEvents := 0
+	if calendarInfo.Version < 1 {
+		events := []EventInfo{}
+		for index, event := range calendarInfo.Events {
+			start, err := time.Parse(time.RFC3339, legacy.Events[index].StartDateTime)
+			if err != nil {
+				continue
+			}
+
+			clock, err := time.Parse("3:04PM", legacy.Events[index].EndTime)
+			if err != nil {
+				continue
+			}
+
+			end := time.Date(start.Year(), start.Month(), start.Day(), clock.Hour(), clock.Minute(), 0, 0, start.Location())
+			if end.Before(start) {
+				end = end.AddDate(0, 0, 1)
+			}
+
+			event.StartTime = start.Format(time.RFC3339)
+			event.EndTime = end.Format(time.RFC3339)
+			events = append(events, event)
+		}
+
+		droppedEvents = len(calendarInfo.Events) - len(events)
+		calendarInfo.Events = events
+	}
+
+	if calendarInfo.Version < 2 {
+		for index := range calendarInfo.Events {
+			calendarInfo.Events[index].CalendarID = "primary"
+		}
+
+		calendarInfo.Calendars = []SubscribedCalendar{{
+			ID:              "primary",
+			WatchToken:      legacy.CalendarWatchToken,
+			WatchExpiry:     legacy.CalendarWatchExpiry,
+			WatchResourceID: legacy.CalendarWatchResourceID,
+		}}
+	}
+
+	mlog.Info("Migrated stored calendar information",
+		mlog.String("user_id", userID),
+		mlog.Int("from_version", calendarInfo.Version),
+		mlog.Int("dropped_events", droppedEvents))
+
+	return p.storeCalendarInfo(userID, calendarInfo)
+}
+
+// migrateConnectedUsers builds the index of connected users from the stored user
+// information if it doesn't exist yet, e.g. for users who connected before the
+// index was introduced.
+func (p *Plugin) migrateConnectedUsers() error {
+	p.connectedUsersLock.Lock()
+	defer p.connectedUsersLock.Unlock()
+
+	if info, appErr := p.API.KVGet(connectedUsersKey); appErr != nil {
+		return appErr
+	} else if info != nil {
+		return nil
+	}
+
+	userIDs, err := p.listStoredUserIDs()
+	if err != nil {
+		return err
+	}
+
+	mlog.Info("Built the connected users index", mlog.Int("users", len(userIDs)))
+
+	return p.storeConnectedUsers(userIDs)
+}
+
+// listStoredUserIDs returns the IDs of the users whose information is stored.
+func (p *Plugin) listStoredUserIDs() ([]string, error) {
+	userIDs := []string{}
+	for page := 0; ; page++ {
+		keys, appErr := p.API.KVList(page, 1000)
+		if appErr != nil {
+			return nil, appErr
+		}
+
+		for _, key := range keys {
+			if strings.HasSuffix(key, userTokenKey) {
+				userIDs = append(userIDs, strings.TrimSuffix(key, userTokenKey))
+			}
+		}
+
+		if len(keys) < 1000 {
+			return userIDs, nil
+		}
+	}
+}
+
+// migrateUserTokens encrypts the tokens of the user information records stored
+// in plaintext before tokens were encrypted.
+func (p *Plugin) migrateUserTokens() error {
+	userIDs, err := p.listStoredUserIDs()
+	if err != nil {
+		return err
+	}
+
+	migrated := 0
+	for _, userID := range userIDs {
+		stored, err := p.getStoredUserInfo(userID)
+		if err != nil || stored == nil || stored.EncryptedToken != "" || stored.Token == nil {
+			continue
+		}
+
+		if err := p.storeUserInfo(&UserInfo{UserID: stored.UserID, ChannelID: stored.ChannelID, Token: stored.Token}); err != nil {
+			return err
+		}
+		migrated++
+	}
+
+	if migrated > 0 {
+		mlog.Info("Encrypted the stored tokens", mlog.Int("users", migrated))
+	}
+	return nil
+}
+
+// migrateDirectChannels moves the reminders of the users to their direct channel
+// with the bot, e.g. after the plugin switched from posting as the configured
+// user to posting as its bot account.
+func (p *Plugin) migrateDirectChannels() error {
+	userIDs, err := p.listStoredUserIDs()
+	if err != nil {
+		return err
+	}
+
+	migrated := 0
+	for _, userID := range userIDs {
+		userInfo, err := p.getUserInfo(userID)
+		if err != nil || userInfo == nil {
+			continue
+		}
+
+		previousChannelID := userInfo.ChannelID
+		if _, err := p.getDirectChannel(userInfo); err != nil || userInfo.ChannelID == previousChannelID {
+			continue
+		}
+
+		if err := p.storeUserInfo(userInfo); err != nil {
+			return err
+		}
+		migrated++
+	}
+
+	if migrated > 0 {
+		mlog.Info("Moved the reminders to the direct channels with the bot", mlog.Int("users", migrated))
+	}
+	return nil
+}
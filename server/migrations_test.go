@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+// storeJSON stores a record the way an older version of the plugin did.
+func (e *testEnv) storeJSON(t *testing.T, key string, record interface{}) {
+	data, err := json.Marshal(record)
+	require.NoError(t, err)
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.kv[key] = data
+}
+
+func TestMigrateCalendarInfo(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+
+	e.storeJSON(t, testUserID+calendarTokenKey, map[string]interface{}{
+		"CalendarWatchToken":      "token",
+		"CalendarWatchExpiry":     1234,
+		"CalendarWatchResourceID": "resource",
+		"Events": []map[string]interface{}{
+			{"Id": "standup", "Summary": "Standup", "StartDateTime": "2026-03-02T09:00:00-05:00", "EndTime": "9:15AM"},
+			{"Id": "late", "Summary": "Late release", "StartDateTime": "2026-03-02T23:30:00-05:00", "EndTime": "12:30AM"},
+			{"Id": "broken", "Summary": "Broken", "StartDateTime": "not a time", "EndTime": "9:15AM"},
+		},
+	})
+
+	calendarInfo, err := e.p.getCalendarInfo(testUserID)
+	require.NoError(t, err)
+	require.NotNil(t, calendarInfo)
+
+	assert.Equal(t, calendarInfoVersion, calendarInfo.Version)
+	require.Len(t, calendarInfo.Events, 2, "events whose times can't be recovered are dropped")
+	assert.Equal(t, "2026-03-02T09:00:00-05:00", calendarInfo.Events[0].StartTime)
+	assert.Equal(t, "2026-03-02T09:15:00-05:00", calendarInfo.Events[0].EndTime)
+	assert.Equal(t, "2026-03-03T00:30:00-05:00", calendarInfo.Events[1].EndTime, "events ending after midnight end on the next day")
+	for _, event := range calendarInfo.Events {
+		assert.Equal(t, "primary", event.CalendarID)
+	}
+	assert.Equal(t, []SubscribedCalendar{{ID: "primary", WatchToken: "token", WatchExpiry: 1234, WatchResourceID: "resource"}}, calendarInfo.Calendars)
+
+	// The migrated record is stored.
+	var stored CalendarInfo
+	require.NoError(t, json.Unmarshal(e.kv[testUserID+calendarTokenKey], &stored))
+	assert.Equal(t, calendarInfoVersion, stored.Version)
+}
+
+func TestMigrateConnectedUsers(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	e.connected(t, testUserID)
+	e.connected(t, "user2")
+
+	// Users who connected before the index was introduced aren't in it.
+	require.Nil(t, e.p.API.KVDelete(connectedUsersKey))
+
+	require.NoError(t, e.p.migrateConnectedUsers())
+	userIDs, err := e.p.getConnectedUsers()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{testUserID, "user2"}, userIDs)
+
+	// An existing index is kept.
+	require.NoError(t, e.p.storeConnectedUsers([]string{testUserID}))
+	require.NoError(t, e.p.migrateConnectedUsers())
+	userIDs, err = e.p.getConnectedUsers()
+	require.NoError(t, err)
+	assert.Equal(t, []string{testUserID}, userIDs)
+}
+
+func TestMigrateUserTokens(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+
+	token := &oauth2.Token{AccessToken: "access", RefreshToken: "refresh", Expiry: time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)}
+	e.storeJSON(t, testUserID+userTokenKey, map[string]interface{}{
+		"UserID":    testUserID,
+		"ChannelID": directChannelID(testUserID),
+		"Token":     token,
+	})
+
+	require.NoError(t, e.p.migrateUserTokens())
+
+	stored, err := e.p.getStoredUserInfo(testUserID)
+	require.NoError(t, err)
+	require.NotNil(t, stored)
+	assert.Nil(t, stored.Token, "the plaintext token is removed")
+	assert.NotEmpty(t, stored.EncryptedToken)
+	assert.Equal(t, keyID("secret"), stored.KeyID)
+
+	userInfo, err := e.p.getUserInfo(testUserID)
+	require.NoError(t, err)
+	require.NotNil(t, userInfo)
+	assert.Equal(t, directChannelID(testUserID), userInfo.ChannelID)
+	assert.Equal(t, token.RefreshToken, userInfo.Token.RefreshToken)
+}
+
+func TestMigrateDirectChannels(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	userInfo := e.connected(t, testUserID)
+
+	// The reminders were posted in the direct channel with the configured user.
+	userInfo.ChannelID = "dm-configured-user"
+	require.NoError(t, e.p.storeUserInfo(userInfo))
+
+	require.NoError(t, e.p.migrateDirectChannels())
+
+	userInfo, err := e.p.getUserInfo(testUserID)
+	require.NoError(t, err)
+	assert.Equal(t, directChannelID(testUserID), userInfo.ChannelID)
+}
+
+func TestRestoreWaitsForSchedulerLease(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	e.connected(t, testUserID)
+	require.Nil(t, e.p.API.KVDelete(connectedUsersKey))
+
+	// The lease of a node that went away without releasing it hasn't expired yet.
+	e.p.nodeID = "this node"
+	require.Nil(t, e.p.API.KVSetWithExpiry(schedulerLeaseKey, []byte("stale node"), int64(schedulerLeaseDuration/time.Second)))
+	e.p.runScheduledTasks()
+
+	userIDs, err := e.p.getConnectedUsers()
+	require.NoError(t, err)
+	assert.Empty(t, userIDs, "the data isn't migrated without the lease")
+
+	// Once the stale lease expired, the next tick restores the connected users.
+	require.Nil(t, e.p.API.KVDelete(schedulerLeaseKey))
+	e.p.runScheduledTasks()
+
+	userIDs, err = e.p.getConnectedUsers()
+	require.NoError(t, err)
+	assert.Equal(t, []string{testUserID}, userIDs)
+
+	// It's only done once.
+	require.Nil(t, e.p.API.KVDelete(connectedUsersKey))
+	e.p.runScheduledTasks()
+
+	userIDs, err = e.p.getConnectedUsers()
+	require.NoError(t, err)
+	assert.Empty(t, userIDs)
+}
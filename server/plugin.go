@@ -1,10 +1,13 @@
 package main
 
 import (
-	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -13,10 +16,9 @@ import (
 	"github.com/mattermost/mattermost-server/mlog"
 	"github.com/mattermost/mattermost-server/model"
 	"github.com/mattermost/mattermost-server/plugin"
+	"github.com/pkg/errors"
 	"github.com/robfig/cron"
 	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
-	"google.golang.org/api/calendar/v3"
 )
 
 const (
@@ -24,8 +26,30 @@ const (
 	calendarTokenKey = "_calendartoken"
 	CalendarIconURL  = "plugins/google-calendar/Google_Calendar_Logo.png"
 	BotUsername      = "Calendar Plugin"
-	postPretext      = "Event starting in 10 min"
 	welcomeMessage   = "Welcome to Google Calendar Plugin"
+	goodbyeMessage   = "Your Google Calendar has been disconnected. You will no longer receive reminders."
+
+	// authorizationRevokedMessage is formatted with the site URL.
+	authorizationRevokedMessage = "Your Google Calendar authorization was revoked or has expired, so your calendar has been disconnected and you will no longer receive reminders. [Click here to reconnect your Google Calendar.](%s/plugins/google-calendar/oauth/connect)"
+
+	caldavCredentialsRejectedMessage = "Your CalDAV server rejected your username or password, so your calendar has been disconnected and you will no longer receive reminders. Reconnect it with `/google-calendar connect caldav`."
+
+	// watchRenewalWindow is how long before its expiry a watch channel is replaced.
+	watchRenewalWindow = time.Hour
+
+	// syncWindow is how far ahead events are stored. It covers the longest
+	// reminder lead time until the next full sync.
+	syncWindow = maxReminderLeadTime + fullSyncInterval
+
+	// fullSyncInterval is how often the events of a calendar are fully synced.
+	fullSyncInterval = 24 * time.Hour
+
+	// pollInterval is how often calendars that can't be watched are synced.
+	pollInterval = 5 * time.Minute
+
+	// reminderGracePeriod is how long after the start of an event a reminder
+	// that was missed, e.g. because of a late tick, is still posted.
+	reminderGracePeriod = 5 * time.Minute
 )
 
 type Plugin struct {
@@ -39,6 +63,33 @@ type Plugin struct {
 	configuration *configuration
 
 	BotUserID string
+
+	// postAsConfiguredUser is set when the plugin posts as the user configured in
+	// Username because its bot account couldn't be set up.
+	postAsConfiguredUser bool
+
+	// nodeID identifies this instance of the plugin when competing for the scheduler lease.
+	nodeID string
+
+	// cron runs the plugin-wide scheduler, see startScheduler.
+	cron *cron.Cron
+
+	// clock tells the current time, see now.
+	clock clock
+
+	// restoreLock guards restored, which is set once this node restored the
+	// connected users since it started, see restoreConnectedUsersOnce.
+	restoreLock sync.Mutex
+	restored    bool
+
+	// connectedUsersLock serializes the updates of the connected users index, see
+	// addConnectedUser.
+	connectedUsersLock sync.Mutex
+
+	// userLocks serializes the updates of the calendar information of each user,
+	// see updateCalendarInfo.
+	userLocksLock sync.Mutex
+	userLocks     map[string]*sync.Mutex
 }
 
 // UserInfo captures the UserID and authentication token of a user.
@@ -46,24 +97,53 @@ type UserInfo struct {
 	UserID    string
 	Token     *oauth2.Token
 	ChannelID string
+
+	// CalDAV is set instead of Token for users who connected a CalDAV account.
+	CalDAV *CalDAVAccount
 }
 
-// CalendarInfo captures the list of events and details of the last event update.
+// CalendarInfo captures the list of events of the calendars the user subscribed to
+// and the sync and watch details of each of these calendars.
 type CalendarInfo struct {
-	LastEventUpdate     string
-	Events              []EventInfo
-	CalendarWatchToken  string
-	CalendarWatchExpiry int64
+	// Version is the format version of the stored record, see migrateCalendarInfo.
+	Version   int
+	Events    []EventInfo
+	Calendars []SubscribedCalendar
+
+	// LastDigestDate is the local date, formatted as "2006-01-02", of the last daily digest sent.
+	LastDigestDate string
+
+	// StatusBeforeMeeting is the status of the user before the plugin set it to
+	// MeetingStatus for an ongoing meeting, and StatusBeforeMeetingManual whether
+	// the user set it themselves. They are empty outside of meetings.
+	StatusBeforeMeeting       string
+	StatusBeforeMeetingManual bool
+	MeetingStatus             string
 }
 
 // EventInfo captures some of the attributes of a Calendar event.
+// StartTime and EndTime are RFC3339 instants, except for all-day events where
+// they are dates formatted as "2006-01-02", with the end date being exclusive.
 type EventInfo struct {
-	Id        string
-	HtmlLink  string
-	StartTime string
-	EndTime   string
-	Summary   string
-	Status    string
+	Id         string
+	CalendarID string
+	HtmlLink   string
+	StartTime  string
+	EndTime    string
+	AllDay     bool
+	Summary    string
+	Status     string
+
+	// ResponseStatus is the response of the user to the event, or an empty string
+	// if the user isn't invited to it, e.g. as sole organizer.
+	ResponseStatus string
+
+	// Transparent is true for events that don't block time, i.e. marked as free.
+	Transparent bool
+
+	// SentReminders lists the lead times, in minutes, of the reminders already
+	// posted for this occurrence of the event.
+	SentReminders []int
 }
 
 // OnActivate is triggered as soon as the plugin is enabled.
@@ -76,12 +156,35 @@ func (p *Plugin) OnActivate() error {
 
 	p.API.RegisterCommand(getCommand())
 
-	user, err := p.API.GetUserByUsername(config.Username)
-	if err != nil {
-		return fmt.Errorf("Unable to find user with configured username: %v", config.Username)
+	botUserID, err := p.ensureBot()
+	if err == nil {
+		p.BotUserID = botUserID
+		p.postAsConfiguredUser = false
+	} else if config.Username != "" {
+		mlog.Warn("Unable to set up the bot account, posting as the configured user instead", mlog.Err(err))
+
+		user, appErr := p.API.GetUserByUsername(config.Username)
+		if appErr != nil {
+			return fmt.Errorf("Unable to find user with configured username: %v", config.Username)
+		}
+
+		p.BotUserID = user.Id
+		p.postAsConfiguredUser = true
+	} else {
+		return err
 	}
 
-	p.BotUserID = user.Id
+	p.startScheduler()
+
+	// Don't wait for the first tick to restore the connected users.
+	go p.runScheduledTasks()
+
+	return nil
+}
+
+// OnDeactivate is triggered when the plugin is disabled.
+func (p *Plugin) OnDeactivate() error {
+	p.stopScheduler()
 
 	return nil
 }
@@ -90,12 +193,17 @@ func (p *Plugin) getOAuthConfig() *oauth2.Config {
 	pluginConfig := p.getConfiguration()
 	config := p.API.GetConfig()
 
+	scopes := []string{"https://www.googleapis.com/auth/calendar.readonly", "https://www.googleapis.com/auth/calendar.events.readonly"}
+	if pluginConfig.EnableWriteAccess {
+		scopes = []string{"https://www.googleapis.com/auth/calendar.readonly", "https://www.googleapis.com/auth/calendar.events"}
+	}
+
 	return &oauth2.Config{
 		ClientID:     pluginConfig.CalendarOAuthClientID,
 		ClientSecret: pluginConfig.CalendarOAuthClientSecret,
 		RedirectURL:  fmt.Sprintf("%s/plugins/google-calendar/oauth/complete", *config.ServiceSettings.SiteURL),
-		Scopes:       []string{"https://www.googleapis.com/auth/calendar.readonly", "https://www.googleapis.com/auth/calendar.events.readonly"},
-		Endpoint:     google.Endpoint,
+		Scopes:       scopes,
+		Endpoint:     pluginConfig.oauthEndpoint(),
 	}
 }
 
@@ -111,6 +219,45 @@ func (p *Plugin) ExecuteCommand(c *plugin.Context, args *model.CommandArgs) (*mo
 		return &model.CommandResponse{}, nil
 	}
 
+	if action == "settings" {
+		return p.executeSettingsCommand(args, split[2:]), nil
+	}
+
+	if action == "today" || action == "tomorrow" || action == "week" {
+		return p.executeAgendaCommand(args, action, split[2:]), nil
+	}
+
+	if action == "create" {
+		return p.executeCreateCommand(args, split[2:]), nil
+	}
+
+	if action == "meet-channel" {
+		return p.executeMeetChannelCommand(args, split[2:]), nil
+	}
+
+	if action == "availability" {
+		return p.executeAvailabilityCommand(args, split[2:]), nil
+	}
+
+	if action == "channel" {
+		return p.executeChannelCommand(args, split[2:]), nil
+	}
+
+	if action == "calendars" {
+		return p.executeCalendarsCommand(args, split[2:]), nil
+	}
+
+	if action == "disconnect" {
+		if err := p.disconnectUser(args.UserId); err != nil {
+			return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, "Encountered an error disconnecting your Google Calendar."), nil
+		}
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, "Disconnected your Google Calendar."), nil
+	}
+
+	if action == "connect" && len(split) > 2 && split[2] == "caldav" {
+		return p.executeConnectCalDAVCommand(args), nil
+	}
+
 	if action == "connect" {
 		config := p.API.GetConfig()
 		if config.ServiceSettings.SiteURL == nil {
@@ -125,18 +272,12 @@ func (p *Plugin) ExecuteCommand(c *plugin.Context, args *model.CommandArgs) (*mo
 
 func (p *Plugin) createBotDMPost(userInfo *UserInfo) *model.AppError {
 	post := &model.Post{
-		UserId:    p.BotUserID,
 		ChannelId: userInfo.ChannelID,
 		Message:   welcomeMessage,
 		Type:      "custom_git_welcome",
-		Props: map[string]interface{}{
-			"from_webhook":      "true",
-			"override_username": BotUsername,
-			"override_icon_url": CalendarIconURL,
-		},
 	}
 
-	if _, err := p.API.CreatePost(post); err != nil {
+	if _, err := p.createBotPost(post); err != nil {
 		mlog.Error("Error while creating bot welcome post" + err.Error())
 		return err
 	}
@@ -154,245 +295,657 @@ func (p *Plugin) getDirectChannel(userInfo *UserInfo) (string, error) {
 	return channel.Id, nil
 }
 
-func (p *Plugin) createAPostForEvent(userID string, e EventInfo) error {
-	event := generateSlackAttachment(e)
-	userInfo, err := p.getUserInfo(userID)
-
-	if err != nil {
-		mlog.Error("Error fetching user details" + err.Error())
-		return err
-	}
+func (p *Plugin) createAPostForEvent(userInfo *UserInfo, e EventInfo, calendarName string, now time.Time) error {
+	event := generateSlackAttachment(e, calendarName, now)
+	p.addRSVP(event, userInfo.UserID, e)
 
-	p.API.CreatePost(&model.Post{
+	if _, appErr := p.createBotPost(&model.Post{
 		ChannelId: userInfo.ChannelID,
 		Type:      model.POST_SLACK_ATTACHMENT,
-		UserId:    p.BotUserID,
 		Props: map[string]interface{}{
-			"from_webhook":  "true",
-			"use_user_icon": "true",
-			"attachments":   []*model.SlackAttachment{event},
+			"attachments": []*model.SlackAttachment{event},
 		},
-	})
+	}); appErr != nil {
+		return appErr
+	}
 	return nil
 }
 
-// createCalendarService initialises and returns a Google Calendar service
-func (p *Plugin) createCalendarService(u *UserInfo) (*calendar.Service, error) {
-	googleOauthConfig := p.getOAuthConfig()
-	tokenSource := googleOauthConfig.TokenSource(context.TODO(), u.Token)
-	newToken, err := tokenSource.Token()
-	if err != nil {
-		mlog.Error("Error fetching token from token source" + err.Error())
-		return nil, err
+// getUserLocation returns the timezone configured by the user in Mattermost,
+// falling back to UTC if it is unset or unknown.
+func (p *Plugin) getUserLocation(userID string) *time.Location {
+	user, appErr := p.API.GetUser(userID)
+	if appErr != nil {
+		mlog.Error("Error fetching user to determine the timezone " + appErr.Error())
+		return time.UTC
 	}
 
-	if newToken.AccessToken != u.Token.AccessToken {
-		u.Token = newToken
-		err := p.storeUserInfo(u)
-		if err != nil {
-			mlog.Error("Error storing the new access token " + err.Error())
-			return nil, err
-		}
+	timezone := user.Timezone["manualTimezone"]
+	if user.Timezone["useAutomaticTimezone"] == "true" {
+		timezone = user.Timezone["automaticTimezone"]
 	}
 
-	client := oauth2.NewClient(context.TODO(), tokenSource)
-	calendarService, err := calendar.New(client)
+	location, err := time.LoadLocation(timezone)
 	if err != nil {
-		return nil, err
+		return time.UTC
 	}
-	return calendarService, nil
+	return location
 }
 
-func (p *Plugin) subscribeToCalendar(u *UserInfo) {
-	p.processEventsFromCalendar(u)
+// connectUser stores the credentials of a user who connected their calendar,
+// subscribes them to their primary calendar and welcomes them. Users who
+// reconnect keep their subscriptions and the reminders already sent, unless they
+// switched between Google Calendar and CalDAV, and their calendars are synced
+// again with the new credentials.
+func (p *Plugin) connectUser(userInfo *UserInfo) error {
+	if _, err := p.getDirectChannel(userInfo); err != nil {
+		return err
+	}
+
+	stored, err := p.getStoredUserInfo(userInfo.UserID)
+	if err != nil {
+		return err
+	}
+	if stored != nil {
+		p.stopPreviousWatchChannels(stored)
+	}
 
-	p.setupCalendarWatchService(u)
+	if err := p.storeUserInfo(userInfo); err != nil {
+		mlog.Error("Error storing the user information " + err.Error())
+		return err
+	}
 
-	cron := cron.New()
-	cron.AddFunc("@every 1m", func() {
-		// checkEvents method gets called every minute to check if the
-		// start time of any event is after 10 min.
-		p.checkEvents(u.UserID)
+	switched := stored != nil && (stored.CalDAV == nil) != (userInfo.CalDAV == nil)
+	calendarInfo, err := p.updateCalendarInfo(userInfo.UserID, func(calendarInfo *CalendarInfo) bool {
+		if switched {
+			calendarInfo.Calendars = nil
+			calendarInfo.Events = nil
+		}
+		for index := range calendarInfo.Calendars {
+			calendarInfo.Calendars[index] = SubscribedCalendar{
+				ID:           calendarInfo.Calendars[index].ID,
+				Summary:      calendarInfo.Calendars[index].Summary,
+				ChannelsOnly: calendarInfo.Calendars[index].ChannelsOnly,
+				Invitations:  calendarInfo.Calendars[index].Invitations,
+			}
+		}
+		return true
 	})
-	cron.Start()
+	if err != nil {
+		return err
+	}
+
+	if calendarInfo == nil {
+		if err := p.storeCalendarInfo(userInfo.UserID, &CalendarInfo{}); err != nil {
+			return err
+		}
+	} else {
+		for _, subscribedCalendar := range calendarInfo.Calendars {
+			if err := p.updateCalendarEvents(userInfo, subscribedCalendar.ID); err != nil {
+				mlog.Error("Error syncing a subscribed calendar", mlog.String("user_id", userInfo.UserID), mlog.String("calendar_id", subscribedCalendar.ID), mlog.Err(err))
+				continue
+			}
+			if err := p.setupCalendarWatchService(userInfo, subscribedCalendar.ID); err != nil {
+				mlog.Error("Error watching a subscribed calendar", mlog.String("user_id", userInfo.UserID), mlog.String("calendar_id", subscribedCalendar.ID), mlog.Err(err))
+			}
+		}
+	}
+
+	p.subscribeToCalendar(userInfo)
+
+	p.createBotDMPost(userInfo)
+
+	return nil
 }
 
-func (p *Plugin) setupCalendarWatchService(u *UserInfo) error {
-	calendarInfo, calendarInfoErr := p.getCalendarInfo(u.UserID)
-	if calendarInfoErr != nil {
-		return calendarInfoErr
+// stopPreviousWatchChannels stops the watch channels of a user who reconnects,
+// with their previous credentials. Channels that can't be stopped, e.g. because
+// the previous authorization was revoked, stop when they expire, and their
+// notifications are rejected once they are replaced.
+func (p *Plugin) stopPreviousWatchChannels(stored *storedUserInfo) {
+	calendarInfo, err := p.getCalendarInfo(stored.UserID)
+	if err != nil || calendarInfo == nil {
+		return
 	}
 
-	calendarService, calendarServiceErr := p.createCalendarService(u)
-	if calendarServiceErr != nil {
-		return calendarServiceErr
+	previous, err := stored.decrypt(p.getConfiguration().Secret)
+	if err != nil {
+		return
 	}
 
-	config := p.API.GetConfig()
+	var provider CalendarProvider
+	for _, subscribedCalendar := range calendarInfo.Calendars {
+		if subscribedCalendar.WatchToken == "" || subscribedCalendar.WatchResourceID == "" {
+			continue
+		}
+		if provider == nil {
+			if provider, err = p.newCalendarProvider(previous); err != nil {
+				mlog.Info("Unable to stop the previous watch channels", mlog.String("user_id", stored.UserID), mlog.Err(err))
+				return
+			}
+		}
+		if err := provider.StopWatch(subscribedCalendar.WatchToken, subscribedCalendar.WatchResourceID); err != nil {
+			mlog.Error("Error stopping the previous watch channel " + err.Error())
+		}
+	}
+}
 
-	uuid := uuid.New().String()
+// subscribeToCalendar subscribes the user to their primary calendar and adds them
+// to the users checked by the scheduler.
+func (p *Plugin) subscribeToCalendar(u *UserInfo) {
+	if _, err := p.addCalendarSubscription(u, "primary", false); err != nil {
+		mlog.Error("Error subscribing to the primary calendar " + err.Error())
+	}
 
-	eventsWatchCall := calendarService.Events.Watch("primary", &calendar.Channel{
-		Address: fmt.Sprintf("%s/plugins/google-calendar/watch?userID=%s", *config.ServiceSettings.SiteURL, u.UserID),
-		Id:      uuid,
-		Type:    "web_hook",
-	})
+	if err := p.addConnectedUser(u.UserID); err != nil {
+		mlog.Error("Error adding the user to the connected users " + err.Error())
+	}
+}
 
-	channel, err := eventsWatchCall.Do()
+// disconnectUser undoes connecting the user's calendar: it stops the reminders and
+// the watch channel, revokes the tokens granted by the user and deletes what the
+// plugin stored about their calendar. The user's settings are kept.
+func (p *Plugin) disconnectUser(userID string) error {
+	userInfo, err := p.getUserInfo(userID)
 	if err != nil {
 		return err
 	}
 
-	calendarInfo.CalendarWatchToken = uuid
-	calendarInfo.CalendarWatchExpiry = channel.Expiration
-	p.storeCalendarInfo(u.UserID, calendarInfo)
+	if err := p.removeConnectedUser(userID); err != nil {
+		return err
+	}
+
+	if userInfo == nil {
+		return nil
+	}
+
+	if calendarInfo, err := p.getCalendarInfo(userID); err == nil && calendarInfo != nil {
+		for _, subscribedCalendar := range calendarInfo.Calendars {
+			if err := p.stopCalendarWatchService(userInfo, subscribedCalendar); err != nil {
+				mlog.Error("Error stopping the watch channel " + err.Error())
+			}
+		}
+	}
+
+	if err := p.revokeToken(userInfo); err != nil {
+		mlog.Error("Error revoking the token " + err.Error())
+	}
+
+	if err := p.deleteUserData(userID); err != nil {
+		return err
+	}
+
+	if _, err := p.createBotPost(&model.Post{
+		ChannelId: userInfo.ChannelID,
+		Message:   goodbyeMessage,
+	}); err != nil {
+		mlog.Error("Error while creating bot goodbye post " + err.Error())
+	}
 
 	return nil
 }
 
-func (p *Plugin) setupWatchRenewal(userID string) error {
-	calendarInfo, calendarInfoErr := p.getCalendarInfo(userID)
-	if calendarInfoErr != nil {
-		return calendarInfoErr
+// deleteUserData deletes what the plugin stored about the user's calendar, along
+// with the channel subscriptions relying on their credentials. The status set for
+// an ongoing meeting is restored.
+func (p *Plugin) deleteUserData(userID string) error {
+	if _, err := p.removeChannelSubscriptions(func(s ChannelSubscription) bool {
+		return s.UserID == userID
+	}); err != nil {
+		mlog.Error("Error removing the channel subscriptions " + err.Error())
 	}
 
-	userInfo, userInfoErr := p.getUserInfo(userID)
-	if userInfoErr != nil {
-		return userInfoErr
+	if calendarInfo, err := p.getCalendarInfo(userID); err == nil && calendarInfo != nil {
+		p.updateMeetingStatus(userID, calendarInfo, &UserSettings{}, p.now())
 	}
 
-	diff := calendarInfo.CalendarWatchExpiry - (time.Now().UnixNano()/int64(time.Millisecond) + 60000)
-	if diff <= 60000 {
-		time.AfterFunc(time.Millisecond*time.Duration(diff), func() {
-			p.setupCalendarWatchService(userInfo)
-		})
+	unlock := p.lockUser(userID)
+	appErr := p.API.KVDelete(userID + calendarTokenKey)
+	unlock()
+	if appErr != nil {
+		return appErr
 	}
+
+	if err := p.API.KVDelete(userID + userTokenKey); err != nil {
+		return err
+	}
+
 	return nil
 }
 
-// checkIfTheEventAlreadyExists checks if event with given eventID already exists
-func (p *Plugin) checkIfTheEventAlreadyExists(eventID, userID string) bool {
-	calendarInfo, _ := p.getCalendarInfo(userID)
-	for _, event := range calendarInfo.Events {
-		if event.Id == eventID {
-			return true
-		}
-	}
-	return false
+// isAuthorizationError returns whether err shows the user's authorization was revoked or expired.
+func isAuthorizationError(err error) bool {
+	return errors.Cause(err) == errAuthorizationRevoked
 }
 
-func (p *Plugin) fetchEventsFromCalendar(u *UserInfo) (*calendar.Events, error) {
-	calendarService, _ := p.createCalendarService(u)
+// handleAuthorizationError disconnects the user if err shows their authorization
+// was revoked or expired, and asks them to reconnect. The watch channels can't be
+// stopped without a valid authorization and stop when they expire.
+func (p *Plugin) handleAuthorizationError(u *UserInfo, err error) {
+	if !isAuthorizationError(err) {
+		return
+	}
 
-	var calendarInfo *CalendarInfo
-	var calendarEvents *calendar.Events
-	var err error
+	// Only the first failure disconnects the user, so they are notified once.
+	if stored, storedErr := p.getStoredUserInfo(u.UserID); storedErr != nil || stored == nil {
+		return
+	}
+
+	mlog.Warn("Calendar authorization was revoked or expired, disconnecting the user", mlog.String("user_id", u.UserID), mlog.Err(err))
 
-	if info, _ := p.getCalendarInfo(u.UserID); info != nil {
-		calendarInfo = info
+	if err := p.removeConnectedUser(u.UserID); err != nil {
+		mlog.Error("Error removing the user from the connected users " + err.Error())
 	}
 
-	if calendarInfo.LastEventUpdate != "" {
-		calendarEvents, err = calendarService.Events.List("primary").UpdatedMin(calendarInfo.LastEventUpdate).TimeMax(time.Now().Add(time.Hour * 1).Format(time.RFC3339)).Do()
-	} else {
-		calendarEvents, err = calendarService.Events.List("primary").TimeMin(time.Now().Format(time.RFC3339)).TimeMax(time.Now().Add(time.Hour * 1).Format(time.RFC3339)).Do()
+	if err := p.deleteUserData(u.UserID); err != nil {
+		mlog.Error("Error deleting the user data " + err.Error())
+		return
 	}
 
+	config := p.API.GetConfig()
+	message := fmt.Sprintf(authorizationRevokedMessage, *config.ServiceSettings.SiteURL)
+	if u.CalDAV != nil {
+		message = caldavCredentialsRejectedMessage
+	}
+	if _, appErr := p.createBotPost(&model.Post{
+		ChannelId: u.ChannelID,
+		Message:   message,
+	}); appErr != nil {
+		mlog.Error("Error while creating the reconnect post " + appErr.Error())
+	}
+}
+
+// stopCalendarWatchService stops the watch channel of a calendar, if any.
+func (p *Plugin) stopCalendarWatchService(u *UserInfo, subscribedCalendar SubscribedCalendar) error {
+	if subscribedCalendar.WatchToken == "" {
+		return nil
+	}
+
+	if subscribedCalendar.WatchResourceID == "" {
+		return errors.New("the watch channel was created without storing its resource ID and will stop when it expires")
+	}
+
+	provider, err := p.getCalendarProvider(u)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return calendarEvents, nil
+	return provider.StopWatch(subscribedCalendar.WatchToken, subscribedCalendar.WatchResourceID)
 }
 
-func (p *Plugin) processEventsFromCalendar(u *UserInfo) error {
-	var calendarInfo *CalendarInfo
-	info, err := p.getCalendarInfo(u.UserID)
+// revokeToken revokes the access granted by the user to the plugin. Revoking the
+// refresh token also revokes the access tokens issued with it. CalDAV passwords
+// can only be revoked by the user on their server.
+func (p *Plugin) revokeToken(u *UserInfo) error {
+	if u.Token == nil {
+		return nil
+	}
 
-	if info != nil {
-		calendarInfo = info
+	token := u.Token.RefreshToken
+	if token == "" {
+		token = u.Token.AccessToken
 	}
 
+	resp, err := http.PostForm(p.getConfiguration().oauthRevokeURL(), url.Values{"token": {token}})
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("revoking the token failed with status %d", resp.StatusCode)
+	}
 
-	calendarEvents, err := p.fetchEventsFromCalendar(u)
+	return nil
+}
+
+// setupCalendarWatchService creates a channel notifying the plugin of changes to
+// the events of a calendar the user subscribed to, replacing the previous one.
+// Calendars that can't be watched are polled instead.
+func (p *Plugin) setupCalendarWatchService(u *UserInfo, calendarID string) error {
+	provider, err := p.getCalendarProvider(u)
 	if err != nil {
 		return err
 	}
 
-	if len(calendarEvents.Items) > 0 {
-		for _, event := range calendarEvents.Items {
-			calendarInfo.Events = append(calendarInfo.Events, EventInfo{
-				Id:        event.Id,
-				HtmlLink:  event.HtmlLink,
-				StartTime: formatTime(event.Start.DateTime),
-				EndTime:   formatTime(event.End.DateTime),
-				Summary:   event.Summary,
-				Status:    event.Status,
-			})
+	config := p.API.GetConfig()
+
+	uuid := uuid.New().String()
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	token := hex.EncodeToString(secret)
+
+	address := fmt.Sprintf("%s/plugins/google-calendar/watch?userID=%s", *config.ServiceSettings.SiteURL, u.UserID)
+	channel, err := provider.Watch(calendarID, uuid, token, address)
+	polled := errors.Cause(err) == errWatchNotSupported
+	if err != nil && !polled {
+		return err
+	}
+
+	var previous *SubscribedCalendar
+	if _, err := p.updateCalendarInfo(u.UserID, func(calendarInfo *CalendarInfo) bool {
+		subscribedCalendar := calendarInfo.getCalendar(calendarID)
+		if subscribedCalendar == nil {
+			return false
+		}
+
+		stored := *subscribedCalendar
+		previous = &stored
+		subscribedCalendar.Polled = polled
+		subscribedCalendar.WatchToken = ""
+		subscribedCalendar.WatchExpiry = 0
+		subscribedCalendar.WatchResourceID = ""
+		subscribedCalendar.WatchSecret = ""
+		if !polled {
+			subscribedCalendar.WatchToken = channel.ID
+			subscribedCalendar.WatchExpiry = channel.Expiry
+			subscribedCalendar.WatchResourceID = channel.ResourceID
+			subscribedCalendar.WatchSecret = token
+		}
+		return true
+	}); err != nil {
+		return err
+	}
+
+	// The calendar was unsubscribed in the meantime, so the new channel isn't needed.
+	if previous == nil {
+		if !polled {
+			if err := provider.StopWatch(channel.ID, channel.ResourceID); err != nil {
+				mlog.Error("Error stopping the watch channel " + err.Error())
+			}
 		}
-		calendarInfo.LastEventUpdate = time.Now().Format(time.RFC3339)
-		p.storeCalendarInfo(u.UserID, calendarInfo)
+		return nil
+	}
+
+	if err := p.stopCalendarWatchService(u, *previous); err != nil {
+		mlog.Error("Error stopping the previous watch channel " + err.Error())
 	}
 	return nil
 }
 
-func (p *Plugin) updateCalendarEvents(u *UserInfo, calendarInfo *CalendarInfo) error {
-	calendarEvents, err := p.fetchEventsFromCalendar(u)
+// setupWatchRenewal replaces the watch channels of the user's calendars before
+// they expire, and those created before their token was stored, whose
+// notifications are rejected. A calendar that can't be watched doesn't keep the others from
+// being renewed; it returns the last error encountered.
+func (p *Plugin) setupWatchRenewal(userID string) error {
+	calendarInfo, calendarInfoErr := p.getCalendarInfo(userID)
+	if calendarInfoErr != nil || calendarInfo == nil {
+		return calendarInfoErr
+	}
+
+	userInfo, userInfoErr := p.getUserInfo(userID)
+	if userInfoErr != nil || userInfo == nil {
+		return userInfoErr
+	}
+
+	var lastErr error
+	for _, subscribedCalendar := range calendarInfo.Calendars {
+		if subscribedCalendar.Polled {
+			continue
+		}
+
+		expiry := time.Unix(0, subscribedCalendar.WatchExpiry*int64(time.Millisecond))
+		if expiry.Sub(p.now()) > watchRenewalWindow && subscribedCalendar.WatchSecret != "" {
+			continue
+		}
+		if err := p.setupCalendarWatchService(userInfo, subscribedCalendar.ID); err != nil {
+			if isAuthorizationError(err) {
+				return err
+			}
+			mlog.Warn("Unable to renew a watch channel", mlog.String("user_id", userID), mlog.String("calendar_id", subscribedCalendar.ID), mlog.Err(err))
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// newEventInfo captures the attributes of an event that the plugin stores.
+func newEventInfo(event *Event) EventInfo {
+	return EventInfo{
+		Id:        event.ID,
+		HtmlLink:  event.HTMLLink,
+		StartTime: event.StartTime,
+		EndTime:   event.EndTime,
+		AllDay:    event.AllDay,
+		Summary:   event.Summary,
+		Status:    event.Status,
+
+		ResponseStatus: event.ResponseStatus,
+		Transparent:    event.Transparent,
+	}
+}
+
+// updateCalendarEvents fetches the changes to the events of a calendar the user
+// subscribed to and applies them to the stored events. Only events taking place
+// within syncWindow are stored.
+func (p *Plugin) updateCalendarEvents(u *UserInfo, calendarID string) error {
+	calendarInfo, err := p.getCalendarInfo(u.UserID)
+	if err != nil || calendarInfo == nil {
+		return err
+	}
+
+	subscribedCalendar := calendarInfo.getCalendar(calendarID)
+	if subscribedCalendar == nil {
+		return nil
+	}
+
+	// A full sync is done regularly, even with a valid sync token, to store the
+	// events that entered the sync window since the last one.
+	syncToken := subscribedCalendar.SyncToken
+	if p.now().Sub(time.Unix(subscribedCalendar.LastFullSync, 0)) > fullSyncInterval {
+		syncToken = ""
+	}
+
+	provider, err := p.getCalendarProvider(u)
 	if err != nil {
 		return err
 	}
 
-	for _, event := range calendarEvents.Items {
-		if event.Status == "cancelled" {
-			calendarInfo, _ = p.removeAnEvent(u.UserID, event)
-		} else if p.checkIfTheEventAlreadyExists(event.Id, u.UserID) == true {
-			e := EventInfo{
-				Id:        event.Id,
-				HtmlLink:  event.HtmlLink,
-				StartTime: formatTime(event.Start.DateTime),
-				EndTime:   formatTime(event.End.DateTime),
-				Summary:   event.Summary,
-				Status:    event.Status,
-			}
-			calendarInfo, _ = p.updateEvent(event.Id, u.UserID, e)
-		} else {
-			calendarInfo.Events = append(calendarInfo.Events, EventInfo{
-				Id:        event.Id,
-				HtmlLink:  event.HtmlLink,
-				StartTime: formatTime(event.Start.DateTime),
-				EndTime:   formatTime(event.End.DateTime),
-				Summary:   event.Summary,
-				Status:    event.Status,
+	events, nextSyncToken, err := provider.SyncEvents(calendarID, syncToken, p.now())
+	if errors.Cause(err) == errSyncTokenExpired {
+		mlog.Info("Sync token expired, doing a full sync", mlog.String("user_id", u.UserID), mlog.String("calendar_id", calendarID))
+		syncToken = ""
+		events, nextSyncToken, err = provider.SyncEvents(calendarID, syncToken, p.now())
+	}
+	if err != nil {
+		if errors.Cause(err) == errRateLimited {
+			p.updateCalendarInfo(u.UserID, func(calendarInfo *CalendarInfo) bool {
+				subscribedCalendar := calendarInfo.getCalendar(calendarID)
+				if subscribedCalendar == nil || subscribedCalendar.SyncPending {
+					return false
+				}
+				subscribedCalendar.SyncPending = true
+				return true
 			})
 		}
-		calendarInfo.LastEventUpdate = time.Now().Format(time.RFC3339)
-		p.storeCalendarInfo(u.UserID, calendarInfo)
+		p.handleAuthorizationError(u, err)
+		return err
+	}
+
+	// The changes are applied to the calendar information as stored now, as it
+	// may have been updated while the events were fetched.
+	now := p.now()
+	invitations := []EventInfo{}
+	calendarInfo, err = p.updateCalendarInfo(u.UserID, func(calendarInfo *CalendarInfo) bool {
+		subscribedCalendar := calendarInfo.getCalendar(calendarID)
+		if subscribedCalendar == nil {
+			return false
+		}
+
+		subscribedCalendar.LastSync = now.Unix()
+		subscribedCalendar.SyncPending = false
+		if syncToken == "" {
+			calendarInfo.removeCalendarEvents(calendarID, events)
+			subscribedCalendar.LastFullSync = now.Unix()
+			subscribedCalendar.Invitations = []string{}
+		}
+
+		for _, event := range events {
+			e := newEventInfo(event)
+			e.CalendarID = calendarID
+
+			// Invitations pending when the calendar is fully synced are recorded
+			// without notifying the user, who may have seen them already, as are
+			// those of calendars only synced for channel subscriptions.
+			if isNewInvitation(event) && !subscribedCalendar.hasInvitation(event.ID) {
+				subscribedCalendar.Invitations = append(subscribedCalendar.Invitations, event.ID)
+				if syncToken != "" && !subscribedCalendar.ChannelsOnly {
+					invitations = append(invitations, e)
+				}
+			}
+
+			if event.Status == "cancelled" || !inSyncWindow(e, now) {
+				calendarInfo.removeEvent(calendarID, event.ID)
+				continue
+			}
+			calendarInfo.updateEvent(e)
+		}
+
+		subscribedCalendar.SyncToken = nextSyncToken
+		return true
+	})
+	if err != nil || calendarInfo == nil {
+		return err
+	}
+
+	for _, e := range invitations {
+		if err := p.createInvitationPost(u, e, calendarInfo.calendarName(calendarID)); err != nil {
+			mlog.Error("Error posting an invitation " + err.Error())
+		}
 	}
 	return nil
 }
 
-// checkEvents checks if there is any event 10 min after the current time.
-// If there is an event, if triggers a post for it.
+// inSyncWindow returns whether an event takes place between now and the end of the sync window.
+func inSyncWindow(e EventInfo, now time.Time) bool {
+	start, end, err := eventTimes(e, now.Location())
+	if err != nil {
+		return false
+	}
+	return end.After(now) && start.Before(now.Add(syncWindow))
+}
+
+// checkEvents checks if a reminder is due for any of the user's events.
+// If there is one, it triggers a post for it. It also updates the user's status
+// when a meeting starts or ends.
 func (p *Plugin) checkEvents(userID string) error {
-	calendarInfo, err := p.getCalendarInfo(userID)
+	settings, err := p.getUserSettings(userID)
+	if err != nil {
+		return err
+	}
+
+	// The user information is fetched before locking the calendar information,
+	// as users whose credentials can't be decrypted are disconnected.
+	userInfo, err := p.getUserInfo(userID)
 	if err != nil {
+		p.handleUserInfoError(userID, err)
 		return err
 	}
-	for _, e := range calendarInfo.Events {
-		afterTenMinutes := time.Now().Add(time.Minute * 10).Format("3:04PM")
-		if afterTenMinutes == e.StartTime {
-			_ = p.createAPostForEvent(userID, e)
+	if userInfo == nil {
+		return nil
+	}
+
+	now := p.now().In(p.getUserLocation(userID))
+	calendarInfo, err := p.updateCalendarInfo(userID, func(calendarInfo *CalendarInfo) bool {
+		changed := false
+		for index := range calendarInfo.Events {
+			e := &calendarInfo.Events[index]
+			if subscribedCalendar := calendarInfo.getCalendar(e.CalendarID); subscribedCalendar != nil && subscribedCalendar.ChannelsOnly {
+				continue
+			}
+
+			dueLeadTimes := dueReminderLeadTimes(*e, settings, now)
+			if len(dueLeadTimes) == 0 {
+				continue
+			}
+
+			// A single reminder is posted when several have become due at once,
+			// e.g. after a skipped tick. It's retried on the next tick if it
+			// can't be posted.
+			if err := p.createAPostForEvent(userInfo, *e, calendarInfo.calendarName(e.CalendarID), now); err != nil {
+				mlog.Error("Error posting a reminder", mlog.String("user_id", userID), mlog.Err(err))
+				continue
+			}
+			e.SentReminders = append(e.SentReminders, dueLeadTimes...)
+			changed = true
+		}
+
+		if p.updateMeetingStatus(userID, calendarInfo, settings, now) {
+			changed = true
 		}
+		return changed
+	})
+	if err != nil || calendarInfo == nil {
+		return err
 	}
+
 	p.setupWatchRenewal(userID)
 	return nil
 }
 
+// dueReminderLeadTimes returns the lead times whose reminder for the event is due
+// at the given time and hasn't been sent yet, ordered from the shortest one.
+// All-day events get a single reminder, with a lead time of 0, on the morning of
+// their first day.
+func dueReminderLeadTimes(e EventInfo, settings *UserSettings, now time.Time) []int {
+	start, _, err := eventTimes(e, now.Location())
+	if err != nil {
+		return nil
+	}
+
+	sent := map[int]bool{}
+	for _, leadTime := range e.SentReminders {
+		sent[leadTime] = true
+	}
+
+	if e.AllDay {
+		remindAt, err := time.ParseInLocation("2006-01-02 15:04", e.StartTime+" "+settings.AllDayReminderTime, now.Location())
+		if err != nil || sent[0] || now.Before(remindAt) || !now.Before(start.AddDate(0, 0, 1)) {
+			return nil
+		}
+		return []int{0}
+	}
+
+	if !now.Before(start.Add(reminderGracePeriod)) {
+		return nil
+	}
+
+	due := []int{}
+	for _, leadTime := range settings.ReminderLeadTimes {
+		remindAt := start.Add(-time.Duration(leadTime) * time.Minute)
+		if !sent[leadTime] && !now.Before(remindAt) {
+			due = append(due, leadTime)
+		}
+	}
+	sort.Ints(due)
+
+	return due
+}
+
+// storeUserInfo stores the user information with the token or the CalDAV
+// password encrypted.
 func (p *Plugin) storeUserInfo(userInfo *UserInfo) error {
-	jsonInfo, err := json.Marshal(userInfo)
+	secret := p.getConfiguration().Secret
+	stored := &storedUserInfo{
+		UserID:    userInfo.UserID,
+		ChannelID: userInfo.ChannelID,
+		KeyID:     keyID(secret),
+		CalDAV:    userInfo.CalDAV,
+	}
+
+	var err error
+	if userInfo.CalDAV != nil {
+		if stored.EncryptedPassword, err = encrypt(encryptionKey(secret), []byte(userInfo.CalDAV.Password)); err != nil {
+			return err
+		}
+	} else if stored.EncryptedToken, err = encryptToken(secret, userInfo.Token); err != nil {
+		return err
+	}
+
+	jsonInfo, err := json.Marshal(stored)
 	if err != nil {
 		return err
 	}
@@ -404,19 +957,117 @@ func (p *Plugin) storeUserInfo(userInfo *UserInfo) error {
 	return nil
 }
 
+// getUserInfo returns the user information with the token or the CalDAV
+// password decrypted, or nil if the user hasn't connected their calendar.
+// Records still encrypted with the previous secret are re-encrypted. Records that
+// can't be decrypted, e.g. because the secret changed while the plugin was
+// disabled, return an authorization error, which handleUserInfoError turns into
+// disconnecting the user. It doesn't do so itself, as it's called while the
+// calendar information of the user is locked.
 func (p *Plugin) getUserInfo(userID string) (*UserInfo, error) {
-	var userInfo UserInfo
+	stored, err := p.getStoredUserInfo(userID)
+	if err != nil || stored == nil {
+		return nil, err
+	}
+
+	config := p.getConfiguration()
+	if config.Secret == "" {
+		return nil, errors.New("the secret isn't configured")
+	}
+
+	userInfo, err := stored.decrypt(config.Secret)
+	if err == nil {
+		return userInfo, nil
+	}
+
+	if config.previousSecret != "" {
+		if userInfo, previousErr := stored.decrypt(config.previousSecret); previousErr == nil {
+			if err := p.storeUserInfo(userInfo); err != nil {
+				mlog.Error("Error re-encrypting a token", mlog.String("user_id", userID), mlog.Err(err))
+			}
+			return userInfo, nil
+		}
+	}
+
+	return nil, errors.Wrap(errAuthorizationRevoked, "the stored credentials can't be decrypted with the current secret: "+err.Error())
+}
+
+// handleUserInfoError disconnects the user if err, returned by getUserInfo, shows
+// their stored credentials can't be decrypted, and asks them to reconnect. It
+// mustn't be called while the calendar information of the user is locked.
+func (p *Plugin) handleUserInfoError(userID string, err error) {
+	if !isAuthorizationError(err) {
+		return
+	}
 
-	if info, err := p.API.KVGet(userID + userTokenKey); err != nil || info == nil {
+	stored, storedErr := p.getStoredUserInfo(userID)
+	if storedErr != nil || stored == nil {
+		return
+	}
+	p.handleAuthorizationError(&UserInfo{UserID: userID, ChannelID: stored.ChannelID, CalDAV: stored.CalDAV}, err)
+}
+
+// getStoredUserInfo returns the user information as stored, with the token encrypted.
+func (p *Plugin) getStoredUserInfo(userID string) (*storedUserInfo, error) {
+	var stored storedUserInfo
+
+	if info, appErr := p.API.KVGet(userID + userTokenKey); appErr != nil {
+		return nil, appErr
+	} else if info == nil {
+		return nil, nil
+	} else if err := json.Unmarshal(info, &stored); err != nil {
 		return nil, err
-	} else if err := json.Unmarshal(info, &userInfo); err != nil {
+	}
+
+	return &stored, nil
+}
+
+// lockUser locks the calendar information of the user, returning the function
+// unlocking it.
+func (p *Plugin) lockUser(userID string) func() {
+	p.userLocksLock.Lock()
+	if p.userLocks == nil {
+		p.userLocks = map[string]*sync.Mutex{}
+	}
+	lock := p.userLocks[userID]
+	if lock == nil {
+		lock = &sync.Mutex{}
+		p.userLocks[userID] = lock
+	}
+	p.userLocksLock.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
+// updateCalendarInfo applies update to the stored calendar information of the
+// user, and stores it if update returns true. Updates of the same user are
+// serialized, so that e.g. a sync triggered by a watch notification and the
+// reminders sent at the same time don't overwrite each other's changes. Updates
+// are only serialized within a node, as the key-value store can't compare and set. It
+// returns the updated calendar information, or nil if none is stored. update
+// mustn't call updateCalendarInfo, nor anything disconnecting the user.
+func (p *Plugin) updateCalendarInfo(userID string, update func(calendarInfo *CalendarInfo) bool) (*CalendarInfo, error) {
+	unlock := p.lockUser(userID)
+	defer unlock()
+
+	calendarInfo, err := p.getCalendarInfo(userID)
+	if err != nil || calendarInfo == nil {
 		return nil, err
 	}
 
-	return &userInfo, nil
+	if !update(calendarInfo) {
+		return calendarInfo, nil
+	}
+
+	if err := p.storeCalendarInfo(userID, calendarInfo); err != nil {
+		return nil, err
+	}
+	return calendarInfo, nil
 }
 
 func (p *Plugin) storeCalendarInfo(userID string, calendarInfo *CalendarInfo) error {
+	calendarInfo.Version = calendarInfoVersion
 	jsonInfo, err := json.Marshal(calendarInfo)
 	if err != nil {
 		return err
@@ -432,45 +1083,23 @@ func (p *Plugin) storeCalendarInfo(userID string, calendarInfo *CalendarInfo) er
 func (p *Plugin) getCalendarInfo(userID string) (*CalendarInfo, error) {
 	var calendarInfo CalendarInfo
 
-	if info, err := p.API.KVGet(userID + calendarTokenKey); err != nil || info == nil {
-		return nil, err
-	} else if err := json.Unmarshal(info, &calendarInfo); err != nil {
-		return nil, err
+	info, appErr := p.API.KVGet(userID + calendarTokenKey)
+	if appErr != nil {
+		return nil, appErr
+	}
+	if info == nil {
+		return nil, nil
 	}
 
-	return &calendarInfo, nil
-}
-
-func (p *Plugin) updateEvent(eventID, userID string, updatedEvent EventInfo) (*CalendarInfo, error) {
-	calendarInfo, err := p.getCalendarInfo(userID)
-	if err != nil {
+	if err := json.Unmarshal(info, &calendarInfo); err != nil {
 		return nil, err
 	}
-	for index := range calendarInfo.Events {
-		event := &calendarInfo.Events[index]
-		if event.Id == eventID {
-			event.StartTime = updatedEvent.StartTime
-			event.EndTime = updatedEvent.EndTime
-			event.Status = updatedEvent.Status
-			event.HtmlLink = updatedEvent.HtmlLink
-			event.Id = updatedEvent.Id
-			event.Summary = updatedEvent.Summary
-			break
-		}
-	}
-	return calendarInfo, nil
-}
 
-func (p *Plugin) removeAnEvent(userID string, e *calendar.Event) (*CalendarInfo, error) {
-	calendarInfo, err := p.getCalendarInfo(userID)
-	if err != nil {
-		return nil, errors.New("Failed to get calendar information")
-	}
-	for index, event := range calendarInfo.Events {
-		if event.Id == e.Id {
-			calendarInfo.Events = append(calendarInfo.Events[:index], calendarInfo.Events[index+1:]...)
-			break
+	if calendarInfo.Version < calendarInfoVersion {
+		if err := p.migrateCalendarInfo(userID, info, &calendarInfo); err != nil {
+			return nil, err
 		}
 	}
-	return calendarInfo, nil
+
+	return &calendarInfo, nil
 }
@@ -0,0 +1,827 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/mattermost/mattermost-server/plugin"
+	"github.com/mattermost/mattermost-server/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/calendar/v3"
+
+	"github.com/waseem18/mattermost-plugin-google-calendar/server/fakecaldav"
+	"github.com/waseem18/mattermost-plugin-google-calendar/server/fakegoogle"
+)
+
+const (
+	testUserID   = "user1"
+	testBotID    = "bot"
+	testClientID = "client-id"
+
+	testCalDAVPassword = "app-password"
+)
+
+// testEnv runs the plugin against a fake Google server and a fake CalDAV server,
+// with plugintest.API backed by an in-memory key-value store. The plugin is also
+// served over HTTP at the site URL, so the fakes can redirect to it and send it
+// notifications.
+type testEnv struct {
+	p          *Plugin
+	api        *plugintest.API
+	google     *fakegoogle.Server
+	caldav     *fakecaldav.Server
+	mattermost *httptest.Server
+	clock      *testClock
+
+	// timezone is the Mattermost timezone of the users.
+	timezone string
+
+	lock  sync.Mutex
+	kv    map[string][]byte
+	posts []*model.Post
+
+	// failPosts makes creating posts fail.
+	failPosts bool
+
+	// kvGetDelay delays reading the keys, widening the window in which
+	// concurrent read-modify-write updates can overwrite each other.
+	kvGetDelay time.Duration
+
+	// expiry holds when the keys set with an expiry expire, according to the
+	// clock of the tests.
+	expiry map[string]time.Time
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	e := &testEnv{
+		p:      &Plugin{BotUserID: testBotID},
+		api:    &plugintest.API{},
+		google: fakegoogle.New(testClientID, "client-secret"),
+		caldav: fakecaldav.New(testCalDAVPassword),
+		clock:  &testClock{now: time.Now()},
+		kv:     map[string][]byte{},
+		expiry: map[string]time.Time{},
+	}
+	e.p.clock = e.clock
+	e.mattermost = httptest.NewServer(http.StripPrefix("/plugins/google-calendar", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e.p.ServeHTTP(&plugin.Context{}, w, r)
+	})))
+
+	e.p.SetAPI(e.api)
+	e.p.setConfiguration(&configuration{
+		CalendarOAuthClientID:     testClientID,
+		CalendarOAuthClientSecret: "client-secret",
+		Secret:                    "secret",
+		GoogleCalendarAPIURL:      e.google.CalendarAPIURL(),
+		GoogleOAuthURL:            e.google.OAuthURL(),
+		CalDAVServerURL:           e.caldav.URL,
+	})
+
+	config := &model.Config{}
+	config.SetDefaults()
+	config.ServiceSettings.SiteURL = model.NewString(e.mattermost.URL)
+	e.api.On("GetConfig").Return(config)
+
+	e.api.On("KVGet", mock.AnythingOfType("string")).Return(
+		func(key string) []byte {
+			e.lock.Lock()
+			defer e.lock.Unlock()
+			e.expireKeys()
+			value := e.kv[key]
+			if e.kvGetDelay > 0 {
+				e.lock.Unlock()
+				time.Sleep(e.kvGetDelay)
+				e.lock.Lock()
+			}
+			return value
+		},
+		func(key string) *model.AppError { return nil },
+	)
+	e.api.On("KVSet", mock.AnythingOfType("string"), mock.Anything).Return(
+		func(key string, value []byte) *model.AppError {
+			e.lock.Lock()
+			defer e.lock.Unlock()
+			e.kv[key] = value
+			delete(e.expiry, key)
+			return nil
+		},
+	)
+	e.api.On("KVSetWithExpiry", mock.AnythingOfType("string"), mock.Anything, mock.AnythingOfType("int64")).Return(
+		func(key string, value []byte, expireInSeconds int64) *model.AppError {
+			e.lock.Lock()
+			defer e.lock.Unlock()
+			e.kv[key] = value
+			delete(e.expiry, key)
+			if expireInSeconds > 0 {
+				e.expiry[key] = e.clock.Now().Add(time.Duration(expireInSeconds) * time.Second)
+			}
+			return nil
+		},
+	)
+	e.api.On("KVDelete", mock.AnythingOfType("string")).Return(
+		func(key string) *model.AppError {
+			e.lock.Lock()
+			defer e.lock.Unlock()
+			delete(e.kv, key)
+			delete(e.expiry, key)
+			return nil
+		},
+	)
+	e.api.On("KVList", mock.AnythingOfType("int"), mock.AnythingOfType("int")).Return(
+		func(page, perPage int) []string {
+			e.lock.Lock()
+			defer e.lock.Unlock()
+			e.expireKeys()
+			keys := []string{}
+			for key := range e.kv {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			if page*perPage >= len(keys) {
+				return []string{}
+			}
+			keys = keys[page*perPage:]
+			if len(keys) > perPage {
+				keys = keys[:perPage]
+			}
+			return keys
+		},
+		func(page, perPage int) *model.AppError { return nil },
+	)
+
+	e.api.On("GetUser", mock.AnythingOfType("string")).Return(
+		func(userID string) *model.User {
+			return &model.User{
+				Id:       userID,
+				Username: userID,
+				Timezone: map[string]string{"useAutomaticTimezone": "false", "manualTimezone": e.timezone},
+			}
+		},
+		func(userID string) *model.AppError { return nil },
+	)
+	e.api.On("GetDirectChannel", mock.AnythingOfType("string"), testBotID).Return(
+		func(userID, botID string) *model.Channel {
+			return &model.Channel{Id: directChannelID(userID), Type: model.CHANNEL_DIRECT}
+		},
+		func(userID, botID string) *model.AppError { return nil },
+	)
+	e.api.On("CreatePost", mock.AnythingOfType("*model.Post")).Return(
+		func(post *model.Post) *model.Post {
+			e.lock.Lock()
+			defer e.lock.Unlock()
+			if e.failPosts {
+				return nil
+			}
+			e.posts = append(e.posts, post)
+			return post
+		},
+		func(post *model.Post) *model.AppError {
+			e.lock.Lock()
+			defer e.lock.Unlock()
+			if e.failPosts {
+				return model.NewAppError("CreatePost", "test.create_post", nil, "", http.StatusInternalServerError)
+			}
+			return nil
+		},
+	)
+
+	return e
+}
+
+// testClock is a clock set by the tests.
+type testClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *testClock) set(now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = now
+}
+
+// expireKeys removes the keys that expired. It's called with the lock held.
+func (e *testEnv) expireKeys() {
+	now := e.clock.Now()
+	for key, expiry := range e.expiry {
+		if !now.Before(expiry) {
+			delete(e.kv, key)
+			delete(e.expiry, key)
+		}
+	}
+}
+
+func (e *testEnv) close() {
+	e.mattermost.Close()
+	e.google.Close()
+	e.caldav.Close()
+}
+
+func directChannelID(userID string) string {
+	return "dm-" + userID
+}
+
+// channelPosts returns the posts created so far in a channel.
+func (e *testEnv) channelPosts(channelID string) []*model.Post {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	posts := []*model.Post{}
+	for _, post := range e.posts {
+		if post.ChannelId == channelID {
+			posts = append(posts, post)
+		}
+	}
+	return posts
+}
+
+// connect connects the calendar of the user through the OAuth flow, the way the
+// browser of the user would, and returns the page shown at the end of it.
+func (e *testEnv) connect(t *testing.T, userID string) *http.Response {
+	request, err := http.NewRequest(http.MethodGet, e.mattermost.URL+"/plugins/google-calendar/oauth/connect", nil)
+	require.NoError(t, err)
+	request.Header.Set("Mattermost-User-ID", userID)
+
+	// The header set by Mattermost for the session of the user is kept across the
+	// redirects to the fake authorization endpoint and back.
+	resp, err := http.DefaultClient.Do(request)
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp
+}
+
+// connected connects the calendar of the user and returns the stored user information.
+func (e *testEnv) connected(t *testing.T, userID string) *UserInfo {
+	resp := e.connect(t, userID)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	userInfo, err := e.p.getUserInfo(userID)
+	require.NoError(t, err)
+	require.NotNil(t, userInfo)
+	return userInfo
+}
+
+// addEvent adds a timed event to a calendar of the fake, starting after the given
+// delay according to the clock of the plugin.
+func (e *testEnv) addEvent(t *testing.T, calendarID, summary string, startsIn, duration time.Duration) *calendar.Event {
+	start := e.clock.Now().Add(startsIn).Truncate(time.Second)
+	event, err := e.google.AddEvent(calendarID, &calendar.Event{
+		Summary: summary,
+		Start:   &calendar.EventDateTime{DateTime: start.Format(time.RFC3339)},
+		End:     &calendar.EventDateTime{DateTime: start.Add(duration).Format(time.RFC3339)},
+	})
+	require.NoError(t, err)
+	return event
+}
+
+// storedEvents returns the summaries of the stored events of the user.
+func (e *testEnv) storedEvents(t *testing.T, userID string) []string {
+	calendarInfo, err := e.p.getCalendarInfo(userID)
+	require.NoError(t, err)
+	require.NotNil(t, calendarInfo)
+
+	summaries := []string{}
+	for _, event := range calendarInfo.Events {
+		summaries = append(summaries, event.Summary)
+	}
+	return summaries
+}
+
+func TestUpdateCalendarEvents(t *testing.T) {
+	t.Run("applies the changes since the last sync", func(t *testing.T) {
+		e := newTestEnv(t)
+		defer e.close()
+		e.addEvent(t, fakegoogle.PrimaryCalendarID, "Standup", time.Hour, 15*time.Minute)
+		userInfo := e.connected(t, testUserID)
+		assert.Equal(t, []string{"Standup"}, e.storedEvents(t, testUserID))
+
+		retro := e.addEvent(t, fakegoogle.PrimaryCalendarID, "Retro", 2*time.Hour, time.Hour)
+		require.NoError(t, e.p.updateCalendarEvents(userInfo, "primary"))
+		assert.ElementsMatch(t, []string{"Standup", "Retro"}, e.storedEvents(t, testUserID))
+
+		require.NoError(t, e.google.CancelEvent(fakegoogle.PrimaryCalendarID, retro.Id))
+		require.NoError(t, e.p.updateCalendarEvents(userInfo, "primary"))
+		assert.Equal(t, []string{"Standup"}, e.storedEvents(t, testUserID))
+	})
+
+	t.Run("follows the pages of events", func(t *testing.T) {
+		e := newTestEnv(t)
+		defer e.close()
+		e.google.PageSize = 1
+		e.addEvent(t, fakegoogle.PrimaryCalendarID, "First", time.Hour, time.Hour)
+		e.addEvent(t, fakegoogle.PrimaryCalendarID, "Second", 2*time.Hour, time.Hour)
+		e.addEvent(t, fakegoogle.PrimaryCalendarID, "Third", 3*time.Hour, time.Hour)
+		e.connected(t, testUserID)
+
+		assert.ElementsMatch(t, []string{"First", "Second", "Third"}, e.storedEvents(t, testUserID))
+	})
+
+	t.Run("does a full sync when the sync token expired", func(t *testing.T) {
+		e := newTestEnv(t)
+		defer e.close()
+		userInfo := e.connected(t, testUserID)
+
+		e.google.ExpireSyncTokens()
+		e.addEvent(t, fakegoogle.PrimaryCalendarID, "Planning", time.Hour, time.Hour)
+		require.NoError(t, e.p.updateCalendarEvents(userInfo, "primary"))
+		assert.Equal(t, []string{"Planning"}, e.storedEvents(t, testUserID))
+	})
+
+	t.Run("only stores the events within the sync window", func(t *testing.T) {
+		e := newTestEnv(t)
+		defer e.close()
+		e.addEvent(t, fakegoogle.PrimaryCalendarID, "Soon", time.Hour, time.Hour)
+		e.addEvent(t, fakegoogle.PrimaryCalendarID, "Later", syncWindow+time.Hour, time.Hour)
+		e.connected(t, testUserID)
+
+		assert.Equal(t, []string{"Soon"}, e.storedEvents(t, testUserID))
+	})
+
+	t.Run("notifies the user of new invitations", func(t *testing.T) {
+		e := newTestEnv(t)
+		defer e.close()
+		userInfo := e.connected(t, testUserID)
+
+		_, err := e.google.AddEvent(fakegoogle.PrimaryCalendarID, &calendar.Event{
+			Summary:   "Offsite",
+			Start:     &calendar.EventDateTime{DateTime: e.clock.Now().Add(time.Hour).Format(time.RFC3339)},
+			End:       &calendar.EventDateTime{DateTime: e.clock.Now().Add(2 * time.Hour).Format(time.RFC3339)},
+			Organizer: &calendar.EventOrganizer{Email: "boss@example.com"},
+			Attendees: []*calendar.EventAttendee{
+				{Email: fakegoogle.PrimaryCalendarID, Self: true, ResponseStatus: "needsAction"},
+			},
+		})
+		require.NoError(t, err)
+		require.NoError(t, e.p.updateCalendarEvents(userInfo, "primary"))
+		require.NoError(t, e.p.updateCalendarEvents(userInfo, "primary"))
+
+		invitations := []*model.Post{}
+		for _, post := range e.channelPosts(directChannelID(testUserID)) {
+			if attachments := post.Attachments(); len(attachments) > 0 && attachments[0].Pretext == "New invitation" {
+				invitations = append(invitations, post)
+			}
+		}
+		require.Len(t, invitations, 1)
+		assert.Equal(t, "Offsite", invitations[0].Attachments()[0].Title)
+	})
+}
+
+func TestCheckEventsPostsReminders(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	e.addEvent(t, fakegoogle.PrimaryCalendarID, "Design review", 5*time.Minute, 30*time.Minute)
+	e.addEvent(t, fakegoogle.PrimaryCalendarID, "Lunch", 3*time.Hour, time.Hour)
+	e.connected(t, testUserID)
+
+	require.NoError(t, e.p.checkEvents(testUserID))
+	require.NoError(t, e.p.checkEvents(testUserID))
+
+	reminders := []string{}
+	for _, post := range e.channelPosts(directChannelID(testUserID)) {
+		if attachments := post.Attachments(); len(attachments) > 0 {
+			reminders = append(reminders, attachments[0].Title)
+		}
+	}
+	assert.Equal(t, []string{"Design review"}, reminders, "only the event starting within the lead time is reminded, once")
+}
+
+func TestCheckEventsRetriesFailedReminders(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	e.addEvent(t, fakegoogle.PrimaryCalendarID, "Design review", 5*time.Minute, 30*time.Minute)
+	e.connected(t, testUserID)
+	welcomePosts := len(e.channelPosts(directChannelID(testUserID)))
+
+	e.lock.Lock()
+	e.failPosts = true
+	e.lock.Unlock()
+	require.NoError(t, e.p.checkEvents(testUserID))
+
+	calendarInfo, err := e.p.getCalendarInfo(testUserID)
+	require.NoError(t, err)
+	require.Len(t, calendarInfo.Events, 1)
+	assert.Empty(t, calendarInfo.Events[0].SentReminders, "the reminder isn't recorded as sent")
+
+	e.lock.Lock()
+	e.failPosts = false
+	e.lock.Unlock()
+	require.NoError(t, e.p.checkEvents(testUserID))
+
+	posts := e.channelPosts(directChannelID(testUserID))
+	require.Len(t, posts, welcomePosts+1)
+	assert.Equal(t, "Design review", posts[welcomePosts].Attachments()[0].Title)
+}
+
+func TestConcurrentCalendarInfoUpdates(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	e.addEvent(t, fakegoogle.PrimaryCalendarID, "Design review", 5*time.Minute, 30*time.Minute)
+	userInfo := e.connected(t, testUserID)
+
+	// Reminders and syncs triggered by watch notifications at the same time keep
+	// each other's changes.
+	want := []string{"Design review"}
+	for i := 0; i < 10; i++ {
+		summary := fmt.Sprintf("Meeting %d", i)
+		e.addEvent(t, fakegoogle.PrimaryCalendarID, summary, 2*time.Hour, time.Hour)
+		want = append(want, summary)
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, e.p.checkEvents(testUserID))
+		}()
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, e.p.updateCalendarEvents(userInfo, "primary"))
+		}()
+		wg.Wait()
+	}
+
+	assert.ElementsMatch(t, want, e.storedEvents(t, testUserID))
+
+	reminders := 0
+	for _, post := range e.channelPosts(directChannelID(testUserID)) {
+		if len(post.Attachments()) > 0 {
+			reminders++
+		}
+	}
+	assert.Equal(t, 1, reminders)
+}
+
+func TestConcurrentConnectedUsersUpdates(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	require.NoError(t, e.p.storeConnectedUsers([]string{"leaving"}))
+	e.lock.Lock()
+	e.kvGetDelay = time.Millisecond
+	e.lock.Unlock()
+
+	// Users connecting and disconnecting at the same time don't drop each other
+	// from the index.
+	want := []string{}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		userID := fmt.Sprintf("user%d", i)
+		want = append(want, userID)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, e.p.addConnectedUser(userID))
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.NoError(t, e.p.removeConnectedUser("leaving"))
+	}()
+	wg.Wait()
+
+	userIDs, err := e.p.getConnectedUsers()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, want, userIDs)
+}
+
+func TestReconnect(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	e.addEvent(t, fakegoogle.PrimaryCalendarID, "Design review", 5*time.Minute, 30*time.Minute)
+	e.connected(t, testUserID)
+	require.NoError(t, e.p.checkEvents(testUserID))
+	_, err := e.p.updateCalendarInfo(testUserID, func(calendarInfo *CalendarInfo) bool {
+		calendarInfo.LastDigestDate = "2026-03-02"
+		return true
+	})
+	require.NoError(t, err)
+	previous := e.google.Channels()
+	require.Len(t, previous, 1)
+
+	e.connected(t, testUserID)
+
+	channels := e.google.Channels()
+	require.Len(t, channels, 1, "the previous watch channel is stopped")
+	assert.NotEqual(t, previous[0].Id, channels[0].Id)
+
+	calendarInfo, err := e.p.getCalendarInfo(testUserID)
+	require.NoError(t, err)
+	assert.Equal(t, "2026-03-02", calendarInfo.LastDigestDate)
+	require.Len(t, calendarInfo.Calendars, 1)
+	assert.Equal(t, channels[0].Id, calendarInfo.Calendars[0].WatchToken)
+	assert.Equal(t, []string{"Design review"}, e.storedEvents(t, testUserID))
+
+	require.NoError(t, e.p.checkEvents(testUserID))
+	reminders := 0
+	for _, post := range e.channelPosts(directChannelID(testUserID)) {
+		if len(post.Attachments()) > 0 {
+			reminders++
+		}
+	}
+	assert.Equal(t, 1, reminders, "the reminder isn't sent again")
+}
+
+func TestRevokedAuthorizationDisconnectsUser(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	userInfo := e.connected(t, testUserID)
+
+	e.google.RevokeAccess()
+	assert.Error(t, e.p.updateCalendarEvents(userInfo, "primary"))
+
+	stored, err := e.p.getUserInfo(testUserID)
+	require.NoError(t, err)
+	assert.Nil(t, stored)
+
+	connectedUsers, err := e.p.getConnectedUsers()
+	require.NoError(t, err)
+	assert.NotContains(t, connectedUsers, testUserID)
+
+	posts := e.channelPosts(directChannelID(testUserID))
+	require.NotEmpty(t, posts)
+	assert.Contains(t, posts[len(posts)-1].Message, "/plugins/google-calendar/oauth/connect")
+
+	// Syncs that were already scheduled don't notify the user again.
+	e.p.updateCalendarEvents(userInfo, "primary")
+	assert.Len(t, e.channelPosts(directChannelID(testUserID)), len(posts))
+}
+
+func TestDisconnect(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	userInfo := e.connected(t, testUserID)
+	require.Len(t, e.google.Channels(), 1)
+
+	resp, appErr := e.p.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{UserId: testUserID, Command: "/google-calendar disconnect"})
+	require.Nil(t, appErr)
+	assert.Equal(t, "Disconnected your Google Calendar.", resp.Text)
+
+	assert.Empty(t, e.google.Channels())
+	assert.Contains(t, e.google.Revoked(), userInfo.Token.RefreshToken)
+
+	stored, err := e.p.getUserInfo(testUserID)
+	require.NoError(t, err)
+	assert.Nil(t, stored)
+}
+
+func TestCreateCommand(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	config := *e.p.getConfiguration()
+	config.EnableWriteAccess = true
+	e.p.setConfiguration(&config)
+	e.connected(t, testUserID)
+
+	resp, appErr := e.p.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{UserId: testUserID, Command: "/google-calendar create tomorrow 15:00 30m Design review --meet"})
+	require.Nil(t, appErr)
+	assert.True(t, strings.HasPrefix(resp.Text, "Created"), resp.Text)
+
+	events := e.google.Events(fakegoogle.PrimaryCalendarID)
+	require.Len(t, events, 1)
+	assert.Equal(t, "Design review", events[0].Summary)
+	assert.NotEmpty(t, events[0].HangoutLink)
+
+	start, err := time.Parse(time.RFC3339, events[0].Start.DateTime)
+	require.NoError(t, err)
+	end, err := time.Parse(time.RFC3339, events[0].End.DateTime)
+	require.NoError(t, err)
+	assert.Equal(t, 30*time.Minute, end.Sub(start))
+}
+
+// mustParseTime parses a local time formatted as "2006-01-02 15:04" in the given location.
+func mustParseTime(t *testing.T, value string, location *time.Location) time.Time {
+	parsed, err := time.ParseInLocation("2006-01-02 15:04", value, location)
+	require.NoError(t, err)
+	return parsed
+}
+
+func TestDueReminderLeadTimes(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+
+	timed := func(start string) EventInfo {
+		return EventInfo{Id: "event", StartTime: start, EndTime: start}
+	}
+	allDay := func(date string) EventInfo {
+		return EventInfo{Id: "event", StartTime: date, EndTime: date, AllDay: true}
+	}
+
+	for _, tc := range []struct {
+		name          string
+		event         EventInfo
+		leadTimes     []int
+		sentReminders []int
+		now           string
+		want          []int
+	}{
+		{"before the lead time", timed("2026-03-02T10:00:00-05:00"), []int{10}, nil, "2026-03-02 09:49", nil},
+		{"at the lead time", timed("2026-03-02T10:00:00-05:00"), []int{10}, nil, "2026-03-02 09:50", []int{10}},
+		{"late tick within the grace period", timed("2026-03-02T10:00:00-05:00"), []int{10}, nil, "2026-03-02 10:04", []int{10}},
+		{"late tick after the grace period", timed("2026-03-02T10:00:00-05:00"), []int{10}, nil, "2026-03-02 10:05", nil},
+		{"several reminders due after skipped ticks", timed("2026-03-02T10:00:00-05:00"), []int{60, 10}, nil, "2026-03-02 09:55", []int{10, 60}},
+		{"reminder already sent", timed("2026-03-02T10:00:00-05:00"), []int{60, 10}, []int{60}, "2026-03-02 09:55", []int{10}},
+		{"before the lead time across midnight", timed("2026-03-03T00:05:00-05:00"), []int{10}, nil, "2026-03-02 23:54", nil},
+		{"at the lead time across midnight", timed("2026-03-03T00:05:00-05:00"), []int{10}, nil, "2026-03-02 23:55", []int{10}},
+		// Clocks jump from 2:00 EST to 3:00 EDT: an hour before 3:30 EDT is 1:30 EST.
+		{"before the lead time when clocks spring forward", timed("2026-03-08T03:30:00-04:00"), []int{60}, nil, "2026-03-08 01:29", nil},
+		{"at the lead time when clocks spring forward", timed("2026-03-08T03:30:00-04:00"), []int{60}, nil, "2026-03-08 01:30", []int{60}},
+		// Clocks go back from 2:00 EDT to 1:00 EST: an hour before 1:30 EST is 1:30 EDT,
+		// the first of the two 1:30 local times.
+		{"before the lead time when clocks fall back", timed("2026-11-01T01:30:00-05:00"), []int{60}, nil, "2026-11-01 00:45", nil},
+		{"at the lead time when clocks fall back", timed("2026-11-01T01:30:00-05:00"), []int{60}, nil, "2026-11-01 01:30", []int{60}},
+		{"all-day event before the reminder time", allDay("2026-03-08"), nil, nil, "2026-03-08 07:59", nil},
+		{"all-day event at the reminder time when clocks spring forward", allDay("2026-03-08"), nil, nil, "2026-03-08 08:00", []int{0}},
+		{"all-day event late tick on the same day", allDay("2026-03-08"), nil, nil, "2026-03-08 23:59", []int{0}},
+		{"all-day event missed day", allDay("2026-03-08"), nil, nil, "2026-03-09 00:00", nil},
+		{"all-day event already reminded", allDay("2026-03-08"), nil, []int{0}, "2026-03-08 09:00", nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			settings := &UserSettings{ReminderLeadTimes: tc.leadTimes, AllDayReminderTime: "08:00"}
+			tc.event.SentReminders = tc.sentReminders
+
+			got := dueReminderLeadTimes(tc.event, settings, mustParseTime(t, tc.now, newYork))
+			if len(tc.want) == 0 {
+				assert.Empty(t, got)
+			} else {
+				assert.Equal(t, tc.want, got)
+			}
+		})
+	}
+}
+
+func TestCheckEventsTicks(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		timezone  string
+		start     string
+		leadTimes []int
+		ticks     []string
+		want      []string
+	}{
+		{"regular ticks", "Europe/Berlin", "2026-03-02 10:00", []int{10}, []string{"2026-03-02 09:49", "2026-03-02 09:50", "2026-03-02 09:51", "2026-03-02 10:00"}, []string{"Event starting in 10 min"}},
+		{"late tick within the grace period", "Europe/Berlin", "2026-03-02 10:00", []int{10}, []string{"2026-03-02 09:49", "2026-03-02 10:03"}, []string{"Event started 3 min ago"}},
+		{"tick missed past the grace period", "Europe/Berlin", "2026-03-02 10:00", []int{10}, []string{"2026-03-02 09:49", "2026-03-02 10:06"}, []string{}},
+		{"reminders due together after a late tick", "Europe/Berlin", "2026-03-02 10:00", []int{10, 60}, []string{"2026-03-02 08:30", "2026-03-02 09:55", "2026-03-02 09:56"}, []string{"Event starting in 5 min"}},
+		{"late tick before the start", "Europe/Berlin", "2026-03-02 10:00", []int{60}, []string{"2026-03-02 08:30", "2026-03-02 09:40"}, []string{"Event starting in 20 min"}},
+		{"reminders on separate ticks", "Europe/Berlin", "2026-03-02 10:00", []int{10, 60}, []string{"2026-03-02 09:00", "2026-03-02 09:50"}, []string{"Event starting in 1 hour", "Event starting in 10 min"}},
+		{"across midnight", "Asia/Tokyo", "2026-03-03 00:05", []int{10}, []string{"2026-03-02 23:54", "2026-03-02 23:55", "2026-03-03 00:00"}, []string{"Event starting in 10 min"}},
+		{"clocks spring forward", "Europe/Berlin", "2026-03-29 03:30", []int{60}, []string{"2026-03-29 01:29", "2026-03-29 01:30", "2026-03-29 03:00"}, []string{"Event starting in 1 hour"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			defer e.close()
+			e.timezone = tc.timezone
+			location, err := time.LoadLocation(tc.timezone)
+			require.NoError(t, err)
+
+			start := mustParseTime(t, tc.start, location)
+			e.clock.set(start.Add(-2 * time.Hour))
+			e.addEvent(t, fakegoogle.PrimaryCalendarID, "Standup", 2*time.Hour, 15*time.Minute)
+			e.connected(t, testUserID)
+			require.NoError(t, e.p.storeUserSettings(testUserID, &UserSettings{ReminderLeadTimes: tc.leadTimes, AllDayReminderTime: "08:00"}))
+
+			for _, tick := range tc.ticks {
+				e.clock.set(mustParseTime(t, tick, location))
+				require.NoError(t, e.p.checkEvents(testUserID))
+			}
+
+			// The reminders show the time actually left before the event.
+			pretexts := []string{}
+			for _, post := range e.channelPosts(directChannelID(testUserID)) {
+				if attachments := post.Attachments(); len(attachments) > 0 {
+					pretexts = append(pretexts, attachments[0].Pretext)
+				}
+			}
+			assert.Equal(t, tc.want, pretexts)
+		})
+	}
+}
+
+func TestSetupWatchRenewal(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		advance     time.Duration
+		wantRenewed bool
+	}{
+		{"channel far from its expiry", 24 * time.Hour, false},
+		{"channel just outside the renewal window", 7*24*time.Hour - watchRenewalWindow - time.Minute, false},
+		{"channel within the renewal window", 7*24*time.Hour - watchRenewalWindow + time.Minute, true},
+		{"expired channel", 8 * 24 * time.Hour, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			defer e.close()
+			e.connected(t, testUserID)
+			previous := e.google.Channels()[0]
+
+			expiry := time.Unix(0, previous.Expiration*int64(time.Millisecond))
+			e.clock.set(expiry.Add(-7 * 24 * time.Hour).Add(tc.advance))
+			require.NoError(t, e.p.setupWatchRenewal(testUserID))
+
+			channels := e.google.Channels()
+			require.Len(t, channels, 1)
+			assert.Equal(t, tc.wantRenewed, channels[0].Id != previous.Id)
+		})
+	}
+}
+
+func TestUnwatchableCalendars(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	e.google.AddCalendar(&calendar.CalendarListEntry{Id: "holidays@group.v.calendar.google.com", Summary: "Holidays", AccessRole: "reader"})
+	e.google.AddCalendar(&calendar.CalendarListEntry{Id: "team@example.com", Summary: "Team", AccessRole: "writer"})
+	e.google.DisablePush("holidays@group.v.calendar.google.com")
+	e.connected(t, testUserID)
+
+	resp, appErr := e.p.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{UserId: testUserID, Command: "/google-calendar calendars subscribe holidays@group.v.calendar.google.com"})
+	require.Nil(t, appErr)
+	assert.Contains(t, resp.Text, "Subscribed to calendar `holidays@group.v.calendar.google.com`.")
+	assert.Contains(t, resp.Text, "checked for changes every 5 minutes")
+	resp, appErr = e.p.ExecuteCommand(&plugin.Context{}, &model.CommandArgs{UserId: testUserID, Command: "/google-calendar calendars subscribe team@example.com"})
+	require.Nil(t, appErr)
+	assert.Equal(t, "Subscribed to calendar `team@example.com`. You will receive reminders for its events.", resp.Text)
+
+	calendarInfo, err := e.p.getCalendarInfo(testUserID)
+	require.NoError(t, err)
+	require.Len(t, calendarInfo.Calendars, 3)
+	assert.True(t, calendarInfo.Calendars[1].Polled)
+
+	// A calendar that can't be watched, e.g. subscribed to before such calendars
+	// were polled, doesn't keep the calendars after it from being renewed.
+	calendarInfo.Calendars[1].Polled = false
+	require.NoError(t, e.p.storeCalendarInfo(testUserID, calendarInfo))
+	previous := map[string]bool{}
+	for _, channel := range e.google.Channels() {
+		previous[channel.Id] = true
+	}
+	e.clock.set(e.clock.Now().Add(7 * 24 * time.Hour))
+	require.NoError(t, e.p.setupWatchRenewal(testUserID))
+
+	channels := e.google.Channels()
+	require.Len(t, channels, 2)
+	for _, channel := range channels {
+		assert.False(t, previous[channel.Id], "the channel is renewed")
+	}
+	calendarInfo, err = e.p.getCalendarInfo(testUserID)
+	require.NoError(t, err)
+	assert.True(t, calendarInfo.Calendars[1].Polled)
+}
+
+func TestCheckCalendarSyncPollsCalendars(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	e.connected(t, testUserID)
+
+	calendarInfo, err := e.p.getCalendarInfo(testUserID)
+	require.NoError(t, err)
+	calendarInfo.Calendars[0].Polled = true
+	require.NoError(t, e.p.storeCalendarInfo(testUserID, calendarInfo))
+
+	e.addEvent(t, fakegoogle.PrimaryCalendarID, "Standup", 2*time.Hour, 15*time.Minute)
+
+	e.clock.set(e.clock.Now().Add(pollInterval - time.Minute))
+	require.NoError(t, e.p.checkCalendarSync(testUserID))
+	assert.Empty(t, e.storedEvents(t, testUserID))
+
+	e.clock.set(e.clock.Now().Add(time.Minute))
+	require.NoError(t, e.p.checkCalendarSync(testUserID))
+	assert.Equal(t, []string{"Standup"}, e.storedEvents(t, testUserID))
+}
+
+func TestRateLimitedSyncIsRetried(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	e.connected(t, testUserID)
+
+	e.addEvent(t, fakegoogle.PrimaryCalendarID, "Standup", 2*time.Hour, 15*time.Minute)
+	e.google.RateLimit(1)
+	require.NoError(t, e.google.Notify(fakegoogle.PrimaryCalendarID))
+	assert.Empty(t, e.storedEvents(t, testUserID))
+
+	calendarInfo, err := e.p.getCalendarInfo(testUserID)
+	require.NoError(t, err)
+	assert.True(t, calendarInfo.Calendars[0].SyncPending)
+
+	// The watched calendar is synced again on the next tick rather than after the
+	// next notification.
+	require.NoError(t, e.p.checkCalendarSync(testUserID))
+	assert.Equal(t, []string{"Standup"}, e.storedEvents(t, testUserID))
+
+	calendarInfo, err = e.p.getCalendarInfo(testUserID)
+	require.NoError(t, err)
+	assert.False(t, calendarInfo.Calendars[0].SyncPending)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Errors returned by calendar providers, possibly wrapped. Compare them with the
+// cause of an error, see errors.Cause.
+var (
+	// errAuthorizationRevoked shows the user's authorization was revoked or has expired.
+	errAuthorizationRevoked = errors.New("authorization revoked or expired")
+
+	// errPermissionDenied shows the user didn't grant the plugin the permission to
+	// do something, e.g. to write to their calendar.
+	errPermissionDenied = errors.New("permission denied")
+
+	// errRateLimited shows the provider is limiting the rate of the requests of
+	// the plugin. They can be retried later.
+	errRateLimited = errors.New("rate limit exceeded")
+
+	// errSyncTokenExpired shows a sync token is no longer valid and a full sync is needed.
+	errSyncTokenExpired = errors.New("sync token expired")
+
+	// errWatchNotSupported is returned by providers that can't notify the plugin
+	// of changes. Their calendars are polled instead.
+	errWatchNotSupported = errors.New("watching calendars isn't supported")
+)
+
+// CalendarProvider gives access to the calendars of a user on a calendar service.
+// The primary calendar of the user can be referred to with the "primary" alias.
+type CalendarProvider interface {
+	// ListCalendars returns the calendars in the user's calendar list.
+	ListCalendars() ([]*Calendar, error)
+
+	// GetCalendar returns a calendar the user can read, including calendars
+	// shared with them that aren't in their calendar list.
+	GetCalendar(calendarID string) (*Calendar, error)
+
+	// ListEvents returns the events of a calendar between timeMin and timeMax,
+	// with recurring events expanded and ordered by their start.
+	ListEvents(calendarID string, timeMin, timeMax time.Time) ([]*Event, error)
+
+	// SyncEvents returns the changes to the events of a calendar since the sync
+	// that returned syncToken, including cancelled events, along with the token
+	// for the next sync. Without a sync token, it returns the events taking
+	// place within the sync window starting at timeMin. It returns
+	// errSyncTokenExpired if a full sync is needed.
+	SyncEvents(calendarID, syncToken string, timeMin time.Time) ([]*Event, string, error)
+
+	// Watch creates a channel posting notifications of changes to the events of
+	// a calendar to address, carrying the given token. It returns
+	// errWatchNotSupported if the calendar has to be polled instead.
+	Watch(calendarID, channelID, token, address string) (*WatchChannel, error)
+
+	// StopWatch stops a channel created by Watch.
+	StopWatch(channelID, resourceID string) error
+
+	// GetBusyTime returns the busy periods of the user's primary calendar between
+	// timeMin and timeMax.
+	GetBusyTime(timeMin, timeMax time.Time) ([]interval, error)
+
+	// CreateEvent creates an event in the user's primary calendar and invites its attendees.
+	CreateEvent(request *EventRequest) (*Event, error)
+
+	// RespondToEvent sets the response of the user, accepted, declined or
+	// tentative, to an event they were invited to.
+	RespondToEvent(calendarID, eventID, response string) error
+}
+
+// Calendar captures a calendar of a provider.
+type Calendar struct {
+	ID      string
+	Summary string
+	Primary bool
+}
+
+// Event captures the attributes of an event of a provider used by the plugin.
+// StartTime and EndTime are RFC3339 instants, except for all-day events where
+// they are dates formatted as "2006-01-02", with the end date being exclusive.
+type Event struct {
+	ID        string
+	Summary   string
+	Location  string
+	HTMLLink  string
+	StartTime string
+	EndTime   string
+	AllDay    bool
+
+	// Status is confirmed, tentative or cancelled. Only the ID of cancelled
+	// events is guaranteed to be set.
+	Status string
+
+	// ResponseStatus is the response of the user to the event, or an empty string
+	// if the user isn't invited to it, e.g. as sole organizer.
+	ResponseStatus string
+
+	// OrganizedByUser is true if the user organizes the event.
+	OrganizedByUser bool
+
+	// Transparent is true for events that don't block time, i.e. marked as free.
+	Transparent bool
+
+	// MeetingLink is the link of the video conference of the event, if any.
+	MeetingLink string
+}
+
+// EventRequest captures an event to create.
+type EventRequest struct {
+	Summary        string
+	Start          time.Time
+	End            time.Time
+	AttendeeEmails []string
+
+	// AddMeeting adds a video conference to the event.
+	AddMeeting bool
+}
+
+// WatchChannel captures a channel created by CalendarProvider.Watch.
+type WatchChannel struct {
+	ID         string
+	ResourceID string
+
+	// Expiry is the Unix time, in milliseconds, at which the channel stops.
+	Expiry int64
+}
+
+// getCalendarProvider returns the provider of the calendars of the user,
+// disconnecting the user if their authorization was revoked or expired.
+func (p *Plugin) getCalendarProvider(u *UserInfo) (CalendarProvider, error) {
+	provider, err := p.newCalendarProvider(u)
+	if err != nil {
+		p.handleAuthorizationError(u, err)
+		return nil, err
+	}
+	return provider, nil
+}
+
+// newCalendarProvider returns the provider of the calendars of the user.
+func (p *Plugin) newCalendarProvider(u *UserInfo) (CalendarProvider, error) {
+	if u.CalDAV != nil {
+		provider, err := p.newCalDAVProvider(u)
+		if err != nil {
+			return nil, err
+		}
+		return provider, nil
+	}
+
+	provider, err := p.newGoogleProvider(u)
+	if err != nil {
+		return nil, err
+	}
+	return provider, nil
+}
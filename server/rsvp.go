@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"net/http"
+
+	"github.com/mattermost/mattermost-server/mlog"
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/pkg/errors"
+)
+
+// rsvpResponses lists the responses offered by the RSVP buttons, in the order
+// they are shown, along with their labels.
+var rsvpResponses = []struct {
+	status string
+	label  string
+}{
+	{"accepted", "Accept"},
+	{"declined", "Decline"},
+	{"tentative", "Maybe"},
+}
+
+// generateRSVPActions returns the buttons responding to an event of the user.
+// Each button is signed so the response can't be forged for another user or event.
+func (p *Plugin) generateRSVPActions(userID string, e EventInfo) []*model.PostAction {
+	config := p.API.GetConfig()
+
+	actions := []*model.PostAction{}
+	for _, response := range rsvpResponses {
+		actions = append(actions, &model.PostAction{
+			Name: response.label,
+			Integration: &model.PostActionIntegration{
+				URL: fmt.Sprintf("%s/plugins/google-calendar/event/respond", *config.ServiceSettings.SiteURL),
+				Context: map[string]interface{}{
+					"calendar_id": e.CalendarID,
+					"event_id":    e.Id,
+					"response":    response.status,
+					"signature":   p.signIntegrationRequest(userID, e.CalendarID, e.Id),
+				},
+			},
+		})
+	}
+	return actions
+}
+
+// addRSVP adds the response status of the user and, if write access is enabled,
+// the RSVP buttons to the attachment of an event the user was invited to.
+func (p *Plugin) addRSVP(attachment *model.SlackAttachment, userID string, e EventInfo) {
+	status, ok := responseStatuses[e.ResponseStatus]
+	if !ok {
+		return
+	}
+
+	attachment.Fields = append(attachment.Fields, &model.SlackAttachmentField{
+		Title: "Your response",
+		Value: status,
+		Short: true,
+	})
+
+	if p.getConfiguration().EnableWriteAccess {
+		attachment.Actions = p.generateRSVPActions(userID, e)
+	}
+}
+
+// respondToEvent handles a click on an RSVP button: it sets the response of the
+// user on the event and updates the post to show it.
+func (p *Plugin) respondToEvent(w http.ResponseWriter, r *http.Request) {
+	request := model.PostActionIntegrationRequestFromJson(r.Body)
+	if request == nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	calendarID, _ := request.Context["calendar_id"].(string)
+	eventID, _ := request.Context["event_id"].(string)
+	response, _ := request.Context["response"].(string)
+	signature, _ := request.Context["signature"].(string)
+
+	if !hmac.Equal([]byte(signature), []byte(p.signIntegrationRequest(request.UserId, calendarID, eventID))) {
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	status, ok := responseStatuses[response]
+	if !ok || response == "needsAction" {
+		http.Error(w, "invalid response", http.StatusBadRequest)
+		return
+	}
+
+	reply := &model.PostActionIntegrationResponse{}
+	if err := p.setEventResponse(request.UserId, calendarID, eventID, response); err != nil {
+		mlog.Error("Error responding to an event", mlog.String("user_id", request.UserId), mlog.Err(err))
+
+		reply.EphemeralText = "Encountered an error responding to the event."
+		switch errors.Cause(err) {
+		case errPermissionDenied:
+			reply.EphemeralText = "The plugin isn't allowed to respond to events. Reconnect your Google Calendar with `/google-calendar connect` and try again."
+		case errRateLimited:
+			reply.EphemeralText = "Your calendar is receiving too many requests. Try again in a few minutes."
+		}
+		w.Write(reply.ToJson())
+		return
+	}
+
+	if post, appErr := p.API.GetPost(request.PostId); appErr == nil {
+		attachments := post.Attachments()
+		for _, attachment := range attachments {
+			for _, field := range attachment.Fields {
+				if field.Title == "Your response" {
+					field.Value = status
+				}
+			}
+		}
+		post.Props["attachments"] = attachments
+		reply.Update = post
+	}
+
+	w.Write(reply.ToJson())
+}
+
+// setEventResponse sets the response status of the user on an event they were invited to.
+func (p *Plugin) setEventResponse(userID, calendarID, eventID, response string) error {
+	userInfo, err := p.getUserInfo(userID)
+	if err != nil {
+		return err
+	}
+	if userInfo == nil {
+		return fmt.Errorf("user %s isn't connected", userID)
+	}
+
+	provider, err := p.getCalendarProvider(userInfo)
+	if err != nil {
+		return err
+	}
+
+	return provider.RespondToEvent(calendarID, eventID, response)
+}
+
+// isNewInvitation returns whether an event is an invitation the user hasn't responded to yet.
+func isNewInvitation(event *Event) bool {
+	if event.Status == "cancelled" || event.OrganizedByUser {
+		return false
+	}
+	return event.ResponseStatus == "needsAction"
+}
+
+// createInvitationPost notifies the user of an invitation to an event of the named calendar.
+func (p *Plugin) createInvitationPost(u *UserInfo, e EventInfo, calendarName string) error {
+	now := p.now().In(p.getUserLocation(u.UserID))
+
+	attachment := &model.SlackAttachment{
+		Pretext:   "New invitation",
+		Title:     e.Summary,
+		TitleLink: e.HtmlLink,
+		Text:      formatEventTime(e, now),
+		Footer:    calendarName,
+		Color:     "#7FC1EE",
+	}
+	p.addRSVP(attachment, u.UserID, e)
+
+	if _, appErr := p.createBotPost(&model.Post{
+		ChannelId: u.ChannelID,
+		Type:      model.POST_SLACK_ATTACHMENT,
+		Props: map[string]interface{}{
+			"attachments": []*model.SlackAttachment{attachment},
+		},
+	}); appErr != nil {
+		return appErr
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/calendar/v3"
+
+	"github.com/waseem18/mattermost-plugin-google-calendar/server/fakegoogle"
+)
+
+// respond clicks an RSVP button the way Mattermost does, returning the status code
+// and the reply of the plugin.
+func (e *testEnv) respond(t *testing.T, userID string, context map[string]interface{}) (int, *model.PostActionIntegrationResponse) {
+	request := &model.PostActionIntegrationRequest{UserId: userID, PostId: "post", Context: context}
+	resp, err := http.Post(e.mattermost.URL+"/plugins/google-calendar/event/respond", "application/json", bytes.NewReader(request.ToJson()))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, nil
+	}
+	return resp.StatusCode, model.PostActionIntegrationResponseFromJson(resp.Body)
+}
+
+func TestRespondToEvent(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	config := *e.p.getConfiguration()
+	config.EnableWriteAccess = true
+	e.p.setConfiguration(&config)
+	e.connected(t, testUserID)
+	e.api.On("GetPost", mock.AnythingOfType("string")).Return(nil, &model.AppError{Message: "not found"})
+
+	start := e.clock.Now().Add(time.Hour).Truncate(time.Second)
+	event, err := e.google.AddEvent(fakegoogle.PrimaryCalendarID, &calendar.Event{
+		Summary:   "Design review",
+		Start:     &calendar.EventDateTime{DateTime: start.Format(time.RFC3339)},
+		End:       &calendar.EventDateTime{DateTime: start.Add(time.Hour).Format(time.RFC3339)},
+		Organizer: &calendar.EventOrganizer{Email: "organizer@example.com"},
+		Attendees: []*calendar.EventAttendee{
+			{Email: "organizer@example.com", ResponseStatus: "accepted"},
+			{Email: fakegoogle.PrimaryCalendarID, Self: true, ResponseStatus: "needsAction"},
+		},
+	})
+	require.NoError(t, err)
+
+	selfResponse := func() string {
+		for _, stored := range e.google.Events(fakegoogle.PrimaryCalendarID) {
+			for _, attendee := range stored.Attendees {
+				if stored.Id == event.Id && attendee.Self {
+					return attendee.ResponseStatus
+				}
+			}
+		}
+		return ""
+	}
+
+	context := func(response, signature string) map[string]interface{} {
+		return map[string]interface{}{
+			"calendar_id": "primary",
+			"event_id":    event.Id,
+			"response":    response,
+			"signature":   signature,
+		}
+	}
+	signature := e.p.signIntegrationRequest(testUserID, "primary", event.Id)
+
+	// The buttons can't be replayed by another user, or for another event.
+	status, _ := e.respond(t, "user2", context("declined", signature))
+	assert.Equal(t, http.StatusUnauthorized, status)
+	status, _ = e.respond(t, testUserID, context("declined", e.p.signIntegrationRequest(testUserID, "primary", "another-event")))
+	assert.Equal(t, http.StatusUnauthorized, status)
+	status, _ = e.respond(t, testUserID, context("declined", ""))
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Equal(t, "needsAction", selfResponse())
+
+	status, reply := e.respond(t, testUserID, context("accepted", signature))
+	require.Equal(t, http.StatusOK, status)
+	assert.Empty(t, reply.EphemeralText)
+	assert.Equal(t, "accepted", selfResponse())
+
+	e.google.RateLimit(1)
+	status, reply = e.respond(t, testUserID, context("declined", signature))
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "Your calendar is receiving too many requests. Try again in a few minutes.", reply.EphemeralText)
+	assert.Equal(t, "accepted", selfResponse())
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/mlog"
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/pkg/errors"
+	"github.com/robfig/cron"
+)
+
+const (
+	connectedUsersKey = "connected_users"
+	schedulerLeaseKey = "scheduler_lease"
+
+	// schedulerLeaseDuration is how long a node keeps sending reminders after it
+	// last renewed its lease. It spans a couple of ticks so a single slow tick
+	// doesn't hand the lease over to another node.
+	schedulerLeaseDuration = 3 * time.Minute
+)
+
+// startScheduler starts the plugin-wide scheduler that checks the events of all
+// connected users every minute. In a cluster, every node runs the scheduler but
+// only the node holding the scheduler lease sends reminders.
+func (p *Plugin) startScheduler() {
+	p.stopScheduler()
+
+	p.nodeID = model.NewId()
+	p.restoreLock.Lock()
+	p.restored = false
+	p.restoreLock.Unlock()
+
+	p.cron = cron.New()
+	p.cron.AddFunc("@every 1m", p.runScheduledTasks)
+	p.cron.Start()
+}
+
+// stopScheduler stops the scheduler and releases the lease if this node holds it,
+// so another node can take over without waiting for it to expire.
+func (p *Plugin) stopScheduler() {
+	if p.cron == nil {
+		return
+	}
+
+	p.cron.Stop()
+	p.cron = nil
+
+	if lease, err := p.API.KVGet(schedulerLeaseKey); err == nil && string(lease) == p.nodeID {
+		p.API.KVDelete(schedulerLeaseKey)
+	}
+}
+
+func (p *Plugin) runScheduledTasks() {
+	if !p.acquireSchedulerLease() {
+		return
+	}
+
+	p.restoreConnectedUsersOnce()
+
+	userIDs, err := p.getConnectedUsers()
+	if err != nil {
+		mlog.Error("Error fetching the connected users " + err.Error())
+		return
+	}
+
+	if err := p.checkChannelSubscriptions(); err != nil {
+		mlog.Error("Error checking the channel subscriptions " + err.Error())
+	}
+
+	for _, userID := range userIDs {
+		if err := p.checkCalendarSync(userID); err != nil {
+			mlog.Error("Error syncing calendars", mlog.String("user_id", userID), mlog.Err(err))
+		}
+		if err := p.checkEvents(userID); err != nil {
+			mlog.Error("Error checking events", mlog.String("user_id", userID), mlog.Err(err))
+		}
+		if err := p.checkDigest(userID); err != nil {
+			mlog.Error("Error sending the daily digest", mlog.String("user_id", userID), mlog.Err(err))
+		}
+	}
+}
+
+// restoreConnectedUsersOnce restores the connected users unless this node already
+// did so since it started. It runs on the ticks of the scheduler, so a node that
+// couldn't take the lease when it started, e.g. because a stale lease was left
+// behind, still does so once it takes the lease over.
+func (p *Plugin) restoreConnectedUsersOnce() {
+	p.restoreLock.Lock()
+	defer p.restoreLock.Unlock()
+
+	if p.restored {
+		return
+	}
+
+	if err := p.restoreConnectedUsers(); err != nil {
+		mlog.Error("Error restoring the connected users, retrying on the next tick " + err.Error())
+		return
+	}
+
+	p.restored = true
+}
+
+// restoreConnectedUsers migrates the stored data, then brings the calendars of
+// the connected users up to date and renews their watch channels, as changes and
+// notifications may have been missed while the plugin wasn't running. It only
+// fails if the connected users can't be listed; the failures of single users are
+// logged, as the scheduler keeps checking their calendars.
+func (p *Plugin) restoreConnectedUsers() error {
+	if err := p.migrateConnectedUsers(); err != nil {
+		return errors.Wrap(err, "unable to build the connected users index")
+	}
+
+	if err := p.migrateUserTokens(); err != nil {
+		mlog.Error("Error encrypting the stored tokens " + err.Error())
+	}
+
+	if err := p.migrateDirectChannels(); err != nil {
+		mlog.Error("Error moving the reminders to the direct channels with the bot " + err.Error())
+	}
+
+	userIDs, err := p.getConnectedUsers()
+	if err != nil {
+		return errors.Wrap(err, "unable to fetch the connected users")
+	}
+
+	failedUserIDs := []string{}
+	for _, userID := range userIDs {
+		if err := p.restoreConnectedUser(userID); err != nil {
+			mlog.Warn("Unable to restore the calendar of a connected user", mlog.String("user_id", userID), mlog.Err(err))
+			failedUserIDs = append(failedUserIDs, userID)
+		}
+	}
+
+	mlog.Info("Restored the calendars of connected users",
+		mlog.Int("restored", len(userIDs)-len(failedUserIDs)),
+		mlog.Int("failed", len(failedUserIDs)),
+		mlog.String("failed_user_ids", strings.Join(failedUserIDs, ",")))
+
+	return nil
+}
+
+func (p *Plugin) restoreConnectedUser(userID string) error {
+	userInfo, err := p.getUserInfo(userID)
+	if err != nil {
+		p.handleUserInfoError(userID, err)
+		return err
+	}
+	if userInfo == nil {
+		return errors.New("user is no longer connected")
+	}
+
+	calendarInfo, err := p.getCalendarInfo(userID)
+	if err != nil {
+		return err
+	}
+	if calendarInfo == nil {
+		return errors.New("no calendar information stored")
+	}
+
+	// Refreshing the token first tells apart users whose authorization is no
+	// longer valid from transient failures further down.
+	if _, err := p.getCalendarProvider(userInfo); err != nil {
+		return errors.Wrap(err, "unable to refresh the token")
+	}
+
+	for _, subscribedCalendar := range calendarInfo.Calendars {
+		if err := p.updateCalendarEvents(userInfo, subscribedCalendar.ID); err != nil {
+			return errors.Wrapf(err, "unable to update the events of calendar %s", subscribedCalendar.ID)
+		}
+	}
+
+	if err := p.setupWatchRenewal(userID); err != nil {
+		return errors.Wrap(err, "unable to renew the watch channel")
+	}
+
+	return nil
+}
+
+// acquireSchedulerLease takes or renews the scheduler lease, returning whether
+// this node holds it. The lease expires on its own if the holding node goes away.
+func (p *Plugin) acquireSchedulerLease() bool {
+	lease, appErr := p.API.KVGet(schedulerLeaseKey)
+	if appErr != nil {
+		mlog.Error("Error fetching the scheduler lease " + appErr.Error())
+		return false
+	}
+
+	if lease != nil && string(lease) != p.nodeID {
+		return false
+	}
+
+	if appErr := p.API.KVSetWithExpiry(schedulerLeaseKey, []byte(p.nodeID), int64(schedulerLeaseDuration/time.Second)); appErr != nil {
+		mlog.Error("Error storing the scheduler lease " + appErr.Error())
+		return false
+	}
+
+	// Another node may have taken the free lease at the same time, in which
+	// case the last write wins.
+	lease, appErr = p.API.KVGet(schedulerLeaseKey)
+	if appErr != nil {
+		return false
+	}
+
+	return string(lease) == p.nodeID
+}
+
+// getConnectedUsers returns the IDs of the users who connected their calendar.
+func (p *Plugin) getConnectedUsers() ([]string, error) {
+	var userIDs []string
+
+	if info, appErr := p.API.KVGet(connectedUsersKey); appErr != nil {
+		return nil, appErr
+	} else if info == nil {
+		return nil, nil
+	} else if err := json.Unmarshal(info, &userIDs); err != nil {
+		return nil, err
+	}
+
+	return userIDs, nil
+}
+
+func (p *Plugin) storeConnectedUsers(userIDs []string) error {
+	jsonUserIDs, err := json.Marshal(userIDs)
+	if err != nil {
+		return err
+	}
+
+	if err := p.API.KVSet(connectedUsersKey, jsonUserIDs); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// addConnectedUser adds the user to the connected users index. Updates of the
+// index are serialized, so that users connecting or disconnecting at the same
+// time don't drop each other from it. As with updateCalendarInfo, they are only
+// serialized within a node.
+func (p *Plugin) addConnectedUser(userID string) error {
+	p.connectedUsersLock.Lock()
+	defer p.connectedUsersLock.Unlock()
+
+	userIDs, err := p.getConnectedUsers()
+	if err != nil {
+		return err
+	}
+
+	for _, id := range userIDs {
+		if id == userID {
+			return nil
+		}
+	}
+
+	return p.storeConnectedUsers(append(userIDs, userID))
+}
+
+// removeConnectedUser removes the user from the connected users index.
+func (p *Plugin) removeConnectedUser(userID string) error {
+	p.connectedUsersLock.Lock()
+	defer p.connectedUsersLock.Unlock()
+
+	userIDs, err := p.getConnectedUsers()
+	if err != nil {
+		return err
+	}
+
+	for index, id := range userIDs {
+		if id == userID {
+			return p.storeConnectedUsers(append(userIDs[:index], userIDs[index+1:]...))
+		}
+	}
+
+	return nil
+}
+
+// checkCalendarSync syncs the calendars of the user that haven't been fully
+// synced for fullSyncInterval, so events entering the sync window are stored, the
+// polled calendars that haven't been synced for pollInterval, and the calendars
+// whose last sync was rate limited.
+func (p *Plugin) checkCalendarSync(userID string) error {
+	calendarInfo, err := p.getCalendarInfo(userID)
+	if err != nil || calendarInfo == nil {
+		return err
+	}
+
+	var userInfo *UserInfo
+	for _, subscribedCalendar := range calendarInfo.Calendars {
+		fullSyncDue := p.now().Sub(time.Unix(subscribedCalendar.LastFullSync, 0)) > fullSyncInterval
+		pollDue := subscribedCalendar.Polled && p.now().Sub(time.Unix(subscribedCalendar.LastSync, 0)) >= pollInterval
+		if !fullSyncDue && !pollDue && !subscribedCalendar.SyncPending {
+			continue
+		}
+
+		if userInfo == nil {
+			if userInfo, err = p.getUserInfo(userID); err != nil || userInfo == nil {
+				return err
+			}
+		}
+
+		if err := p.updateCalendarEvents(userInfo, subscribedCalendar.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/model"
+)
+
+const (
+	userSettingsKey = "_usersettings"
+
+	// maxReminderLeadTime is the longest lead time a user can configure for a reminder.
+	maxReminderLeadTime = 7 * 24 * time.Hour
+)
+
+// defaultReminderLeadTimes is used for users who haven't configured their reminders.
+var defaultReminderLeadTimes = []int{10}
+
+// defaultAllDayReminderTime is used for users who haven't configured when to be
+// reminded of all-day events.
+const defaultAllDayReminderTime = "08:00"
+
+// UserSettings captures the preferences a user has configured for the plugin.
+type UserSettings struct {
+	// ReminderLeadTimes lists, in minutes, how long before the start of an event
+	// a reminder is posted. A lead time of 0 posts the reminder when the event starts.
+	ReminderLeadTimes []int
+
+	// AllDayReminderTime is the local time of day, formatted as "15:04", at which
+	// all-day events are announced on their first day. Empty if turned off.
+	AllDayReminderTime string
+
+	// DigestTime is the local time of day, formatted as "15:04", at which the daily
+	// digest is posted. Empty if the user hasn't opted in.
+	DigestTime string
+
+	// DigestSkipWeekends skips the daily digest on Saturdays and Sundays.
+	DigestSkipWeekends bool
+
+	// AvailabilityVisibility is who can look up the user's free/busy information:
+	// everyone, the members of a team the user belongs to, or nobody.
+	AvailabilityVisibility string
+
+	// MeetingStatus is the status, dnd or away, the user's status is set to during
+	// meetings. Empty if the user hasn't opted in.
+	MeetingStatus string
+}
+
+func (p *Plugin) storeUserSettings(userID string, settings *UserSettings) error {
+	jsonSettings, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+
+	if err := p.API.KVSet(userID+userSettingsKey, jsonSettings); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// getUserSettings returns the settings of a user, falling back to the defaults
+// if the user hasn't configured anything yet.
+func (p *Plugin) getUserSettings(userID string) (*UserSettings, error) {
+	settings := UserSettings{
+		ReminderLeadTimes:      append([]int{}, defaultReminderLeadTimes...),
+		AllDayReminderTime:     defaultAllDayReminderTime,
+		AvailabilityVisibility: availabilityEveryone,
+	}
+
+	if info, err := p.API.KVGet(userID + userSettingsKey); err != nil {
+		return nil, err
+	} else if info == nil {
+		return &settings, nil
+	} else if err := json.Unmarshal(info, &settings); err != nil {
+		return nil, err
+	}
+
+	return &settings, nil
+}
+
+func (p *Plugin) executeSettingsCommand(args *model.CommandArgs, parameters []string) *model.CommandResponse {
+	setting := ""
+	if len(parameters) > 0 {
+		setting = parameters[0]
+	}
+
+	switch setting {
+	case "reminders":
+		return p.executeRemindersSetting(args.UserId, parameters[1:])
+	case "allday":
+		return p.executeAllDaySetting(args.UserId, parameters[1:])
+	case "digest":
+		return p.executeDigestSetting(args.UserId, parameters[1:])
+	case "availability":
+		return p.executeAvailabilitySetting(args.UserId, parameters[1:])
+	case "meetingstatus":
+		return p.executeMeetingStatusSetting(args.UserId, parameters[1:])
+	default:
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, "Available settings: reminders, allday, digest, availability, meetingstatus")
+	}
+}
+
+func (p *Plugin) executeRemindersSetting(userID string, values []string) *model.CommandResponse {
+	settings, err := p.getUserSettings(userID)
+	if err != nil {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, "Encountered an error fetching your settings.")
+	}
+
+	if len(values) == 0 {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, fmt.Sprintf(
+			"Reminders are posted %s. Change them with `/google-calendar settings reminders <lead times>`, e.g. `1d 1h 10m start`, or turn them off with `off`.",
+			describeLeadTimes(settings.ReminderLeadTimes)))
+	}
+
+	leadTimes, err := parseLeadTimes(values)
+	if err != nil {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, err.Error())
+	}
+
+	settings.ReminderLeadTimes = leadTimes
+	if err := p.storeUserSettings(userID, settings); err != nil {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, "Encountered an error saving your settings.")
+	}
+
+	return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, fmt.Sprintf("Reminders will be posted %s.", describeLeadTimes(leadTimes)))
+}
+
+func (p *Plugin) executeAllDaySetting(userID string, values []string) *model.CommandResponse {
+	settings, err := p.getUserSettings(userID)
+	if err != nil {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, "Encountered an error fetching your settings.")
+	}
+
+	if len(values) == 0 {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, fmt.Sprintf(
+			"All-day events are announced %s. Change it with `/google-calendar settings allday <time>`, e.g. `8:00`, or turn it off with `off`.",
+			describeAllDayReminderTime(settings.AllDayReminderTime)))
+	}
+
+	reminderTime, err := parseTimeOfDay(values[0])
+	if err != nil {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, err.Error())
+	}
+
+	settings.AllDayReminderTime = reminderTime
+	if err := p.storeUserSettings(userID, settings); err != nil {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, "Encountered an error saving your settings.")
+	}
+
+	return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, fmt.Sprintf("All-day events will be announced %s.", describeAllDayReminderTime(reminderTime)))
+}
+
+func (p *Plugin) executeDigestSetting(userID string, values []string) *model.CommandResponse {
+	settings, err := p.getUserSettings(userID)
+	if err != nil {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, "Encountered an error fetching your settings.")
+	}
+
+	if len(values) == 0 {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, fmt.Sprintf(
+			"The daily digest is posted %s. Change it with `/google-calendar settings digest <time> [weekdays|everyday]`, e.g. `8:30 weekdays`, or turn it off with `off`.",
+			describeDigestTime(settings)))
+	}
+
+	digestTime, err := parseTimeOfDay(values[0])
+	if err != nil {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, err.Error())
+	}
+
+	if len(values) > 1 {
+		switch strings.ToLower(values[1]) {
+		case "weekdays":
+			settings.DigestSkipWeekends = true
+		case "everyday":
+			settings.DigestSkipWeekends = false
+		default:
+			return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, fmt.Sprintf("Invalid option `%s`. Use `weekdays` or `everyday`.", values[1]))
+		}
+	}
+
+	settings.DigestTime = digestTime
+	if err := p.storeUserSettings(userID, settings); err != nil {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, "Encountered an error saving your settings.")
+	}
+
+	return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, fmt.Sprintf("The daily digest will be posted %s.", describeDigestTime(settings)))
+}
+
+func (p *Plugin) executeAvailabilitySetting(userID string, values []string) *model.CommandResponse {
+	settings, err := p.getUserSettings(userID)
+	if err != nil {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, "Encountered an error fetching your settings.")
+	}
+
+	if len(values) == 0 {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, fmt.Sprintf(
+			"Your availability can be looked up by %s. Change it with `/google-calendar settings availability <everyone|team|nobody>`.",
+			describeAvailabilityVisibility(settings.AvailabilityVisibility)))
+	}
+
+	visibility := strings.ToLower(values[0])
+	if visibility != availabilityEveryone && visibility != availabilityTeam && visibility != availabilityNobody {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, fmt.Sprintf("Invalid option `%s`. Use `everyone`, `team` or `nobody`.", values[0]))
+	}
+
+	settings.AvailabilityVisibility = visibility
+	if err := p.storeUserSettings(userID, settings); err != nil {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, "Encountered an error saving your settings.")
+	}
+
+	return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, fmt.Sprintf("Your availability can now be looked up by %s.", describeAvailabilityVisibility(visibility)))
+}
+
+func describeAvailabilityVisibility(visibility string) string {
+	switch visibility {
+	case availabilityEveryone:
+		return "everyone"
+	case availabilityTeam:
+		return "the members of your teams"
+	default:
+		return "nobody"
+	}
+}
+
+func describeDigestTime(settings *UserSettings) string {
+	if settings.DigestTime == "" {
+		return "never"
+	}
+	if settings.DigestSkipWeekends {
+		return fmt.Sprintf("at %s on weekdays", settings.DigestTime)
+	}
+	return fmt.Sprintf("at %s every day", settings.DigestTime)
+}
+
+// parseTimeOfDay parses a time of day such as "8:00", "17:30" or "8:30am" into the
+// "15:04" format. "off" parses to an empty string.
+func parseTimeOfDay(value string) (string, error) {
+	value = strings.ToLower(value)
+	if value == "off" || value == "none" {
+		return "", nil
+	}
+
+	for _, layout := range []string{"15:04", "3:04pm", "3pm"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.Format("15:04"), nil
+		}
+	}
+
+	return "", fmt.Errorf("Invalid time `%s`. Use a time of day such as `8:00`, `17:30` or `8:30am`.", value)
+}
+
+func describeAllDayReminderTime(reminderTime string) string {
+	if reminderTime == "" {
+		return "never"
+	}
+	return fmt.Sprintf("at %s on the day they start", reminderTime)
+}
+
+// parseLeadTimes parses lead times such as "1d", "1h", "10m" or "start", separated by
+// spaces or commas, into a sorted list of distinct minute values.
+func parseLeadTimes(values []string) ([]int, error) {
+	fields := strings.FieldsFunc(strings.Join(values, " "), func(r rune) bool {
+		return r == ' ' || r == ','
+	})
+
+	if len(fields) == 1 && (fields[0] == "off" || fields[0] == "none") {
+		return []int{}, nil
+	}
+
+	seen := map[int]bool{}
+	leadTimes := []int{}
+	for _, field := range fields {
+		leadTime, err := parseLeadTime(field)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[leadTime] {
+			seen[leadTime] = true
+			leadTimes = append(leadTimes, leadTime)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(leadTimes)))
+
+	return leadTimes, nil
+}
+
+// parseLeadTime parses a single lead time into minutes.
+func parseLeadTime(value string) (int, error) {
+	value = strings.ToLower(value)
+	if value == "start" || value == "now" || value == "0" {
+		return 0, nil
+	}
+
+	invalid := fmt.Errorf("Invalid lead time `%s`. Use a number followed by d, h or m, e.g. `1d`, `1h` or `10m`, or `start`.", value)
+	if len(value) < 2 {
+		return 0, invalid
+	}
+
+	amount, err := strconv.Atoi(value[:len(value)-1])
+	if err != nil || amount <= 0 {
+		return 0, invalid
+	}
+
+	var unit time.Duration
+	switch value[len(value)-1] {
+	case 'd':
+		unit = 24 * time.Hour
+	case 'h':
+		unit = time.Hour
+	case 'm':
+		unit = time.Minute
+	default:
+		return 0, invalid
+	}
+
+	leadTime := time.Duration(amount) * unit
+	if leadTime > maxReminderLeadTime {
+		return 0, fmt.Errorf("Lead time `%s` is too long. Reminders can be posted at most %s before an event.", value, formatLeadTime(int(maxReminderLeadTime/time.Minute)))
+	}
+
+	return int(leadTime / time.Minute), nil
+}
+
+// describeLeadTimes lists the lead times in a human readable sentence fragment.
+func describeLeadTimes(leadTimes []int) string {
+	if len(leadTimes) == 0 {
+		return "never"
+	}
+
+	descriptions := []string{}
+	for _, leadTime := range leadTimes {
+		if leadTime == 0 {
+			descriptions = append(descriptions, "when the event starts")
+		} else {
+			descriptions = append(descriptions, formatLeadTime(leadTime)+" before")
+		}
+	}
+
+	return strings.Join(descriptions, ", ")
+}
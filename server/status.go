@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/mlog"
+	"github.com/mattermost/mattermost-server/model"
+)
+
+// inMeeting returns whether one of the events takes up the user's time at the
+// given time: it is timed, in progress, not marked as free and not declined.
+func inMeeting(events []EventInfo, now time.Time) bool {
+	for _, e := range events {
+		if e.AllDay || e.Transparent || e.ResponseStatus == "declined" {
+			continue
+		}
+
+		start, end, err := eventTimes(e, now.Location())
+		if err != nil {
+			continue
+		}
+		if !now.Before(start) && now.Before(end) {
+			return true
+		}
+	}
+	return false
+}
+
+// updateMeetingStatus sets the user's status to the one configured for meetings
+// when a meeting starts, and restores the previous status when it ends. It returns
+// whether calendarInfo was changed and has to be stored.
+func (p *Plugin) updateMeetingStatus(userID string, calendarInfo *CalendarInfo, settings *UserSettings, now time.Time) bool {
+	meeting := settings.MeetingStatus != "" && inMeeting(calendarInfo.personalEvents(), now)
+
+	if meeting && calendarInfo.StatusBeforeMeeting == "" {
+		status, appErr := p.API.GetUserStatus(userID)
+		if appErr != nil {
+			mlog.Error("Error fetching the user status", mlog.String("user_id", userID), mlog.Err(appErr))
+			return false
+		}
+
+		// Users who are offline or already set the status themselves are left alone.
+		if status.Status == model.STATUS_OFFLINE || status.Status == settings.MeetingStatus {
+			return false
+		}
+
+		if _, appErr := p.API.UpdateUserStatus(userID, settings.MeetingStatus); appErr != nil {
+			mlog.Error("Error setting the meeting status", mlog.String("user_id", userID), mlog.Err(appErr))
+			return false
+		}
+		calendarInfo.StatusBeforeMeeting = status.Status
+		calendarInfo.StatusBeforeMeetingManual = status.Manual
+		calendarInfo.MeetingStatus = settings.MeetingStatus
+		return true
+	}
+
+	if !meeting && calendarInfo.StatusBeforeMeeting != "" {
+		// The previous status is only restored if the user didn't change their
+		// status during the meeting.
+		if status, appErr := p.API.GetUserStatus(userID); appErr == nil && status.Status == calendarInfo.MeetingStatus {
+			previousStatus := calendarInfo.StatusBeforeMeeting
+			if !calendarInfo.StatusBeforeMeetingManual {
+				// A status set automatically, e.g. away when idle, isn't set
+				// back, as that would keep it until the user changes it. Setting
+				// the status to online clears the meeting status so Mattermost
+				// updates it automatically again.
+				previousStatus = model.STATUS_ONLINE
+			}
+			if _, appErr := p.API.UpdateUserStatus(userID, previousStatus); appErr != nil {
+				mlog.Error("Error restoring the status", mlog.String("user_id", userID), mlog.Err(appErr))
+				return false
+			}
+		}
+		calendarInfo.StatusBeforeMeeting = ""
+		calendarInfo.StatusBeforeMeetingManual = false
+		calendarInfo.MeetingStatus = ""
+		return true
+	}
+
+	return false
+}
+
+func (p *Plugin) executeMeetingStatusSetting(userID string, values []string) *model.CommandResponse {
+	settings, err := p.getUserSettings(userID)
+	if err != nil {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, "Encountered an error fetching your settings.")
+	}
+
+	if len(values) == 0 {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, fmt.Sprintf(
+			"Your status %s. Change it with `/google-calendar settings meetingstatus <dnd|away|off>`.",
+			describeMeetingStatus(settings.MeetingStatus)))
+	}
+
+	switch status := strings.ToLower(values[0]); status {
+	case model.STATUS_DND, model.STATUS_AWAY:
+		settings.MeetingStatus = status
+	case "off", "none":
+		settings.MeetingStatus = ""
+	default:
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, fmt.Sprintf("Invalid option `%s`. Use `dnd`, `away` or `off`.", values[0]))
+	}
+
+	if err := p.storeUserSettings(userID, settings); err != nil {
+		return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, "Encountered an error saving your settings.")
+	}
+
+	return getCommandResponse(model.COMMAND_RESPONSE_TYPE_EPHEMERAL, fmt.Sprintf("Your status %s.", describeMeetingStatus(settings.MeetingStatus)))
+}
+
+func describeMeetingStatus(status string) string {
+	switch status {
+	case model.STATUS_DND:
+		return "is set to Do Not Disturb during meetings"
+	case model.STATUS_AWAY:
+		return "is set to Away during meetings"
+	default:
+		return "isn't changed during meetings"
+	}
+}
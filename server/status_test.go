@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-server/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/waseem18/mattermost-plugin-google-calendar/server/fakegoogle"
+)
+
+func TestMeetingStatus(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		before   model.Status
+		restored string
+	}{
+		{"status set by the user", model.Status{Status: model.STATUS_AWAY, Manual: true}, model.STATUS_AWAY},
+		{"status set automatically", model.Status{Status: model.STATUS_AWAY}, model.STATUS_ONLINE},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			defer e.close()
+			userInfo := e.connected(t, testUserID)
+			require.NoError(t, e.p.storeUserSettings(testUserID, &UserSettings{
+				ReminderLeadTimes:  defaultReminderLeadTimes,
+				AllDayReminderTime: defaultAllDayReminderTime,
+				MeetingStatus:      model.STATUS_DND,
+			}))
+
+			status := tc.before
+			updates := []string{}
+			e.api.On("GetUserStatus", testUserID).Return(
+				func(userID string) *model.Status {
+					current := status
+					return &current
+				},
+				func(userID string) *model.AppError { return nil },
+			)
+			e.api.On("UpdateUserStatus", testUserID, mock.AnythingOfType("string")).Return(
+				func(userID, newStatus string) *model.Status {
+					status = model.Status{Status: newStatus, Manual: newStatus != model.STATUS_ONLINE}
+					updates = append(updates, newStatus)
+					return &status
+				},
+				func(userID, newStatus string) *model.AppError { return nil },
+			)
+
+			e.addEvent(t, fakegoogle.PrimaryCalendarID, "Design review", -5*time.Minute, 30*time.Minute)
+			require.NoError(t, e.p.updateCalendarEvents(userInfo, "primary"))
+
+			require.NoError(t, e.p.checkEvents(testUserID))
+			assert.Equal(t, []string{model.STATUS_DND}, updates)
+
+			e.clock.set(e.clock.Now().Add(30 * time.Minute))
+			require.NoError(t, e.p.checkEvents(testUserID))
+			assert.Equal(t, []string{model.STATUS_DND, tc.restored}, updates)
+
+			calendarInfo, err := e.p.getCalendarInfo(testUserID)
+			require.NoError(t, err)
+			assert.Empty(t, calendarInfo.StatusBeforeMeeting)
+			assert.False(t, calendarInfo.StatusBeforeMeetingManual)
+		})
+	}
+}
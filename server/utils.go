@@ -2,26 +2,149 @@ package main
 
 import (
 	"fmt"
+	"math"
+	"strings"
 	"time"
 
 	"github.com/mattermost/mattermost-server/model"
 )
 
 // formatTime formats time to the format HH:MM
-func formatTime(eventTime string) string {
-	timeObject, _ := time.Parse(time.RFC3339, eventTime)
-	formattedTime := timeObject.Format("3:04PM")
-	return formattedTime
+func formatTime(t time.Time) string {
+	return t.Format("3:04PM")
 }
 
-func generateSlackAttachment(e EventInfo) *model.SlackAttachment {
-	eventMessage := fmt.Sprintf("Today from %s to %s", e.StartTime, e.EndTime)
+// formatDay describes the day of t relative to now, e.g. "Today", "Tomorrow",
+// "Friday" within the coming week and "Mon, Jan 2" otherwise.
+func formatDay(t, now time.Time) string {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, now.Location())
+
+	switch days := int(math.Round(day.Sub(today).Hours() / 24)); {
+	case days == 0:
+		return "Today"
+	case days == 1:
+		return "Tomorrow"
+	case days == -1:
+		return "Yesterday"
+	case days > 1 && days < 7:
+		return t.Format("Monday")
+	default:
+		return t.Format("Mon, Jan 2")
+	}
+}
+
+// eventTimes returns the start and end of the event in the given location. The
+// dates of all-day events are interpreted as midnight in that location, so the
+// end of an all-day event is the midnight following its last day.
+func eventTimes(e EventInfo, location *time.Location) (time.Time, time.Time, error) {
+	layout := time.RFC3339
+	if e.AllDay {
+		layout = "2006-01-02"
+	}
+
+	start, err := time.ParseInLocation(layout, e.StartTime, location)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	end, err := time.ParseInLocation(layout, e.EndTime, location)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	return start.In(location), end.In(location), nil
+}
+
+// formatEventTime describes when an event takes place in the timezone of now,
+// e.g. "Today from 3:00PM to 4:00PM", "Today, all day" or "Mon–Wed".
+func formatEventTime(e EventInfo, now time.Time) string {
+	start, end, err := eventTimes(e, now.Location())
+	if err != nil {
+		return ""
+	}
+
+	if e.AllDay {
+		last := end.AddDate(0, 0, -1)
+		if !last.After(start) {
+			return fmt.Sprintf("%s, all day", formatDay(start, now))
+		}
+		if last.Sub(start) < 7*24*time.Hour {
+			return fmt.Sprintf("%s–%s", start.Format("Mon"), last.Format("Mon"))
+		}
+		return fmt.Sprintf("%s–%s", start.Format("Jan 2"), last.Format("Jan 2"))
+	}
+
+	if formatDay(start, now) != formatDay(end, now) {
+		return fmt.Sprintf("%s at %s until %s at %s", formatDay(start, now), formatTime(start), formatDay(end, now), formatTime(end))
+	}
+	return fmt.Sprintf("%s from %s to %s", formatDay(start, now), formatTime(start), formatTime(end))
+}
+
+// formatLeadTime formats a lead time given in minutes, e.g. "1 day", "2 hours" or "10 min".
+func formatLeadTime(minutes int) string {
+	parts := []string{}
+
+	if days := minutes / (24 * 60); days > 0 {
+		parts = append(parts, pluralize(days, "day"))
+		minutes -= days * 24 * 60
+	}
+
+	if hours := minutes / 60; hours > 0 {
+		parts = append(parts, pluralize(hours, "hour"))
+		minutes -= hours * 60
+	}
+
+	if minutes > 0 {
+		parts = append(parts, fmt.Sprintf("%d min", minutes))
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func pluralize(count int, unit string) string {
+	if count == 1 {
+		return fmt.Sprintf("%d %s", count, unit)
+	}
+	return fmt.Sprintf("%d %ss", count, unit)
+}
+
+// reminderPretext returns the pretext of a reminder of the event posted at now,
+// with the time actually left before its start, rounded up to the minute, as
+// the reminder may be posted after its lead time, e.g. after a skipped tick.
+func reminderPretext(e EventInfo, now time.Time) string {
+	start, end, err := eventTimes(e, now.Location())
+	if e.AllDay {
+		if err == nil && end.Sub(start) > 24*time.Hour {
+			return "Multi-day event starting today"
+		}
+		return "All-day event today"
+	}
+	if err != nil {
+		return "Event starting now"
+	}
+
+	left := start.Sub(now)
+	if left > 0 {
+		return fmt.Sprintf("Event starting in %s", formatLeadTime(int((left+time.Minute-1)/time.Minute)))
+	}
+	if started := int(-left / time.Minute); started > 0 {
+		return fmt.Sprintf("Event started %s ago", formatLeadTime(started))
+	}
+	return "Event starting now"
+}
+
+// generateSlackAttachment renders a reminder for the event of the named calendar
+// posted at now, with times shown in the timezone of now.
+func generateSlackAttachment(e EventInfo, calendarName string, now time.Time) *model.SlackAttachment {
+	eventMessage := formatEventTime(e, now)
 
 	event := &model.SlackAttachment{
-		Pretext:   postPretext,
+		Pretext:   reminderPretext(e, now),
 		Title:     e.Summary,
 		TitleLink: e.HtmlLink,
 		Text:      eventMessage,
+		Footer:    calendarName,
 		Color:     "#7FC1EE",
 	}
 	return event
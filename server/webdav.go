@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// webdavTimeout bounds each request to a CalDAV server.
+	webdavTimeout = 30 * time.Second
+
+	// webdavMaxRedirects is how many redirects are followed, e.g. from the
+	// /.well-known/caldav URL to the actual endpoint.
+	webdavMaxRedirects = 5
+)
+
+// webdavClient sends WebDAV requests to a CalDAV server with the basic
+// credentials of a user. Requests are only sent to the origin of the server, so
+// that neither hrefs returned by the server nor calendar IDs entered by users can
+// send the credentials elsewhere.
+type webdavClient struct {
+	client   *http.Client
+	origin   *url.URL
+	username string
+	password string
+}
+
+func newWebdavClient(origin *url.URL, username, password string) *webdavClient {
+	return &webdavClient{
+		client: &http.Client{
+			Timeout: webdavTimeout,
+			// Redirects are followed by do, as the HTTP client turns WebDAV
+			// methods into GET requests when following 301 and 302 redirects.
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		origin:   origin,
+		username: username,
+		password: password,
+	}
+}
+
+// sameOrigin returns whether two URLs have the same scheme and host.
+func sameOrigin(a, b *url.URL) bool {
+	return strings.EqualFold(a.Scheme, b.Scheme) && strings.EqualFold(a.Host, b.Host)
+}
+
+// resolvePath resolves a path, such as a calendar ID, against a URL of the
+// server. Absolute URLs are rejected.
+func resolvePath(base *url.URL, path string) (*url.URL, error) {
+	ref, err := url.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+	if ref.Scheme != "" || ref.Host != "" || ref.User != nil || ref.Opaque != "" {
+		return nil, fmt.Errorf("%s isn't a path", path)
+	}
+	return base.ResolveReference(ref), nil
+}
+
+// do sends a request, following redirects with the same method, and returns the
+// response along with the URL it was received from. Requests and redirects to
+// another origin than the server's are refused. Authentication failures are
+// returned as errAuthorizationRevoked and other failures with their status.
+func (c *webdavClient) do(method, target string, headers map[string]string, body string) (*http.Response, *url.URL, error) {
+	for redirects := 0; ; redirects++ {
+		var bodyReader io.Reader
+		if body != "" {
+			bodyReader = strings.NewReader(body)
+		}
+
+		req, err := http.NewRequest(method, target, bodyReader)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !sameOrigin(req.URL, c.origin) {
+			return nil, nil, fmt.Errorf("refusing to send %s to %s://%s, outside of the CalDAV server %s://%s", method, req.URL.Scheme, req.URL.Host, c.origin.Scheme, c.origin.Host)
+		}
+		req.SetBasicAuth(c.username, c.password)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if location := resp.Header.Get("Location"); location != "" && resp.StatusCode >= 300 && resp.StatusCode < 400 && redirects < webdavMaxRedirects {
+			resp.Body.Close()
+			next, err := req.URL.Parse(location)
+			if err != nil {
+				return nil, nil, err
+			}
+			target = next.String()
+			continue
+		}
+
+		if resp.StatusCode >= 300 {
+			resp.Body.Close()
+			err := fmt.Errorf("%s %s failed with status %d", method, req.URL.Path, resp.StatusCode)
+			switch resp.StatusCode {
+			case http.StatusUnauthorized:
+				return nil, nil, errors.Wrap(errAuthorizationRevoked, err.Error())
+			case http.StatusForbidden:
+				return nil, nil, errors.Wrap(errPermissionDenied, err.Error())
+			case http.StatusTooManyRequests:
+				return nil, nil, errors.Wrap(errRateLimited, err.Error())
+			}
+			return nil, nil, err
+		}
+
+		return resp, req.URL, nil
+	}
+}
+
+// propfind requests properties of a resource, and of its members if depth is "1".
+func (c *webdavClient) propfind(target, depth, props string) (*multistatus, error) {
+	return c.multistatus("PROPFIND", target, depth, `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:caldav" xmlns:cs="http://calendarserver.org/ns/">
+	<d:prop>`+props+`</d:prop>
+</d:propfind>`)
+}
+
+// report sends a REPORT request, such as a calendar-query.
+func (c *webdavClient) report(target, depth, body string) (*multistatus, error) {
+	return c.multistatus("REPORT", target, depth, body)
+}
+
+func (c *webdavClient) multistatus(method, target, depth, body string) (*multistatus, error) {
+	resp, responseURL, err := c.do(method, target, map[string]string{
+		"Content-Type": "application/xml; charset=utf-8",
+		"Depth":        depth,
+	}, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var ms multistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, errors.Wrapf(err, "invalid response to %s %s", method, responseURL.Path)
+	}
+	ms.url = responseURL
+	return &ms, nil
+}
+
+// get returns the content and ETag of a resource.
+func (c *webdavClient) get(target string) (string, string, error) {
+	resp, _, err := c.do(http.MethodGet, target, nil, "")
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", "", err
+	}
+	return string(data), resp.Header.Get("ETag"), nil
+}
+
+// put stores an iCalendar object. With an ETag, it only replaces the resource if
+// it wasn't changed since; without one, it only creates a new resource.
+func (c *webdavClient) put(target, etag, data string) error {
+	headers := map[string]string{"Content-Type": "text/calendar; charset=utf-8"}
+	if etag != "" {
+		headers["If-Match"] = etag
+	} else {
+		headers["If-None-Match"] = "*"
+	}
+
+	resp, _, err := c.do(http.MethodPut, target, headers, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// multistatus captures a WebDAV multi-status response.
+type multistatus struct {
+	Responses []davResponse `xml:"DAV: response"`
+
+	// url is the URL the response was received from, against which its hrefs are resolved.
+	url *url.URL
+}
+
+type davResponse struct {
+	Href      string        `xml:"DAV: href"`
+	Status    string        `xml:"DAV: status"`
+	Propstats []davPropstat `xml:"DAV: propstat"`
+}
+
+type davPropstat struct {
+	Status string  `xml:"DAV: status"`
+	Prop   davProp `xml:"DAV: prop"`
+}
+
+// davProp captures the properties requested by the plugin.
+type davProp struct {
+	CurrentUserPrincipal   davHrefs `xml:"DAV: current-user-principal"`
+	CalendarHomeSet        davHrefs `xml:"urn:ietf:params:xml:ns:caldav calendar-home-set"`
+	CalendarUserAddressSet davHrefs `xml:"urn:ietf:params:xml:ns:caldav calendar-user-address-set"`
+
+	DisplayName  string `xml:"DAV: displayname"`
+	ResourceType struct {
+		Calendar *struct{} `xml:"urn:ietf:params:xml:ns:caldav calendar"`
+	} `xml:"DAV: resourcetype"`
+	SupportedComponents struct {
+		Components []struct {
+			Name string `xml:"name,attr"`
+		} `xml:"urn:ietf:params:xml:ns:caldav comp"`
+	} `xml:"urn:ietf:params:xml:ns:caldav supported-calendar-component-set"`
+
+	CTag         string `xml:"http://calendarserver.org/ns/ getctag"`
+	ETag         string `xml:"DAV: getetag"`
+	CalendarData string `xml:"urn:ietf:params:xml:ns:caldav calendar-data"`
+}
+
+type davHrefs struct {
+	Hrefs []string `xml:"DAV: href"`
+}
+
+// prop returns the properties found for the resource, skipping those reported
+// with an error status such as 404 Not Found.
+func (r *davResponse) prop() davProp {
+	for _, propstat := range r.Propstats {
+		if strings.Contains(propstat.Status, " 200 ") {
+			return propstat.Prop
+		}
+	}
+	return davProp{}
+}
+
+// found returns whether the resource was found, i.e. isn't reported as removed.
+func (r *davResponse) found() bool {
+	return !strings.Contains(r.Status, " 404 ")
+}
+
+// resolve returns the absolute URL of an href of the response, which has to be
+// on the server the response was received from.
+func (ms *multistatus) resolve(href string) (*url.URL, error) {
+	resolved, err := ms.url.Parse(strings.TrimSpace(href))
+	if err != nil {
+		return nil, err
+	}
+	if !sameOrigin(resolved, ms.url) {
+		return nil, fmt.Errorf("%s is outside of the CalDAV server", href)
+	}
+	return resolved, nil
+}
+
+// isCalendar returns whether the resource is a calendar holding events, as
+// opposed to e.g. a task list.
+func (p davProp) isCalendar() bool {
+	if p.ResourceType.Calendar == nil {
+		return false
+	}
+	if len(p.SupportedComponents.Components) == 0 {
+		return true
+	}
+	for _, component := range p.SupportedComponents.Components {
+		if strings.EqualFold(component.Name, "VEVENT") {
+			return true
+		}
+	}
+	return false
+}